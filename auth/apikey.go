@@ -0,0 +1,68 @@
+// Package auth holds the credentials the service accepts and the scopes
+// they grant.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Scopes granted to credentials. ScopeAdmin implies the others.
+const (
+	ScopeRead  = "users:read"
+	ScopeWrite = "users:write"
+	ScopeAdmin = "users:admin"
+)
+
+// Scopes lists every scope.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// apiKeyPrefix marks API keys, so leaked ones are easy to spot.
+const apiKeyPrefix = "usk_"
+
+// NewAPIKey generates a random API key. Only its hash is stored; the key is
+// shown once to whoever created it.
+func NewAPIKey() (key string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating api key: %w", err)
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey hashes a key for storage and lookup. Keys are random, so a
+// plain SHA-256 can't be brute-forced back.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// KeyPrefix is the start of a key, kept in clear to tell keys apart.
+func KeyPrefix(key string) string {
+	return key[:min(len(key), len(apiKeyPrefix)+6)]
+}
+
+// ParseScopes parses a comma or space separated list of scopes.
+func ParseScopes(s string) ([]string, error) {
+	scopes := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scopes, want some of %v", Scopes)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, want some of %v", scope, Scopes)
+		}
+	}
+	return scopes, nil
+}
+
+// HasScope reports whether granted includes scope.
+func HasScope(granted []string, scope string) bool {
+	return slices.Contains(granted, scope) || slices.Contains(granted, ScopeAdmin)
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// Purposes of email tokens. A token is only accepted for the purpose it was
+// issued for.
+const (
+	PurposeVerifyEmail = "verify_email"
+	PurposeChangeEmail = "change_email"
+	PurposeRevertEmail = "revert_email"
+)
+
+// EmailToken is what an email token vouches for: that whoever holds it
+// received mail at Email, sent for the user with UserUuid.
+type EmailToken struct {
+	Id        string
+	UserUuid  string
+	Email     string
+	ExpiresAt time.Time
+}
+
+type emailClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+// EmailTokens issues and checks the tokens sent by email, HS256 JWTs whose
+// audience is their purpose. Each has a random id, so that it can be used
+// once only.
+type EmailTokens struct {
+	key []byte
+}
+
+// NewEmailTokens signs tokens with key.
+func NewEmailTokens(key []byte) *EmailTokens {
+	return &EmailTokens{key: key}
+}
+
+// Issue returns a token for purpose, valid for ttl.
+func (e *EmailTokens) Issue(purpose string, userUuid string, email string, ttl time.Duration) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating token id: %w", err)
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, emailClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{purpose},
+			Subject:   userUuid,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Email: email,
+	})
+	s, err := token.SignedString(e.key)
+	if err != nil {
+		return "", fmt.Errorf("signing email token: %w", err)
+	}
+	return s, nil
+}
+
+// Verify checks a token issued for purpose. Errors wrap ErrInvalidToken.
+func (e *EmailTokens) Verify(purpose string, token string) (*EmailToken, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"HS256"}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(purpose),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	var claims emailClaims
+	if _, err := parser.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return e.key, nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if claims.ID == "" || claims.Subject == "" || claims.Email == "" {
+		return nil, fmt.Errorf("%w: not an email token", ErrInvalidToken)
+	}
+	return &EmailToken{
+		Id:        claims.ID,
+		UserUuid:  claims.Subject,
+		Email:     claims.Email,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
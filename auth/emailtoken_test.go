@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestEmailTokens(t *testing.T) {
+	key, err := NewSigningKey()
+	require.NoError(t, err)
+	tokens := NewEmailTokens(key)
+
+	token, err := tokens.Issue(PurposeVerifyEmail, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "john@example.com", time.Hour)
+	require.NoError(t, err)
+	got, err := tokens.Verify(PurposeVerifyEmail, token)
+	require.NoError(t, err)
+	assert.Equal(t, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", got.UserUuid)
+	assert.Equal(t, "john@example.com", got.Email)
+	assert.Len(t, got.Id, 32)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), got.ExpiresAt, time.Second)
+
+	again, err := tokens.Issue(PurposeVerifyEmail, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "john@example.com", time.Hour)
+	require.NoError(t, err)
+	other, err := tokens.Verify(PurposeVerifyEmail, again)
+	require.NoError(t, err)
+	assert.NotEqual(t, got.Id, other.Id)
+
+	_, err = tokens.Verify("other_purpose", token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "other purpose")
+	expired, err := tokens.Issue(PurposeVerifyEmail, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "john@example.com", -time.Hour)
+	require.NoError(t, err)
+	_, err = tokens.Verify(PurposeVerifyEmail, expired)
+	assert.ErrorIs(t, err, ErrInvalidToken, "expired")
+
+	// The key is shared with access tokens, which must not pass for email
+	// tokens or the other way round.
+	access, _, err := NewAccessTokens(key, time.Minute, nil).Issue("3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "session-1")
+	require.NoError(t, err)
+	_, err = tokens.Verify(PurposeVerifyEmail, access)
+	assert.ErrorIs(t, err, ErrInvalidToken, "access token")
+	_, err = NewAccessTokens(key, time.Minute, nil).Verify(context.Background(), token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "email token")
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKeysUnavailable is returned when the JWKS can't be loaded, which is no
+// fault of the token being checked.
+var ErrKeysUnavailable = errors.New("jwks unavailable")
+
+const (
+	// jwksMinReload bounds how often tokens naming an unknown key make the
+	// set reload, so they can't be used to hammer the issuer.
+	jwksMinReload = 10 * time.Second
+	jwksTimeout   = 5 * time.Second
+	maxJWKSSize   = 1 << 20
+)
+
+// JWKS is a JSON Web Key Set read from a file or an http(s) URL. The set is
+// reloaded every refresh interval, and sooner when a token names a key it
+// doesn't have, so keys rotated by the issuer are picked up. RSA and EC keys
+// are supported.
+type JWKS struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+	triedAt  time.Time
+	// loading is the reload in flight, if any. Callers share it rather than
+	// each fetching the set.
+	loading *jwksLoad
+}
+
+// jwksLoad is a reload of the set. err is set before done is closed.
+type jwksLoad struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksTimeout},
+		now:     time.Now,
+	}
+}
+
+// Load loads the set, e.g. to check it at startup.
+func (s *JWKS) Load(ctx context.Context) error {
+	s.mu.Lock()
+	l := s.reload(ctx)
+	s.mu.Unlock()
+	select {
+	case <-l.done:
+		return l.err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %s: %w", ErrKeysUnavailable, s.source, ctx.Err())
+	}
+}
+
+// Key returns the key with the given id. Without an id, the only key of the
+// set is returned. Known keys are served while the set reloads; only a
+// request for a key the set lacks waits for the reload.
+func (s *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	now := s.now()
+	key, ok := s.lookup(kid)
+	stale := now.Sub(s.loadedAt) >= s.refresh
+	var l *jwksLoad
+	if (stale || !ok) && now.Sub(s.triedAt) >= jwksMinReload {
+		l = s.reload(ctx)
+	} else if !ok {
+		// The reload in flight may bring the key.
+		l = s.loading
+	}
+	s.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if l != nil {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s: %w", ErrKeysUnavailable, s.source, ctx.Err())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		if l != nil && l.err != nil {
+			return nil, l.err
+		}
+		return nil, ErrKeysUnavailable
+	}
+	if key, ok = s.lookup(kid); !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (s *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// reload starts replacing the keys with the ones read from the source, or
+// joins the reload already in flight. The caller must hold the lock, which
+// isn't held while the source is read. The read outlives ctx, as other
+// callers may be waiting for it.
+func (s *JWKS) reload(ctx context.Context) *jwksLoad {
+	if s.loading != nil {
+		return s.loading
+	}
+	l := &jwksLoad{done: make(chan struct{})}
+	s.loading, s.triedAt = l, s.now()
+	triedAt := s.triedAt
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		keys, err := s.fetch(ctx)
+		s.mu.Lock()
+		if err == nil {
+			s.keys, s.loadedAt = keys, triedAt
+		} else if s.keys != nil {
+			// Keep going with the keys we have until the source is back.
+			slog.WarnContext(ctx, "reloading jwks", "source", s.source, "error", err)
+		}
+		s.loading, l.err = nil, err
+		s.mu.Unlock()
+		close(l.done)
+	}()
+	return l
+}
+
+func (s *JWKS) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	b, err := s.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrKeysUnavailable, s.source, err)
+	}
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrKeysUnavailable, s.source, err)
+	}
+	return keys, nil
+}
+
+func (s *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxJWKSSize))
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of a set. Keys of other types or uses
+// are skipped.
+func parseJWKS(b []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var (
+			key crypto.PublicKey
+			err error
+		)
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsa()
+		case "EC":
+			key, err = k.ecdsa()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA or EC signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) rsa() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func (k jwk) ecdsa() (*ecdsa.PublicKey, error) {
+	var (
+		curve     elliptic.Curve
+		ecdhCurve ecdh.Curve
+	)
+	switch k.Crv {
+	case "P-256":
+		curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	x, errX := base64.RawURLEncoding.DecodeString(k.X)
+	y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+	if errX != nil || errY != nil || len(x) != size || len(y) != size {
+		return nil, errors.New("invalid point")
+	}
+	// ecdh rejects points that aren't on the curve.
+	if _, err := ecdhCurve.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+		return nil, errors.New("invalid point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, badly signed,
+// expired or meant for someone else.
+var ErrInvalidToken = errors.New("invalid token")
+
+// jwtLeeway allows for clock skew with the issuer.
+const jwtLeeway = 30 * time.Second
+
+// Principal is who a token was issued to and the scopes it grants.
+type Principal struct {
+	Subject string
+	Scopes  []string
+	// SessionId is set for the access tokens of sessions.
+	SessionId string
+}
+
+// Verifier checks RS256 and ES256 JWTs signed by a key of its JWKS.
+type Verifier struct {
+	keys       *JWKS
+	parser     *jwt.Parser
+	rolesClaim string
+	roleScopes map[string][]string
+}
+
+// NewVerifier accepts tokens from issuer for audience. The roles found in
+// rolesClaim, which may be a dotted path such as realm_access.roles, are
+// granted the scopes roleScopes maps them to.
+func NewVerifier(keys *JWKS, issuer string, audience string, rolesClaim string, roleScopes map[string][]string) *Verifier {
+	return &Verifier{
+		keys: keys,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"RS256", "ES256"}),
+			jwt.WithIssuer(issuer),
+			jwt.WithAudience(audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+			jwt.WithLeeway(jwtLeeway),
+		),
+		rolesClaim: rolesClaim,
+		roleScopes: roleScopes,
+	}
+}
+
+// IsJWT tells JWTs apart from API keys.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks token and returns its principal. Errors wrap ErrInvalidToken,
+// or ErrKeysUnavailable when the token couldn't be checked.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if errors.Is(err, ErrKeysUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	p := &Principal{Subject: sub}
+	for _, role := range v.roles(claims) {
+		for _, scope := range v.roleScopes[role] {
+			if !HasScope(p.Scopes, scope) {
+				p.Scopes = append(p.Scopes, scope)
+			}
+		}
+	}
+	return p, nil
+}
+
+// roles reads the roles claim, a list or a space separated string.
+func (v *Verifier) roles(claims jwt.MapClaims) []string {
+	var value any = map[string]any(claims)
+	for _, name := range strings.Split(v.rolesClaim, ".") {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		var roles []string
+		for _, role := range value {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// ParseRoleScopes parses role=scope pairs. A role listed more than once is
+// granted every scope it is paired with.
+func ParseRoleScopes(pairs []string) (map[string][]string, error) {
+	roleScopes := make(map[string][]string)
+	for _, pair := range pairs {
+		role, scope, ok := strings.Cut(pair, "=")
+		role, scope = strings.TrimSpace(role), strings.TrimSpace(scope)
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid role mapping %q, want role=scope", pair)
+		}
+		scopes, err := ParseScopes(scope)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+		roleScopes[role] = append(roleScopes[role], scopes...)
+	}
+	return roleScopes, nil
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "use": "sig", "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid,
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func TestVerifier(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// The server starts with the EC key only and adds the RSA one later, as
+	// an issuer rotating keys would.
+	var rotated atomic.Bool
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		keys := []map[string]string{ecJWK("ec", &ecKey.PublicKey)}
+		if rotated.Load() {
+			keys = append(keys, rsaJWK("rsa", &rsaKey.PublicKey))
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, time.Hour)
+	now := time.Now()
+	jwks.now = func() time.Time { return now }
+	require.NoError(t, jwks.Load(context.Background()))
+	roleScopes, err := ParseRoleScopes([]string{"viewer=users:read", "editor=users:read", "editor=users:write"})
+	require.NoError(t, err)
+	v := NewVerifier(jwks, "https://issuer.example.com", "users-service", "realm_access.roles", roleScopes)
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"aud": []string{"users-service", "other"},
+			"sub": "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f",
+			"exp": now.Add(time.Minute).Unix(),
+			"iat": now.Unix(),
+			"realm_access": map[string]any{
+				"roles": []string{"editor", "unmapped"},
+			},
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	p, err := v.Verify(context.Background(), sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil)))
+	require.NoError(t, err)
+	assert.Equal(t, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", p.Subject)
+	assert.Equal(t, []string{ScopeRead, ScopeWrite}, p.Scopes)
+
+	for name, token := range map[string]string{
+		"issuer":     sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+		"audience":   sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"aud": "other"})),
+		"expired":    sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})),
+		"no expiry":  sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"exp": nil})),
+		"no subject": sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"sub": nil})),
+		"hmac":       sign(t, jwt.SigningMethodHS256, "ec", []byte("secret"), claims(nil)),
+		"garbage":    "a.b.c",
+	} {
+		_, err := v.Verify(context.Background(), token)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	// A token signed by a key the set doesn't have yet makes it reload, at
+	// most every jwksMinReload.
+	rsaToken := sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"realm_access": map[string]any{"roles": "viewer"}}))
+	rotated.Store(true)
+	_, err = v.Verify(context.Background(), rsaToken)
+	assert.ErrorIs(t, err, ErrInvalidToken, "reloaded too soon")
+	assert.EqualValues(t, 1, fetches.Load())
+
+	now = now.Add(jwksMinReload)
+	p, err = v.Verify(context.Background(), rsaToken)
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeRead}, p.Scopes)
+	assert.EqualValues(t, 2, fetches.Load())
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, time.Hour)
+	assert.ErrorIs(t, jwks.Load(context.Background()), ErrKeysUnavailable)
+	v := NewVerifier(jwks, "iss", "aud", "roles", nil)
+	_, err := v.Verify(context.Background(), "eyJhbGciOiJFUzI1NiJ9.e30.c2ln")
+	assert.ErrorIs(t, err, ErrKeysUnavailable)
+	assert.NotErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWKSReloadDoesNotBlock(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	// Every fetch but the first hangs until released.
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{ecJWK("ec", &ecKey.PublicKey)}})
+	}))
+	defer srv.Close()
+
+	jwks := NewJWKS(srv.URL, time.Hour)
+	require.NoError(t, jwks.Load(context.Background()))
+	jwks.mu.Lock()
+	jwks.triedAt = time.Time{}
+	jwks.mu.Unlock()
+
+	// Tokens naming an unknown key share a single reload.
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.Key(context.Background(), "other")
+			assert.ErrorContains(t, err, "unknown key")
+		}()
+	}
+	require.Eventually(t, func() bool { return fetches.Load() == 2 }, time.Second, time.Millisecond)
+
+	// Meanwhile the keys we have are served.
+	key, err := jwks.Key(context.Background(), "ec")
+	require.NoError(t, err)
+	assert.Equal(t, &ecKey.PublicKey, key)
+
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 2, fetches.Load())
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MaxPasswordLength bounds the work a single login can cause.
+const MaxPasswordLength = 128
+
+// Argon2Params tunes Argon2id. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2Params are the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 4}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// ErrWeakPassword wraps the reason a password is refused.
+var ErrWeakPassword = errors.New("weak password")
+
+// resetTokenPrefix marks password reset tokens, like apiKeyPrefix does API
+// keys.
+const resetTokenPrefix = "usp_"
+
+// NewResetToken generates a password reset token and the hash it is stored
+// under.
+func NewResetToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating reset token: %w", err)
+	}
+	token = resetTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashResetToken(token), nil
+}
+
+// HashResetToken hashes a reset token for storage and lookup, as HashAPIKey
+// does keys.
+func HashResetToken(token string) string {
+	return HashAPIKey(token)
+}
+
+// Passwords hashes passwords with Argon2id and checks them against the
+// password policy.
+type Passwords struct {
+	Params    Argon2Params
+	MinLength int
+	// Denylist holds common and breached passwords, lower-cased.
+	Denylist map[string]struct{}
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// LoadDenylist reads a file with one password per line. Blank lines and
+// lines starting with # are skipped.
+func LoadDenylist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("password denylist: %w", err)
+	}
+	defer f.Close()
+	denylist := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			denylist[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("password denylist %s: %w", path, err)
+	}
+	return denylist, nil
+}
+
+// Check applies the password policy. Errors wrap ErrWeakPassword and say
+// what is wrong.
+func (p *Passwords) Check(password string) error {
+	n := utf8.RuneCountInString(password)
+	switch {
+	case n < p.MinLength:
+		return fmt.Errorf("%w: must be at least %d characters", ErrWeakPassword, p.MinLength)
+	case len(password) > MaxPasswordLength:
+		return fmt.Errorf("%w: must be at most %d bytes", ErrWeakPassword, MaxPasswordLength)
+	}
+	if _, ok := p.Denylist[strings.ToLower(password)]; ok {
+		return fmt.Errorf("%w: too common, it appears in lists of breached passwords", ErrWeakPassword)
+	}
+	return nil
+}
+
+// Hash hashes password with a random salt, encoded in the PHC string format
+// so the parameters travel with the hash.
+func (p *Passwords) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generating salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Params.Iterations, p.Params.Memory, p.Params.Parallelism, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		p.Params.Memory, p.Params.Iterations, p.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether password matches the encoded hash, and whether the
+// hash should be replaced because it was made with other parameters.
+// Malformed hashes never match.
+func (p *Passwords) Verify(password string, encoded string) (ok bool, rehash bool) {
+	params, salt, key, err := decodeHash(encoded)
+	if err != nil || len(password) > MaxPasswordLength {
+		return false, false
+	}
+	got := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return false, false
+	}
+	return true, params != p.Params || len(salt) != argon2SaltLen || len(key) != argon2KeyLen
+}
+
+// VerifyDummy costs as much as Verify, for logins of unknown users to take
+// as long as those of known ones.
+func (p *Passwords) VerifyDummy(password string) {
+	p.dummyOnce.Do(func() {
+		p.dummy, _ = p.Hash("dummy password")
+	})
+	p.Verify(password, p.dummy)
+}
+
+func decodeHash(encoded string) (Argon2Params, []byte, []byte, error) {
+	var (
+		params  Argon2Params
+		version int
+	)
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("not an argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testParams keep tests fast.
+var testParams = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestPasswords(t *testing.T) {
+	p := &Passwords{Params: testParams, MinLength: 8}
+
+	hash, err := p.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"), hash)
+	other, _ := p.Hash("correct horse battery staple")
+	assert.NotEqual(t, hash, other, "hashes are salted")
+
+	ok, rehash := p.Verify("correct horse battery staple", hash)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+	ok, _ = p.Verify("correct horse battery stapler", hash)
+	assert.False(t, ok)
+	ok, _ = p.Verify("anything", "$2a$10$notargon")
+	assert.False(t, ok)
+
+	stronger := &Passwords{Params: Argon2Params{Memory: 128, Iterations: 2, Parallelism: 1}}
+	ok, rehash = stronger.Verify("correct horse battery staple", hash)
+	assert.True(t, ok, "old hashes keep working")
+	assert.True(t, rehash)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "denylist.txt")
+	require.NoError(t, os.WriteFile(file, []byte("# common passwords\nPassword1\n\nqwertyuiop\n"), 0o600))
+	denylist, err := LoadDenylist(file)
+	require.NoError(t, err)
+	assert.Len(t, denylist, 2)
+	p := &Passwords{Params: testParams, MinLength: 8, Denylist: denylist}
+
+	assert.NoError(t, p.Check("correct horse battery staple"))
+	assert.NoError(t, p.Check("pässwörd"), "length counts characters")
+	for _, weak := range []string{"short", "password1", "QWERTYUIOP", strings.Repeat("a", MaxPasswordLength+1)} {
+		assert.ErrorIs(t, p.Check(weak), ErrWeakPassword, weak)
+	}
+}
+
+func TestNewResetToken(t *testing.T) {
+	token, hash, err := NewResetToken()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, "usp_"))
+	assert.Equal(t, HashResetToken(token), hash)
+	other, _, err := NewResetToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
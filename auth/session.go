@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// refreshTokenPrefix marks refresh tokens, like apiKeyPrefix does API keys.
+const refreshTokenPrefix = "usr_"
+
+// tokenIssuer is the issuer of the tokens the service signs, and the
+// audience of its access tokens: it issues them to itself.
+const tokenIssuer = "users-service"
+
+// MinSigningKeyLength is the shortest key HS256 access tokens are signed
+// with.
+const MinSigningKeyLength = 32
+
+// NewRefreshToken generates a random refresh token. Like API keys, only its
+// hash is stored.
+func NewRefreshToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating refresh token: %w", err)
+	}
+	token = refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken hashes a refresh token for storage and lookup, as
+// HashAPIKey does keys.
+func HashRefreshToken(token string) string {
+	return HashAPIKey(token)
+}
+
+// NewSigningKey generates a random key for AccessTokens.
+func NewSigningKey() ([]byte, error) {
+	key := make([]byte, MinSigningKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating signing key: %w", err)
+	}
+	return key, nil
+}
+
+type accessClaims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"sid"`
+}
+
+// SessionChecker reports whether a session of a user is still active.
+type SessionChecker interface {
+	SessionActive(ctx context.Context, userUuid string, id string) (bool, error)
+}
+
+// AccessTokens issues the short-lived access tokens of sessions, HS256 JWTs
+// signed with a key only the service knows, and checks them.
+type AccessTokens struct {
+	key      []byte
+	ttl      time.Duration
+	sessions SessionChecker
+	parser   *jwt.Parser
+}
+
+// NewAccessTokens signs tokens valid for ttl with key. Tokens stop working
+// once sessions no longer has their session active; with nil sessions they
+// work until they expire.
+func NewAccessTokens(key []byte, ttl time.Duration, sessions SessionChecker) *AccessTokens {
+	return &AccessTokens{
+		key:      key,
+		ttl:      ttl,
+		sessions: sessions,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{"HS256"}),
+			jwt.WithIssuer(tokenIssuer),
+			jwt.WithAudience(tokenIssuer),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+			jwt.WithLeeway(jwtLeeway),
+		),
+	}
+}
+
+// Issue returns an access token for the user with the given uuid in a
+// session, and when it expires.
+func (a *AccessTokens) Issue(userUuid string, sessionId string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.ttl)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Audience:  jwt.ClaimStrings{tokenIssuer},
+			Subject:   userUuid,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		SessionId: sessionId,
+	})
+	s, err := token.SignedString(a.key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("signing access token: %w", err)
+	}
+	return s, expiresAt, nil
+}
+
+// Verify checks an access token and that its session is still active. Its
+// principal is the user it was issued to, with no scopes: users may act on
+// themselves only. Errors wrap ErrInvalidToken, unless the session can't be
+// looked up.
+func (a *AccessTokens) Verify(ctx context.Context, token string) (*Principal, error) {
+	var claims accessClaims
+	if _, err := a.parser.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return a.key, nil
+	}); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" || claims.SessionId == "" {
+		return nil, fmt.Errorf("%w: not an access token", ErrInvalidToken)
+	}
+	if a.sessions != nil {
+		active, err := a.sessions.SessionActive(ctx, claims.Subject, claims.SessionId)
+		if err != nil {
+			return nil, fmt.Errorf("checking session: %w", err)
+		}
+		if !active {
+			return nil, fmt.Errorf("%w: session has ended", ErrInvalidToken)
+		}
+	}
+	return &Principal{Subject: claims.Subject, SessionId: claims.SessionId}, nil
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessTokens(t *testing.T) {
+	key, err := NewSigningKey()
+	require.NoError(t, err)
+	tokens := NewAccessTokens(key, time.Minute, nil)
+
+	token, expiresAt, err := tokens.Issue("3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "session-1")
+	require.NoError(t, err)
+	assert.True(t, IsJWT(token))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, time.Second)
+	p, err := tokens.Verify(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, "3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", p.Subject)
+	assert.Equal(t, "session-1", p.SessionId)
+	assert.Empty(t, p.Scopes)
+
+	other, err := NewSigningKey()
+	require.NoError(t, err)
+	forged, _, err := NewAccessTokens(other, time.Minute, nil).Issue("3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "session-1")
+	require.NoError(t, err)
+	expired, _, err := NewAccessTokens(key, -time.Hour, nil).Issue("3f0e4a5c-1d2b-4c3d-8e9f-0a1b2c3d4e5f", "session-1")
+	require.NoError(t, err)
+	for name, token := range map[string]string{
+		"other key":  forged,
+		"expired":    expired,
+		"no session": sign(t, jwt.SigningMethodHS256, "", key, jwt.MapClaims{"iss": "users-service", "aud": "users-service", "sub": "x", "exp": time.Now().Add(time.Minute).Unix()}),
+		"issuer":     sign(t, jwt.SigningMethodHS256, "", key, jwt.MapClaims{"iss": "other", "aud": "users-service", "sub": "x", "sid": "s", "exp": time.Now().Add(time.Minute).Unix()}),
+	} {
+		_, err := tokens.Verify(context.Background(), token)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	sessions := activeSessions{"session-1": true}
+	tokens = NewAccessTokens(key, time.Minute, sessions)
+	_, err = tokens.Verify(context.Background(), token)
+	assert.NoError(t, err)
+	sessions["session-1"] = false
+	_, err = tokens.Verify(context.Background(), token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "ended session")
+}
+
+// activeSessions tells which sessions, by id, are active.
+type activeSessions map[string]bool
+
+func (s activeSessions) SessionActive(_ context.Context, _ string, id string) (bool, error) {
+	return s[id], nil
+}
+
+func TestNewRefreshToken(t *testing.T) {
+	token, hash, err := NewRefreshToken()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, "usr_"))
+	assert.Equal(t, HashRefreshToken(token), hash)
+	assert.False(t, IsJWT(token))
+	other, _, err := NewRefreshToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
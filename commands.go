@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pressly/goose/v3"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/environment"
+)
+
+const migrateUsage = "usage: migrate up|down|status|version|renormalize"
+
+const apiKeyUsage = "usage: apikey create -name NAME -scopes SCOPES | apikey list | apikey revoke ID"
+
+const usage = "usage: [flags] [migrate up|down|status|version|renormalize | apikey create|list|revoke | config print]"
+
+// command runs the subcommand given instead of serving.
+func command(env *environment.Env, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrate(env, args[1:])
+	case "apikey":
+		return apiKey(env, args[1:])
+	case "config":
+		if len(args) != 2 || args[1] != "print" {
+			return errors.New("usage: config print")
+		}
+		return env.Print(os.Stdout)
+	}
+	return errors.New(usage)
+}
+
+// migrate runs the migrate subcommand against the configured database.
+func migrate(env *environment.Env, args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	if env.Db.Driver == "memory" {
+		return errors.New("the memory driver has nothing to migrate")
+	}
+	conn, dialect, err := openDb(env)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		return migrateUp(ctx, conn, dialect, emailNormalization(env.Email))
+	case "renormalize":
+		return renormalize(ctx, conn, dialect, emailNormalization(env.Email))
+	case "down":
+		migrator, err := db.NewMigrator(conn, dialect)
+		if err != nil {
+			return err
+		}
+		res, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Info("rolled back migration", "migration", res.Source.Path)
+	case "status":
+		migrator, err := db.NewMigrator(conn, dialect)
+		if err != nil {
+			return err
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "APPLIED AT\tMIGRATION")
+		for _, st := range statuses {
+			appliedAt := "pending"
+			if st.State == goose.StateApplied {
+				appliedAt = st.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", appliedAt, st.Source.Path)
+		}
+		return w.Flush()
+	case "version":
+		migrator, err := db.NewMigrator(conn, dialect)
+		if err != nil {
+			return err
+		}
+		version, err := migrator.GetDBVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
+
+// migrateUp applies every pending migration. Migrations fill in normalized
+// emails with the default rules only, so they are redone with emailNorm
+// afterwards.
+func migrateUp(ctx context.Context, conn *sql.DB, dialect db.Dialect, emailNorm db.EmailNormalization) error {
+	migrator, err := db.NewMigrator(conn, dialect)
+	if err != nil {
+		return err
+	}
+	results, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		slog.Info("applied migration", "migration", res.Source.Path, "duration", res.Duration.String())
+	}
+	version, err := migrator.GetDBVersion(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("db migrated", "version", version)
+	if len(results) == 0 {
+		return nil
+	}
+	return renormalize(ctx, conn, dialect, emailNorm)
+}
+
+// renormalize recomputes the normalized emails, as needed whenever
+// EMAIL_IGNORE_DOTS or EMAIL_IGNORE_PLUS_TAGS change.
+func renormalize(ctx context.Context, conn *sql.DB, dialect db.Dialect, emailNorm db.EmailNormalization) error {
+	storage := db.NewStorage(conn, db.WithDialect(dialect), db.WithEmailNormalization(emailNorm))
+	n, err := storage.Renormalize(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("renormalized emails", "users", n)
+	return nil
+}
+
+// apiKey runs the apikey subcommand, which manages the API keys in the
+// configured database.
+func apiKey(env *environment.Env, args []string) error {
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+	if env.Db.Driver == "memory" {
+		return errors.New("the memory driver keeps no api keys, use ADMIN_TOKEN")
+	}
+	conn, dialect, err := openDb(env)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	storage := db.NewStorage(conn, db.WithDialect(dialect), db.WithQueryTimeout(env.Db.QueryTimeout))
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := fs.String("name", "", "what the key is for")
+		scopeList := fs.String("scopes", auth.ScopeRead, fmt.Sprintf("comma separated scopes, some of %v", auth.Scopes))
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" || fs.NArg() > 0 {
+			return errors.New(apiKeyUsage)
+		}
+		scopes, err := auth.ParseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		secret, hash, err := auth.NewAPIKey()
+		if err != nil {
+			return err
+		}
+		key, err := storage.AddAPIKey(ctx, db.APIKey{Name: *name, Prefix: auth.KeyPrefix(secret), Hash: hash, Scopes: scopes})
+		if err != nil {
+			return err
+		}
+		slog.Info("created api key", "api_key_id", key.Id, "api_key_name", key.Name, "scopes", key.Scopes)
+		fmt.Fprintf(os.Stderr, "Store the key now, it can't be shown again.\n")
+		fmt.Println(secret)
+	case "list":
+		keys, err := storage.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tCREATED AT\tLAST USED AT\tREVOKED AT")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.Id, key.Name, key.Prefix, strings.Join(key.Scopes, ","),
+				key.CreatedAt.Format(time.RFC3339), formatTime(key.LastUsedAt), formatTime(key.RevokedAt))
+		}
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+		if err := storage.RevokeAPIKey(ctx, args[1]); err != nil {
+			return err
+		}
+		slog.Info("revoked api key", "api_key_id", args[1])
+	default:
+		return errors.New(apiKeyUsage)
+	}
+
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+var ErrAPIKeyNotFound = &Error{Kind: ErrNotFound, Msg: "api key not found"}
+
+// APIKey is an API key as stored: only the hash of the key is kept, along
+// with its first characters to tell keys apart.
+type APIKey struct {
+	Id         string
+	Name       string
+	Prefix     string
+	Hash       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// AddAPIKey stores a new key with the name, prefix, hash and scopes of key.
+func (st *StDb) AddAPIKey(ctx context.Context, key APIKey) (*APIKey, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	key.Id = uuid.New().String()
+	key.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	key.LastUsedAt, key.RevokedAt = nil, nil
+	_, err := st.exec(ctx, "INSERT INTO api_keys (id, name, prefix, key_hash, scopes, created_at) VALUES($1, $2, $3, $4, $5, $6)",
+		key.Id, key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, " "), key.CreatedAt)
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	return &key, nil
+}
+
+// GetAPIKey returns the key with the given hash unless it was revoked.
+func (st *StDb) GetAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	row := st.queryRow(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL", hash)
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		return nil, wrapErr(ctx, err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns every key, revoked ones included, oldest first.
+func (st *StDb) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := st.query(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at, id")
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey stops the key with the given id from authenticating. Revoked
+// keys are kept for the record.
+func (st *StDb) RevokeAPIKey(ctx context.Context, id string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrAPIKeyNotFound
+	}
+	res, err := st.exec(ctx, "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", time.Now(), id)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// TouchAPIKey records that the key was used at the given time.
+func (st *StDb) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	_, err := st.exec(ctx, "UPDATE api_keys SET last_used_at = $1 WHERE id = $2", at, id)
+
+	return wrapErr(ctx, err)
+}
+
+const apiKeyColumns = "id, name, prefix, key_hash, scopes, created_at, last_used_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var (
+		key    APIKey
+		scopes string
+	)
+	if err := row.Scan(&key.Id, &key.Name, &key.Prefix, &key.Hash, &scopes, &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	return &key, nil
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+var ErrCredentialsNotFound = &Error{Kind: ErrNotFound, Msg: "credentials not found"}
+
+// Credentials are the password hash of a user and the state of its lockout
+// after failed logins.
+type Credentials struct {
+	UserUuid       string
+	PasswordHash   string
+	FailedAttempts int
+	LockedUntil    *time.Time
+	UpdatedAt      time.Time
+}
+
+// SetPassword sets the password hash of a user that isn't soft-deleted and
+// lifts any lockout.
+func (st *StDb) SetPassword(ctx context.Context, userUuid string, hash string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var exists int
+	if err := st.queryRow(ctx, "SELECT 1 FROM users WHERE uuid = $1 AND deleted_at IS NULL", userUuid).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return wrapErr(ctx, err)
+	}
+	_, err := st.exec(ctx, `INSERT INTO credentials (user_uuid, password_hash, failed_attempts, updated_at) VALUES($1, $2, 0, $3)
+ON CONFLICT (user_uuid) DO UPDATE SET password_hash = excluded.password_hash, failed_attempts = 0, locked_until = NULL, updated_at = excluded.updated_at`,
+		userUuid, hash, time.Now())
+	if errors.Is(wrapErr(ctx, err), ErrConflict) {
+		// The user was purged meanwhile.
+		return ErrUserNotFound
+	}
+	return wrapErr(ctx, err)
+}
+
+// ChangePassword sets the password hash of a user as SetPassword does and,
+// in the same transaction, revokes the user's sessions other than the one
+// with the id keepSessionId, if any: whoever knew the old password may be
+// logged in.
+func (st *StDb) ChangePassword(ctx context.Context, userUuid string, hash string, keepSessionId string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	return st.inTx(ctx, func(tx *StDb) error {
+		if err := tx.SetPassword(ctx, userUuid, hash); err != nil {
+			return err
+		}
+		if _, err := uuid.Parse(keepSessionId); err != nil {
+			_, err := tx.RevokeSessions(ctx, userUuid)
+			return err
+		}
+		now := time.Now()
+		_, err := tx.exec(ctx, "UPDATE sessions SET revoked_at = $1 WHERE user_uuid = $2 AND id <> $3 AND revoked_at IS NULL AND expires_at > $1",
+			now, userUuid, keepSessionId)
+		return wrapErr(ctx, err)
+	})
+}
+
+// GetCredentials returns the credentials of a user that isn't soft-deleted.
+func (st *StDb) GetCredentials(ctx context.Context, userUuid string) (*Credentials, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	row := st.queryRow(ctx, "SELECT "+credentialsColumns+" FROM credentials c JOIN users u ON u.uuid = c.user_uuid WHERE c.user_uuid = $1 AND u.deleted_at IS NULL", userUuid)
+	return st.scanCredentials(ctx, row)
+}
+
+// GetCredentialsByEmail returns the credentials of the user with the email,
+// compared like duplicates are.
+func (st *StDb) GetCredentialsByEmail(ctx context.Context, email string) (*Credentials, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	row := st.queryRow(ctx, "SELECT "+credentialsColumns+" FROM credentials c JOIN users u ON u.uuid = c.user_uuid WHERE u.email_normalized = $1 AND u.deleted_at IS NULL", st.emailNorm.Normalize(email))
+	return st.scanCredentials(ctx, row)
+}
+
+// RecordLogin resets the failed logins of a user after a successful one,
+// and replaces the password hash with rehash unless it is empty.
+func (st *StDb) RecordLogin(ctx context.Context, userUuid string, rehash string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var err error
+	if rehash != "" {
+		_, err = st.exec(ctx, "UPDATE credentials SET password_hash = $2, failed_attempts = 0, locked_until = NULL, updated_at = $3 WHERE user_uuid = $1",
+			userUuid, rehash, time.Now())
+	} else {
+		_, err = st.exec(ctx, "UPDATE credentials SET failed_attempts = 0, locked_until = NULL WHERE user_uuid = $1 AND (failed_attempts > 0 OR locked_until IS NOT NULL)",
+			userUuid)
+	}
+	return wrapErr(ctx, err)
+}
+
+// RecordFailedLogin counts a failed login of a user. The maxAttempts-th
+// failure in a row locks the user out for lockout and starts counting anew.
+func (st *StDb) RecordFailedLogin(ctx context.Context, userUuid string, maxAttempts int, lockout time.Duration) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	_, err := st.exec(ctx, `UPDATE credentials SET
+failed_attempts = CASE WHEN failed_attempts + 1 >= $2 THEN 0 ELSE failed_attempts + 1 END,
+locked_until = CASE WHEN failed_attempts + 1 >= $2 THEN $3 ELSE locked_until END
+WHERE user_uuid = $1`, userUuid, maxAttempts, time.Now().Add(lockout))
+
+	return wrapErr(ctx, err)
+}
+
+const credentialsColumns = "c.user_uuid, c.password_hash, c.failed_attempts, c.locked_until, c.updated_at"
+
+func (st *StDb) scanCredentials(ctx context.Context, row *sql.Row) (*Credentials, error) {
+	var creds Credentials
+	if err := row.Scan(&creds.UserUuid, &creds.PasswordHash, &creds.FailedAttempts, &creds.LockedUntil, &creds.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCredentialsNotFound
+		}
+		return nil, wrapErr(ctx, err)
+	}
+	return &creds, nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Dialect is the flavour of SQL spoken by the database behind StDb. Queries
+// are written for Postgres and rewritten for the other dialects.
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	SQLite
+)
+
+// ParseDialect maps a DB_DRIVER value to its dialect.
+func ParseDialect(driver string) (Dialect, error) {
+	switch driver {
+	case "", "postgres":
+		return Postgres, nil
+	case "sqlite":
+		return SQLite, nil
+	}
+	return 0, fmt.Errorf("unknown db driver %q", driver)
+}
+
+// DriverName is the database/sql driver to open connections with.
+func (d Dialect) DriverName() string {
+	if d == SQLite {
+		return "sqlite"
+	}
+	return "postgres"
+}
+
+func (d Dialect) String() string {
+	return d.DriverName()
+}
+
+// WithDialect tells the storage which database it talks to. Postgres is the
+// default.
+func WithDialect(d Dialect) Option {
+	return func(st *StDb) {
+		st.dialect = d
+	}
+}
+
+// Open connects to the database. SQLite gets a single connection, so an
+// in-memory database is shared by every query and writers never race for
+// the file lock, and LIKE made case sensitive as it is in Postgres. Its
+// pragmas are per connection, so they go in the DSN for the driver to apply
+// whenever it reconnects.
+func Open(d Dialect, dsn string) (*sql.DB, error) {
+	if d == SQLite {
+		dsn = withSQLitePragmas(dsn)
+	}
+	conn, err := sql.Open(d.DriverName(), dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d == SQLite {
+		conn.SetMaxOpenConns(1)
+	}
+	return conn, nil
+}
+
+var sqlitePragmas = []string{"busy_timeout(5000)", "foreign_keys(1)", "case_sensitive_like(1)"}
+
+func withSQLitePragmas(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	for _, pragma := range sqlitePragmas {
+		dsn += sep + "_pragma=" + url.QueryEscape(pragma)
+		sep = "&"
+	}
+	return dsn
+}
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// sqliteTime is how times are stored in SQLite, which has no time type:
+// fixed width and in UTC, so they compare correctly as text.
+const sqliteTime = "2006-01-02 15:04:05.000"
+
+// rebind rewrites a Postgres query and its arguments for the dialect.
+// Numbered $n placeholders become SQLite's ?n, which keeps reused and out of
+// order parameters working.
+func (d Dialect) rebind(query string, args []any) (string, []any) {
+	if d != SQLite {
+		return query, args
+	}
+	bound := make([]any, len(args))
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC().Format(sqliteTime)
+		}
+		bound[i] = arg
+	}
+	return placeholder.ReplaceAllString(query, "?$1"), bound
+}
+
+// likeEscape is the ESCAPE clause LIKE patterns built by escapeLike need.
+// Postgres uses backslash by default, SQLite has no escape character.
+func (d Dialect) likeEscape() string {
+	if d == SQLite {
+		return ` ESCAPE '\'`
+	}
+	return ""
+}
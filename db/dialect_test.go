@@ -0,0 +1,25 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOpenSQLitePragmasEveryConnection(t *testing.T) {
+	t.Parallel()
+	conn, err := Open(SQLite, "file:pragmas?mode=memory")
+	assert.NoError(t, err)
+	defer conn.Close()
+	// Every query gets a new connection.
+	conn.SetMaxIdleConns(0)
+	for range 2 {
+		for pragma, want := range map[string]int{"busy_timeout": 5000, "foreign_keys": 1} {
+			var got int
+			assert.NoError(t, conn.QueryRow("PRAGMA "+pragma).Scan(&got))
+			assert.Equal(t, want, got, pragma)
+		}
+		var like bool
+		assert.NoError(t, conn.QueryRow("SELECT 'a' LIKE 'A'").Scan(&like))
+		assert.False(t, like)
+	}
+}
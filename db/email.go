@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EmailNormalization controls how emails are folded before the uniqueness
+// check. Emails are always trimmed and lower-cased.
+type EmailNormalization struct {
+	// IgnoreDots drops dots from the local part of Gmail addresses, which
+	// Gmail itself ignores.
+	IgnoreDots bool
+	// IgnorePlusTags drops a "+tag" suffix from the local part.
+	IgnorePlusTags bool
+}
+
+var gmailDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+}
+
+func (n EmailNormalization) Normalize(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	if n.IgnorePlusTags {
+		if i := strings.Index(local, "+"); i > 0 {
+			local = local[:i]
+		}
+	}
+	if n.IgnoreDots && gmailDomains[domain] {
+		local = strings.ReplaceAll(local, ".", "")
+		domain = "gmail.com"
+	}
+
+	return local + "@" + domain
+}
+
+// DuplicateEmailsError is returned by Renormalize when several users would
+// share an email once normalized. Users maps each such normalized email to
+// the uuids of its users.
+type DuplicateEmailsError struct {
+	Users map[string][]string
+}
+
+func (e *DuplicateEmailsError) Error() string {
+	emails := make([]string, 0, len(e.Users))
+	for email := range e.Users {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for i, email := range emails {
+		emails[i] = fmt.Sprintf("%s (%s)", email, strings.Join(e.Users[email], ", "))
+	}
+	return fmt.Sprintf("%d emails are shared by several users once normalized: %s", len(emails), strings.Join(emails, "; "))
+}
+
+func (e *DuplicateEmailsError) Unwrap() error {
+	return ErrConflict
+}
+
+// Renormalize recomputes the normalized email of every user, soft-deleted
+// ones included, with the storage's EmailNormalization. It has to run
+// whenever the normalization changes. If that would make several users share
+// an email, nothing is changed and a *DuplicateEmailsError lists them. It
+// returns how many users were updated.
+func (st *StDb) Renormalize(ctx context.Context) (int, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	type change struct {
+		uuid       string
+		normalized string
+	}
+	var changes []change
+	err := st.inTx(ctx, func(tx *StDb) error {
+		rows, err := tx.query(ctx, "SELECT uuid, email, email_normalized FROM users ORDER BY uuid")
+		if err != nil {
+			return wrapErr(ctx, err)
+		}
+		defer rows.Close()
+		owners := make(map[string][]string)
+		for rows.Next() {
+			var uuid, email, current string
+			if err := rows.Scan(&uuid, &email, &current); err != nil {
+				return wrapErr(ctx, err)
+			}
+			normalized := st.emailNorm.Normalize(email)
+			owners[normalized] = append(owners[normalized], uuid)
+			if normalized != current {
+				changes = append(changes, change{uuid: uuid, normalized: normalized})
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return wrapErr(ctx, err)
+		}
+		rows.Close()
+
+		dups := make(map[string][]string)
+		for email, uuids := range owners {
+			if len(uuids) > 1 {
+				dups[email] = uuids
+			}
+		}
+		if len(dups) > 0 {
+			return &DuplicateEmailsError{Users: dups}
+		}
+		// Parking the changed rows on their uuid first keeps users trading
+		// normalized emails from tripping the unique index halfway.
+		for _, c := range changes {
+			if _, err := tx.exec(ctx, "UPDATE users SET email_normalized = $1 WHERE uuid = $2", c.uuid, c.uuid); err != nil {
+				return wrapErr(ctx, err)
+			}
+		}
+		for _, c := range changes {
+			if _, err := tx.exec(ctx, "UPDATE users SET email_normalized = $1 WHERE uuid = $2", c.normalized, c.uuid); err != nil {
+				return wrapErr(ctx, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
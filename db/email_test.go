@@ -0,0 +1,25 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		norm  EmailNormalization
+		email string
+		want  string
+	}{
+		{EmailNormalization{}, "  John.Doe+news@Example.COM ", "john.doe+news@example.com"},
+		{EmailNormalization{IgnorePlusTags: true}, "john.doe+news@example.com", "john.doe@example.com"},
+		{EmailNormalization{IgnoreDots: true}, "john.doe@example.com", "john.doe@example.com"},
+		{EmailNormalization{IgnoreDots: true}, "John.Doe@googlemail.com", "johndoe@gmail.com"},
+		{EmailNormalization{IgnoreDots: true, IgnorePlusTags: true}, "j.o.h.n+x@gmail.com", "john@gmail.com"},
+		{EmailNormalization{IgnorePlusTags: true}, "+tag@example.com", "+tag@example.com"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, c.norm.Normalize(c.email), c.email)
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrNoEmailChange = &Error{Kind: ErrConflict, Msg: "no such email change is pending"}
+
+// RequestEmailChange records email as the pending email of a user, replacing
+// any earlier one, and returns the user, whose email is unchanged. It fails
+// with ErrEmailTaken if another user has the email; as someone may take it
+// in the meantime, that is checked again on confirmation.
+func (st *StDb) RequestEmailChange(ctx context.Context, uuid string, email string) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var owner string
+	err := st.queryRow(ctx, "SELECT uuid FROM users WHERE email_normalized = $1", st.emailNorm.Normalize(email)).Scan(&owner)
+	if err == nil && owner != uuid {
+		return nil, ErrEmailTaken
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, wrapErr(ctx, err)
+	}
+
+	var user User
+	row := st.queryRow(ctx, "UPDATE users SET pending_email = $1 WHERE uuid = $2 AND deleted_at IS NULL RETURNING uuid, name, email, version, email_verified_at",
+		strings.TrimSpace(email), uuid)
+	if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.EmailVerifiedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, wrapErr(ctx, err)
+	}
+	return &user, nil
+}
+
+// ConfirmEmailChange swaps the email of a user for email, provided it is
+// still the pending one, or returns ErrNoEmailChange. The new email is
+// verified, as confirming proves the user owns it. Like VerifyEmail, it uses
+// token up in the same transaction.
+func (st *StDb) ConfirmEmailChange(ctx context.Context, uuid string, email string, token UsedToken) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+	err := st.inTx(ctx, func(tx *StDb) error {
+		if err := tx.useToken(ctx, token); err != nil {
+			return err
+		}
+		row := tx.queryRow(ctx, "UPDATE users SET email = $1, email_normalized = $2, email_verified_at = $3, pending_email = NULL, updated_at = $3, version = version + 1 WHERE uuid = $4 AND deleted_at IS NULL AND pending_email = $1 RETURNING uuid, name, email, version, email_verified_at",
+			email, tx.emailNorm.Normalize(email), time.Now(), uuid)
+		if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.EmailVerifiedAt); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := tx.GetUser(ctx, uuid, false); err != nil {
+					return err
+				}
+				return ErrNoEmailChange
+			}
+			return wrapErr(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// RevertEmailChange gives a user back their former email and drops any
+// pending change. The email is verified, as reverting proves the user owns
+// it. It fails with ErrEmailTaken if someone took the email since. Like
+// VerifyEmail, it uses token up in the same transaction.
+func (st *StDb) RevertEmailChange(ctx context.Context, uuid string, email string, token UsedToken) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+	err := st.inTx(ctx, func(tx *StDb) error {
+		if err := tx.useToken(ctx, token); err != nil {
+			return err
+		}
+		row := tx.queryRow(ctx, "UPDATE users SET email = $1, email_normalized = $2, email_verified_at = COALESCE(CASE WHEN email = $1 THEN email_verified_at END, $3), pending_email = NULL, updated_at = $3, version = version + 1 WHERE uuid = $4 AND deleted_at IS NULL RETURNING uuid, name, email, version, email_verified_at",
+			email, tx.emailNorm.Normalize(email), time.Now(), uuid)
+		if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.EmailVerifiedAt); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrUserNotFound
+			}
+			return wrapErr(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"net"
+	"strings"
+)
+
+// Error kinds. Every error returned by the storage wraps exactly one of them,
+// so callers can classify failures with errors.Is.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrInvalidInput = errors.New("invalid input")
+	ErrUnavailable  = errors.New("storage unavailable")
+	ErrInternal     = errors.New("internal storage error")
+)
+
+var (
+	ErrUserNotFound  = &Error{Kind: ErrNotFound, Msg: "user not found"}
+	ErrEmailTaken    = &Error{Kind: ErrConflict, Msg: "email already taken"}
+	ErrStale         = &Error{Kind: ErrConflict, Msg: "user was modified by someone else"}
+	ErrInvalidCursor = &Error{Kind: ErrInvalidInput, Msg: "invalid cursor"}
+	ErrInvalidFilter = &Error{Kind: ErrInvalidInput, Msg: "invalid filter"}
+)
+
+// KindName names the kind of err, e.g. for metric labels: not_found,
+// conflict, invalid_input, unavailable or internal.
+func KindName(err error) string {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrConflict):
+		return "conflict"
+	case errors.Is(err, ErrInvalidInput):
+		return "invalid_input"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	default:
+		return "internal"
+	}
+}
+
+// Error is a storage failure of a given Kind. Its message is safe to show to
+// clients; the driver error it was built from is only reachable through
+// Unwrap, so it can be logged but never leaks by accident.
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// wrapErr classifies a driver error. Errors that are already classified are
+// returned as is. Whatever the driver reports, a failure after the context
+// was cancelled or timed out counts as the storage being unavailable.
+func wrapErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return &Error{Kind: ErrUnavailable, Msg: ErrUnavailable.Error(), Err: errors.Join(ctxErr, err)}
+	}
+	if isUniqueViolation(err, "users", "email_normalized") {
+		return ErrEmailTaken
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// A row breaking a NOT NULL or CHECK constraint is bad input however
+		// often it is retried; only clashes with other rows are conflicts.
+		switch pqErr.Code {
+		case "23502", "23514":
+			return &Error{Kind: ErrInvalidInput, Msg: ErrInvalidInput.Error(), Err: err}
+		case "23505", "23P01":
+			return &Error{Kind: ErrConflict, Msg: ErrConflict.Error(), Err: err}
+		}
+		switch pqErr.Code.Class() {
+		case "22":
+			return &Error{Kind: ErrInvalidInput, Msg: ErrInvalidInput.Error(), Err: err}
+		case "23":
+			// Foreign keys: the row referred to went away meanwhile.
+			return &Error{Kind: ErrConflict, Msg: ErrConflict.Error(), Err: err}
+		case "08", "53", "57":
+			return &Error{Kind: ErrUnavailable, Msg: ErrUnavailable.Error(), Err: err}
+		}
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_NOTNULL, sqlite3.SQLITE_CONSTRAINT_CHECK:
+			return &Error{Kind: ErrInvalidInput, Msg: ErrInvalidInput.Error(), Err: err}
+		}
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_MISMATCH, sqlite3.SQLITE_TOOBIG, sqlite3.SQLITE_RANGE:
+			return &Error{Kind: ErrInvalidInput, Msg: ErrInvalidInput.Error(), Err: err}
+		case sqlite3.SQLITE_CONSTRAINT:
+			return &Error{Kind: ErrConflict, Msg: ErrConflict.Error(), Err: err}
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL:
+			return &Error{Kind: ErrUnavailable, Msg: ErrUnavailable.Error(), Err: err}
+		}
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.As(err, &netErr) {
+		return &Error{Kind: ErrUnavailable, Msg: ErrUnavailable.Error(), Err: err}
+	}
+
+	return &Error{Kind: ErrInternal, Msg: ErrInternal.Error(), Err: err}
+}
+
+// isUniqueViolation reports whether err breaks the unique index on
+// table.column. Postgres names the index, <table>_<column>_key by convention
+// here, while SQLite only names the column.
+func isUniqueViolation(err error, table, column string) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" && pqErr.Constraint == table+"_"+column+"_key"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE &&
+			strings.Contains(sqliteErr.Error(), table+"."+column)
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWrapErrPostgresCodes(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		code pq.ErrorCode
+		want error
+	}{
+		{"23505", ErrConflict},
+		{"23P01", ErrConflict},
+		{"23503", ErrConflict},
+		{"23502", ErrInvalidInput},
+		{"23514", ErrInvalidInput},
+		{"22001", ErrInvalidInput},
+		{"22P02", ErrInvalidInput},
+		{"08006", ErrUnavailable},
+		{"XX000", ErrInternal},
+	}
+	for _, c := range cases {
+		err := wrapErr(context.Background(), &pq.Error{Code: c.code})
+		assert.True(t, errors.Is(err, c.want), "%s: got %v", c.code, err)
+	}
+}
+
+func TestWrapErrSQLiteConstraints(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	conn, err := Open(SQLite, ":memory:")
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Exec("CREATE TABLE t (id INTEGER PRIMARY KEY, n INTEGER NOT NULL CHECK (n > 0))")
+	assert.NoError(t, err)
+	_, err = conn.Exec("INSERT INTO t (id, n) VALUES (1, 1)")
+	assert.NoError(t, err)
+
+	_, err = conn.Exec("INSERT INTO t (id, n) VALUES (1, 2)")
+	assert.ErrorIs(t, wrapErr(ctx, err), ErrConflict)
+	_, err = conn.Exec("INSERT INTO t (id, n) VALUES (2, NULL)")
+	assert.ErrorIs(t, wrapErr(ctx, err), ErrInvalidInput)
+	_, err = conn.Exec("INSERT INTO t (id, n) VALUES (2, 0)")
+	assert.ErrorIs(t, wrapErr(ctx, err), ErrInvalidInput)
+}
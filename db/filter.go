@@ -0,0 +1,281 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// userSortColumns whitelists the columns users can be ordered by. Users that
+// were never updated sort by their creation time.
+var userSortColumns = map[string]string{
+	"created_at": "created_at",
+	"updated_at": "COALESCE(updated_at, created_at)",
+	"name":       "name",
+	"email":      "email",
+}
+
+type UserFilter struct {
+	NamePrefix  string
+	EmailDomain string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	UpdatedFrom time.Time
+	UpdatedTo   time.Time
+	// Verified, when set, keeps users whose email is verified, or not.
+	Verified  *bool
+	Sort      string
+	Desc      bool
+	Cursor    string
+	Limit     int
+	WithTotal bool
+}
+
+type UserPage struct {
+	Users      []User
+	NextCursor string
+	Total      *int
+}
+
+func (f UserFilter) sortColumn() string {
+	if f.Sort == "" {
+		return "created_at"
+	}
+	return f.Sort
+}
+
+func (f UserFilter) limit() int {
+	if f.Limit <= 0 {
+		return DefaultPageSize
+	}
+	if f.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return f.Limit
+}
+
+// where builds the filter conditions shared by the page and count queries.
+func (f UserFilter) where(d Dialect) ([]string, []any) {
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.NamePrefix != "" {
+		add("name LIKE $%d"+d.likeEscape(), escapeLike(f.NamePrefix)+"%")
+	}
+	if f.EmailDomain != "" {
+		add("LOWER(email) LIKE $%d"+d.likeEscape(), "%@"+escapeLike(strings.ToLower(f.EmailDomain)))
+	}
+	if !f.CreatedFrom.IsZero() {
+		add("created_at >= $%d", f.CreatedFrom)
+	}
+	if !f.CreatedTo.IsZero() {
+		add("created_at < $%d", f.CreatedTo)
+	}
+	if !f.UpdatedFrom.IsZero() {
+		add("updated_at >= $%d", f.UpdatedFrom)
+	}
+	if !f.UpdatedTo.IsZero() {
+		add("updated_at < $%d", f.UpdatedTo)
+	}
+	if f.Verified != nil && *f.Verified {
+		where = append(where, "email_verified_at IS NOT NULL")
+	} else if f.Verified != nil {
+		where = append(where, "email_verified_at IS NULL")
+	}
+
+	return where, args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	Uuid  string `json:"u"`
+}
+
+func encodeCursor(sort string, desc bool, last User) string {
+	c := cursor{Sort: sort, Desc: desc, Uuid: last.Uuid}
+	switch sort {
+	case "created_at":
+		c.Value = last.CreatedAt.Format(time.RFC3339Nano)
+	case "updated_at":
+		t := last.CreatedAt
+		if last.UpdatedAt != nil {
+			t = *last.UpdatedAt
+		}
+		c.Value = t.Format(time.RFC3339Nano)
+	case "name":
+		c.Value = last.Name
+	case "email":
+		c.Value = last.Email
+	}
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Uuid == "" {
+		return nil, ErrInvalidCursor
+	}
+	if _, ok := userSortColumns[c.Sort]; !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+func (c *cursor) sortValue() (any, error) {
+	switch c.Sort {
+	case "created_at", "updated_at":
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return t, nil
+	default:
+		return c.Value, nil
+	}
+}
+
+// Paginate applies the filter to users held in memory, with the same
+// semantics as StDb.ListUsers, so storages without SQL can share them.
+// Soft-deleted users are skipped.
+func (f UserFilter) Paginate(users []User) (*UserPage, error) {
+	col := f.sortColumn()
+	if _, ok := userSortColumns[col]; !ok {
+		return nil, fmt.Errorf("%w: unknown sort column %q", ErrInvalidFilter, f.Sort)
+	}
+	var after *User
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != col || c.Desc != f.Desc {
+			return nil, fmt.Errorf("%w: cursor was issued for a different sort order", ErrInvalidCursor)
+		}
+		value, err := c.sortValue()
+		if err != nil {
+			return nil, err
+		}
+		after = &User{Uuid: c.Uuid}
+		switch v := value.(type) {
+		case time.Time:
+			after.CreatedAt = v
+		case string:
+			after.Name, after.Email = v, v
+		}
+	}
+
+	page := &UserPage{Users: []User{}}
+	var matched []User
+	for _, u := range users {
+		if f.match(u) {
+			matched = append(matched, u)
+		}
+	}
+	if f.WithTotal {
+		total := len(matched)
+		page.Total = &total
+	}
+	less := func(a, b User) bool {
+		cmp := compareUsers(a, b, col)
+		if f.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return less(matched[i], matched[j])
+	})
+
+	limit := f.limit()
+	for _, u := range matched {
+		if after != nil && !less(*after, u) {
+			continue
+		}
+		if len(page.Users) == limit {
+			page.NextCursor = encodeCursor(col, f.Desc, page.Users[limit-1])
+			break
+		}
+		page.Users = append(page.Users, u)
+	}
+
+	return page, nil
+}
+
+func (f UserFilter) match(u User) bool {
+	if u.DeletedAt != nil {
+		return false
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(u.Name, f.NamePrefix) {
+		return false
+	}
+	if f.EmailDomain != "" && !strings.HasSuffix(strings.ToLower(u.Email), "@"+strings.ToLower(f.EmailDomain)) {
+		return false
+	}
+	if !f.CreatedFrom.IsZero() && u.CreatedAt.Before(f.CreatedFrom) {
+		return false
+	}
+	if !f.CreatedTo.IsZero() && !u.CreatedAt.Before(f.CreatedTo) {
+		return false
+	}
+	if !f.UpdatedFrom.IsZero() && (u.UpdatedAt == nil || u.UpdatedAt.Before(f.UpdatedFrom)) {
+		return false
+	}
+	if !f.UpdatedTo.IsZero() && (u.UpdatedAt == nil || !u.UpdatedAt.Before(f.UpdatedTo)) {
+		return false
+	}
+	if f.Verified != nil && *f.Verified != (u.EmailVerifiedAt != nil) {
+		return false
+	}
+	return true
+}
+
+// compareUsers orders users by the sort column, then by uuid. A cursor
+// position is a User with the sort value in CreatedAt, Name and Email.
+func compareUsers(a, b User, col string) int {
+	var cmp int
+	switch col {
+	case "created_at":
+		cmp = a.CreatedAt.Compare(b.CreatedAt)
+	case "updated_at":
+		cmp = sortTime(a).Compare(sortTime(b))
+	case "name":
+		cmp = strings.Compare(a.Name, b.Name)
+	case "email":
+		cmp = strings.Compare(a.Email, b.Email)
+	}
+	if cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(a.Uuid, b.Uuid)
+}
+
+func sortTime(u User) time.Time {
+	if u.UpdatedAt != nil {
+		return *u.UpdatedAt
+	}
+	return u.CreatedAt
+}
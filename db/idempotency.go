@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var ErrIdempotencyKeyNotFound = &Error{Kind: ErrNotFound, Msg: "idempotency key not found"}
+
+// IdempotencyRecord is the response stored for an Idempotency-Key of a
+// client. Status is zero while the request that claimed the key is still
+// being processed.
+type IdempotencyRecord struct {
+	Client      string
+	Key         string
+	RequestHash string
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// ClaimIdempotencyKey reserves the key of a client for a request with the
+// given hash, for at most lease unless it is completed or released earlier.
+// It returns nil if the caller now owns the key and must complete or release
+// it, or the record of whoever claimed the key first. A pending claim whose
+// lease ran out, e.g. because its request crashed, is taken over, and so is
+// an expired key DeleteExpiredIdempotencyKeys hasn't dropped yet.
+func (st *StDb) ClaimIdempotencyKey(ctx context.Context, client string, key string, requestHash string, ttl time.Duration, lease time.Duration) (*IdempotencyRecord, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	res, err := st.exec(ctx, "INSERT INTO idempotency_keys (client, key, request_hash, created_at, expires_at, locked_until) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (client, key) DO NOTHING",
+		client, key, requestHash, now, now.Add(ttl), now.Add(lease))
+	if claimed, err := claimedOne(res, err); err != nil || claimed {
+		return nil, wrapErr(ctx, err)
+	}
+	res, err = st.exec(ctx, `UPDATE idempotency_keys SET request_hash = $1, status = 0, headers = NULL, body = NULL, created_at = $5, expires_at = $6, locked_until = $2
+WHERE client = $3 AND key = $4 AND (expires_at < $5 OR status = 0 AND (locked_until IS NULL OR locked_until < $5))`,
+		requestHash, now.Add(lease), client, key, now, now.Add(ttl))
+	if claimed, err := claimedOne(res, err); err != nil || claimed {
+		return nil, wrapErr(ctx, err)
+	}
+
+	var (
+		rec     IdempotencyRecord
+		headers sql.NullString
+	)
+	row := st.queryRow(ctx, "SELECT client, key, request_hash, status, headers, body FROM idempotency_keys WHERE client = $1 AND key = $2", client, key)
+	if err := row.Scan(&rec.Client, &rec.Key, &rec.RequestHash, &rec.Status, &headers, &rec.Body); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrIdempotencyKeyNotFound
+		}
+		return nil, wrapErr(ctx, err)
+	}
+	if headers.Valid {
+		if err := json.Unmarshal([]byte(headers.String), &rec.Header); err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+	}
+
+	return &rec, nil
+}
+
+// DeleteExpiredIdempotencyKeys drops the keys whose ttl ran out.
+func (st *StDb) DeleteExpiredIdempotencyKeys(ctx context.Context) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	_, err := st.exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at < $1", time.Now())
+	return wrapErr(ctx, err)
+}
+
+// claimedOne reports whether the statement changed a row.
+func claimedOne(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// CompleteIdempotencyKey stores the response for a claimed key so later
+// requests of the client with the same key get it replayed.
+func (st *StDb) CompleteIdempotencyKey(ctx context.Context, client string, key string, status int, header http.Header, body []byte) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	headers, err := json.Marshal(header)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	_, err = st.exec(ctx, "UPDATE idempotency_keys SET status = $1, headers = $2, body = $3, locked_until = NULL WHERE client = $4 AND key = $5",
+		status, string(headers), body, client, key)
+
+	return wrapErr(ctx, err)
+}
+
+// ReleaseIdempotencyKey gives up a claimed key, letting the request be retried.
+// Completed keys are kept.
+func (st *StDb) ReleaseIdempotencyKey(ctx context.Context, client string, key string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	_, err := st.exec(ctx, "DELETE FROM idempotency_keys WHERE client = $1 AND key = $2 AND status = 0", client, key)
+
+	return wrapErr(ctx, err)
+}
@@ -0,0 +1,836 @@
+// Package memory is an in-memory storage with the same semantics as the
+// Postgres one in package db. It is meant for tests and local development.
+package memory
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"user-service/db"
+)
+
+type Storage struct {
+	mu          sync.RWMutex
+	users       map[string]*db.User
+	emails      map[string]string
+	idempotency map[idempotencyKey]*idempotencyEntry
+	apiKeys     []*db.APIKey
+	credentials map[string]*db.Credentials
+	sessions    map[string]*session
+	// rotated maps the hashes of rotated refresh tokens to their session.
+	rotated    map[string]string
+	usedTokens map[string]time.Time
+	// pendingEmails maps users to the email they asked to change to.
+	pendingEmails map[string]string
+	// passwordResets maps users to their password reset token.
+	passwordResets map[string]passwordReset
+	emailNorm      db.EmailNormalization
+}
+
+type session struct {
+	db.Session
+	refreshHash string
+}
+
+type passwordReset struct {
+	tokenHash string
+	expiresAt time.Time
+}
+
+type idempotencyKey struct {
+	client string
+	key    string
+}
+
+type idempotencyEntry struct {
+	record      db.IdempotencyRecord
+	expiresAt   time.Time
+	lockedUntil time.Time
+}
+
+type Option func(*Storage)
+
+// WithEmailNormalization sets the rules used to detect duplicate emails.
+func WithEmailNormalization(n db.EmailNormalization) Option {
+	return func(st *Storage) {
+		st.emailNorm = n
+	}
+}
+
+func NewStorage(opts ...Option) *Storage {
+	st := &Storage{
+		users:          map[string]*db.User{},
+		emails:         map[string]string{},
+		idempotency:    map[idempotencyKey]*idempotencyEntry{},
+		credentials:    map[string]*db.Credentials{},
+		sessions:       map[string]*session{},
+		rotated:        map[string]string{},
+		usedTokens:     map[string]time.Time{},
+		pendingEmails:  map[string]string{},
+		passwordResets: map[string]passwordReset{},
+	}
+	for _, opt := range opts {
+		opt(st)
+	}
+	return st
+}
+
+// now matches the millisecond precision of the Postgres timestamps.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func (st *Storage) AddUser(ctx context.Context, name string, email string) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	normalized := st.emailNorm.Normalize(email)
+	if _, ok := st.emails[normalized]; ok {
+		return nil, db.ErrEmailTaken
+	}
+	user := &db.User{
+		Uuid:      uuid.New().String(),
+		Name:      name,
+		Email:     strings.TrimSpace(email),
+		Version:   1,
+		CreatedAt: now(),
+	}
+	st.users[user.Uuid] = user
+	st.emails[normalized] = user.Uuid
+
+	return copyUser(user), nil
+}
+
+func (st *Storage) GetUser(ctx context.Context, uuid string, withDeleted bool) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	user, ok := st.users[uuid]
+	if !ok || (user.DeletedAt != nil && !withDeleted) {
+		return nil, db.ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (st *Storage) UpdateUser(ctx context.Context, uuid string, changes db.UserChanges, version int) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	user, err := st.live(uuid, version)
+	if err != nil {
+		return nil, err
+	}
+	if changes.Name == nil && changes.Email == nil {
+		return copyUser(user), nil
+	}
+	if changes.Email != nil {
+		oldNormalized := st.emailNorm.Normalize(user.Email)
+		normalized := st.emailNorm.Normalize(*changes.Email)
+		if owner, ok := st.emails[normalized]; ok && owner != uuid {
+			return nil, db.ErrEmailTaken
+		}
+		delete(st.emails, oldNormalized)
+		st.emails[normalized] = uuid
+		if email := strings.TrimSpace(*changes.Email); email != user.Email {
+			user.Email, user.EmailVerifiedAt = email, nil
+		}
+	}
+	if changes.Name != nil {
+		user.Name = *changes.Name
+	}
+	updatedAt := now()
+	user.UpdatedAt = &updatedAt
+	user.Version++
+
+	return copyUser(user), nil
+}
+
+func (st *Storage) DeleteUser(ctx context.Context, uuid string, hard bool, version int) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if hard {
+		user, ok := st.users[uuid]
+		if !ok {
+			return db.ErrUserNotFound
+		}
+		if version != db.AnyVersion && user.Version != version {
+			return db.ErrStale
+		}
+		delete(st.emails, st.emailNorm.Normalize(user.Email))
+		delete(st.users, uuid)
+		delete(st.credentials, uuid)
+		delete(st.pendingEmails, uuid)
+		delete(st.passwordResets, uuid)
+		st.deleteSessions(func(s *session) bool { return s.UserUuid == uuid })
+		return nil
+	}
+
+	user, err := st.live(uuid, version)
+	if err != nil {
+		return err
+	}
+	deletedAt := now()
+	user.DeletedAt = &deletedAt
+	user.Version++
+
+	return nil
+}
+
+func (st *Storage) RestoreUser(ctx context.Context, uuid string) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	user, ok := st.users[uuid]
+	if !ok || user.DeletedAt == nil {
+		return nil, &db.Error{Kind: db.ErrNotFound, Msg: "deleted user not found"}
+	}
+	updatedAt := now()
+	user.DeletedAt = nil
+	user.UpdatedAt = &updatedAt
+	user.Version++
+
+	return copyUser(user), nil
+}
+
+func (st *Storage) ListUsers(ctx context.Context, filter db.UserFilter) (*db.UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	users := make([]db.User, 0, len(st.users))
+	for _, user := range st.users {
+		users = append(users, *copyUser(user))
+	}
+	st.mu.RUnlock()
+
+	return filter.Paginate(users)
+}
+
+func (st *Storage) ClaimIdempotencyKey(ctx context.Context, client string, key string, requestHash string, ttl time.Duration, lease time.Duration) (*db.IdempotencyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	t := time.Now()
+	k := idempotencyKey{client: client, key: key}
+	if entry, ok := st.idempotency[k]; ok && !entry.expiresAt.Before(t) {
+		if entry.record.Status != 0 || !entry.lockedUntil.Before(t) {
+			rec := entry.record
+			return &rec, nil
+		}
+		entry.record.RequestHash, entry.lockedUntil = requestHash, t.Add(lease)
+		return nil, nil
+	}
+	st.idempotency[k] = &idempotencyEntry{
+		record:      db.IdempotencyRecord{Client: client, Key: key, RequestHash: requestHash},
+		expiresAt:   t.Add(ttl),
+		lockedUntil: t.Add(lease),
+	}
+
+	return nil, nil
+}
+
+func (st *Storage) DeleteExpiredIdempotencyKeys(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	t := time.Now()
+	for k, entry := range st.idempotency {
+		if entry.expiresAt.Before(t) {
+			delete(st.idempotency, k)
+		}
+	}
+	return nil
+}
+
+func (st *Storage) CompleteIdempotencyKey(ctx context.Context, client string, key string, status int, header http.Header, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if entry, ok := st.idempotency[idempotencyKey{client: client, key: key}]; ok {
+		entry.record.Status = status
+		entry.record.Header = header.Clone()
+		entry.record.Body = append([]byte(nil), body...)
+	}
+	return nil
+}
+
+func (st *Storage) ReleaseIdempotencyKey(ctx context.Context, client string, key string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	k := idempotencyKey{client: client, key: key}
+	if entry, ok := st.idempotency[k]; ok && entry.record.Status == 0 {
+		delete(st.idempotency, k)
+	}
+	return nil
+}
+
+func (st *Storage) AddAPIKey(ctx context.Context, key db.APIKey) (*db.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, k := range st.apiKeys {
+		if k.Hash == key.Hash {
+			return nil, &db.Error{Kind: db.ErrConflict, Msg: db.ErrConflict.Error()}
+		}
+	}
+	key.Id = uuid.New().String()
+	key.CreatedAt = now()
+	key.LastUsedAt, key.RevokedAt = nil, nil
+	key.Scopes = append([]string(nil), key.Scopes...)
+	st.apiKeys = append(st.apiKeys, &key)
+
+	return copyAPIKey(&key), nil
+}
+
+func (st *Storage) GetAPIKey(ctx context.Context, hash string) (*db.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	for _, k := range st.apiKeys {
+		if k.Hash == hash && k.RevokedAt == nil {
+			return copyAPIKey(k), nil
+		}
+	}
+	return nil, db.ErrAPIKeyNotFound
+}
+
+func (st *Storage) ListAPIKeys(ctx context.Context) ([]db.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var keys []db.APIKey
+	for _, k := range st.apiKeys {
+		keys = append(keys, *copyAPIKey(k))
+	}
+	return keys, nil
+}
+
+func (st *Storage) RevokeAPIKey(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, k := range st.apiKeys {
+		if k.Id == id && k.RevokedAt == nil {
+			revokedAt := now()
+			k.RevokedAt = &revokedAt
+			return nil
+		}
+	}
+	return db.ErrAPIKeyNotFound
+}
+
+func (st *Storage) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, k := range st.apiKeys {
+		if k.Id == id {
+			at = at.UTC().Truncate(time.Millisecond)
+			k.LastUsedAt = &at
+		}
+	}
+	return nil
+}
+
+func (st *Storage) SetPassword(ctx context.Context, userUuid string, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, err := st.live(userUuid, db.AnyVersion); err != nil {
+		return err
+	}
+	st.credentials[userUuid] = &db.Credentials{UserUuid: userUuid, PasswordHash: hash, UpdatedAt: now()}
+	return nil
+}
+
+func (st *Storage) ChangePassword(ctx context.Context, userUuid string, hash string, keepSessionId string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, err := st.live(userUuid, db.AnyVersion); err != nil {
+		return err
+	}
+	st.credentials[userUuid] = &db.Credentials{UserUuid: userUuid, PasswordHash: hash, UpdatedAt: now()}
+	revokedAt := now()
+	for _, s := range st.sessions {
+		if s.UserUuid == userUuid && s.Id != keepSessionId && active(s) {
+			s.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (st *Storage) GetCredentials(ctx context.Context, userUuid string) (*db.Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.liveCredentials(userUuid)
+}
+
+func (st *Storage) GetCredentialsByEmail(ctx context.Context, email string) (*db.Credentials, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	return st.liveCredentials(st.emails[st.emailNorm.Normalize(email)])
+}
+
+func (st *Storage) RecordLogin(ctx context.Context, userUuid string, rehash string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if creds, ok := st.credentials[userUuid]; ok {
+		creds.FailedAttempts, creds.LockedUntil = 0, nil
+		if rehash != "" {
+			creds.PasswordHash, creds.UpdatedAt = rehash, now()
+		}
+	}
+	return nil
+}
+
+func (st *Storage) RecordFailedLogin(ctx context.Context, userUuid string, maxAttempts int, lockout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if creds, ok := st.credentials[userUuid]; ok {
+		creds.FailedAttempts++
+		if creds.FailedAttempts >= maxAttempts {
+			lockedUntil := now().Add(lockout)
+			creds.FailedAttempts, creds.LockedUntil = 0, &lockedUntil
+		}
+	}
+	return nil
+}
+
+func (st *Storage) AddSession(ctx context.Context, s db.Session, refreshHash string) (*db.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.deleteExpiredSessions()
+	if _, err := st.live(s.UserUuid, db.AnyVersion); err != nil {
+		return nil, err
+	}
+	for _, other := range st.sessions {
+		if other.refreshHash == refreshHash {
+			return nil, &db.Error{Kind: db.ErrConflict, Msg: db.ErrConflict.Error()}
+		}
+	}
+	s.Id = uuid.New().String()
+	s.CreatedAt = now()
+	s.LastUsedAt, s.RevokedAt = s.CreatedAt, nil
+	s.ExpiresAt = s.ExpiresAt.UTC().Truncate(time.Millisecond)
+	st.sessions[s.Id] = &session{Session: s, refreshHash: refreshHash}
+
+	return &s, nil
+}
+
+func (st *Storage) RotateRefreshToken(ctx context.Context, hash string, newHash string) (*db.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.deleteExpiredSessions()
+	if id, ok := st.rotated[hash]; ok {
+		if s := st.sessions[id]; s != nil && s.RevokedAt == nil {
+			revokedAt := now()
+			s.RevokedAt = &revokedAt
+		}
+		return nil, db.ErrRefreshTokenReused
+	}
+	for _, s := range st.sessions {
+		if s.refreshHash != hash {
+			continue
+		}
+		if _, err := st.live(s.UserUuid, db.AnyVersion); err != nil || s.RevokedAt != nil || !s.ExpiresAt.After(time.Now()) {
+			return nil, db.ErrSessionNotFound
+		}
+		st.rotated[hash] = s.Id
+		s.refreshHash = newHash
+		s.LastUsedAt = now()
+		c := s.Session
+		return &c, nil
+	}
+	return nil, db.ErrSessionNotFound
+}
+
+func (st *Storage) ListSessions(ctx context.Context, userUuid string) ([]db.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	sessions := []db.Session{}
+	for _, s := range st.sessions {
+		if s.UserUuid == userUuid && active(s) {
+			sessions = append(sessions, s.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions, nil
+}
+
+func (st *Storage) SessionActive(ctx context.Context, userUuid string, id string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, unavailable(err)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	s, ok := st.sessions[id]
+	if !ok || s.UserUuid != userUuid || !active(s) {
+		return false, nil
+	}
+	_, err := st.live(userUuid, db.AnyVersion)
+	return err == nil, nil
+}
+
+func (st *Storage) RevokeSession(ctx context.Context, userUuid string, id string) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[id]
+	if !ok || s.UserUuid != userUuid || !active(s) {
+		return db.ErrSessionNotFound
+	}
+	revokedAt := now()
+	s.RevokedAt = &revokedAt
+	return nil
+}
+
+func (st *Storage) RevokeSessions(ctx context.Context, userUuid string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	revokedAt := now()
+	for _, s := range st.sessions {
+		if s.UserUuid == userUuid && active(s) {
+			s.RevokedAt = &revokedAt
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (st *Storage) VerifyEmail(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.tokenUsed(token) {
+		return nil, db.ErrTokenUsed
+	}
+	user, err := st.live(uuid, db.AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	if user.Email != email {
+		return nil, db.ErrEmailChanged
+	}
+	if user.EmailVerifiedAt == nil {
+		verifiedAt := now()
+		user.EmailVerifiedAt = &verifiedAt
+		user.Version++
+	}
+	st.usedTokens[token.Id] = token.ExpiresAt
+	return copyUser(user), nil
+}
+
+func (st *Storage) RequestEmailChange(ctx context.Context, uuid string, email string) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if owner, ok := st.emails[st.emailNorm.Normalize(email)]; ok && owner != uuid {
+		return nil, db.ErrEmailTaken
+	}
+	user, err := st.live(uuid, db.AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	st.pendingEmails[uuid] = strings.TrimSpace(email)
+	return copyUser(user), nil
+}
+
+func (st *Storage) ConfirmEmailChange(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.tokenUsed(token) {
+		return nil, db.ErrTokenUsed
+	}
+	user, err := st.live(uuid, db.AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	if pending, ok := st.pendingEmails[uuid]; !ok || pending != email {
+		return nil, db.ErrNoEmailChange
+	}
+	if err := st.swapEmail(user, email); err != nil {
+		return nil, err
+	}
+	verifiedAt := now()
+	user.EmailVerifiedAt = &verifiedAt
+	st.usedTokens[token.Id] = token.ExpiresAt
+	return copyUser(user), nil
+}
+
+func (st *Storage) RevertEmailChange(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.tokenUsed(token) {
+		return nil, db.ErrTokenUsed
+	}
+	user, err := st.live(uuid, db.AnyVersion)
+	if err != nil {
+		return nil, err
+	}
+	verified := user.Email == email && user.EmailVerifiedAt != nil
+	if err := st.swapEmail(user, email); err != nil {
+		return nil, err
+	}
+	if !verified {
+		verifiedAt := now()
+		user.EmailVerifiedAt = &verifiedAt
+	}
+	st.usedTokens[token.Id] = token.ExpiresAt
+	return copyUser(user), nil
+}
+
+// tokenUsed reports whether token was used before, dropping expired ids
+// along the way. Callers record the token once what it was for succeeded.
+// The caller must hold the lock.
+func (st *Storage) tokenUsed(token db.UsedToken) bool {
+	t := time.Now()
+	for k, exp := range st.usedTokens {
+		if exp.Before(t) {
+			delete(st.usedTokens, k)
+		}
+	}
+	_, ok := st.usedTokens[token.Id]
+	return ok
+}
+
+// swapEmail gives the user email, drops their pending change and bumps
+// their version. The caller must hold the lock.
+func (st *Storage) swapEmail(user *db.User, email string) error {
+	normalized := st.emailNorm.Normalize(email)
+	if owner, ok := st.emails[normalized]; ok && owner != user.Uuid {
+		return db.ErrEmailTaken
+	}
+	delete(st.emails, st.emailNorm.Normalize(user.Email))
+	st.emails[normalized] = user.Uuid
+	delete(st.pendingEmails, user.Uuid)
+	updatedAt := now()
+	user.Email, user.UpdatedAt = email, &updatedAt
+	user.Version++
+	return nil
+}
+
+func (st *Storage) AddPasswordReset(ctx context.Context, userUuid string, tokenHash string, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	t := time.Now()
+	for u, r := range st.passwordResets {
+		if r.expiresAt.Before(t) {
+			delete(st.passwordResets, u)
+		}
+	}
+	if _, ok := st.users[userUuid]; !ok {
+		return db.ErrUserNotFound
+	}
+	st.passwordResets[userUuid] = passwordReset{tokenHash: tokenHash, expiresAt: expiresAt}
+	return nil
+}
+
+func (st *Storage) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", unavailable(err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for userUuid, r := range st.passwordResets {
+		if r.tokenHash != tokenHash || !r.expiresAt.After(time.Now()) {
+			continue
+		}
+		if _, err := st.live(userUuid, db.AnyVersion); err != nil {
+			return "", err
+		}
+		delete(st.passwordResets, userUuid)
+		st.credentials[userUuid] = &db.Credentials{UserUuid: userUuid, PasswordHash: passwordHash, UpdatedAt: now()}
+		revokedAt := now()
+		for _, s := range st.sessions {
+			if s.UserUuid == userUuid && active(s) {
+				s.RevokedAt = &revokedAt
+			}
+		}
+		return userUuid, nil
+	}
+	return "", db.ErrResetTokenInvalid
+}
+
+// deleteExpiredSessions drops sessions that can no longer be used.
+func (st *Storage) deleteExpiredSessions() {
+	t := time.Now()
+	st.deleteSessions(func(s *session) bool { return s.ExpiresAt.Before(t) })
+}
+
+// deleteSessions drops the sessions matching del and the hashes of their
+// rotated refresh tokens.
+func (st *Storage) deleteSessions(del func(*session) bool) {
+	for id, s := range st.sessions {
+		if del(s) {
+			delete(st.sessions, id)
+		}
+	}
+	for hash, id := range st.rotated {
+		if _, ok := st.sessions[id]; !ok {
+			delete(st.rotated, hash)
+		}
+	}
+}
+
+// active reports whether a session is neither revoked nor expired.
+func active(s *session) bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(time.Now())
+}
+
+// liveCredentials returns a copy of the credentials of a user that isn't
+// soft-deleted. The caller must hold the lock.
+func (st *Storage) liveCredentials(userUuid string) (*db.Credentials, error) {
+	creds, ok := st.credentials[userUuid]
+	if !ok {
+		return nil, db.ErrCredentialsNotFound
+	}
+	if user := st.users[userUuid]; user == nil || user.DeletedAt != nil {
+		return nil, db.ErrCredentialsNotFound
+	}
+	c := *creds
+	return &c, nil
+}
+
+// live returns the user if it isn't soft-deleted and is at the version.
+// The caller must hold the lock.
+func (st *Storage) live(uuid string, version int) (*db.User, error) {
+	user, ok := st.users[uuid]
+	if !ok || user.DeletedAt != nil {
+		return nil, db.ErrUserNotFound
+	}
+	if version != db.AnyVersion && user.Version != version {
+		return nil, db.ErrStale
+	}
+	return user, nil
+}
+
+func copyUser(user *db.User) *db.User {
+	c := *user
+	return &c
+}
+
+func copyAPIKey(key *db.APIKey) *db.APIKey {
+	c := *key
+	c.Scopes = append([]string(nil), key.Scopes...)
+	return &c
+}
+
+func unavailable(err error) error {
+	return &db.Error{Kind: db.ErrUnavailable, Msg: db.ErrUnavailable.Error(), Err: err}
+}
@@ -0,0 +1,14 @@
+package memory_test
+
+import (
+	"testing"
+	"user-service/db/memory"
+	"user-service/db/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		return memory.NewStorage()
+	})
+}
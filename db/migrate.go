@@ -0,0 +1,22 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+	"user-service/migrations"
+)
+
+// NewMigrator returns a goose provider for the migrations embedded in the
+// binary. On Postgres it holds an advisory lock while migrating, so replicas
+// starting together apply every migration exactly once.
+func NewMigrator(conn *sql.DB, d Dialect) (*goose.Provider, error) {
+	if d == SQLite {
+		return goose.NewProvider(goose.DialectSQLite3, conn, migrations.SQLite)
+	}
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.DialectPostgres, conn, migrations.Postgres, goose.WithSessionLocker(locker))
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrResetTokenInvalid = &Error{Kind: ErrNotFound, Msg: "reset token is invalid or expired"}
+
+// AddPasswordReset stores the hash of a password reset token for a user,
+// replacing the user's earlier one, which stops working. Expired tokens are
+// dropped along the way.
+func (st *StDb) AddPasswordReset(ctx context.Context, userUuid string, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := st.exec(ctx, "DELETE FROM password_resets WHERE expires_at < $1", time.Now()); err != nil {
+		return wrapErr(ctx, err)
+	}
+	_, err := st.exec(ctx, `INSERT INTO password_resets (user_uuid, token_hash, created_at, expires_at) VALUES($1, $2, $3, $4)
+ON CONFLICT (user_uuid) DO UPDATE SET token_hash = excluded.token_hash, created_at = excluded.created_at, expires_at = excluded.expires_at`,
+		userUuid, tokenHash, time.Now(), expiresAt)
+	if errors.Is(wrapErr(ctx, err), ErrConflict) {
+		// The user was purged meanwhile.
+		return ErrUserNotFound
+	}
+	return wrapErr(ctx, err)
+}
+
+// ResetPassword consumes the unexpired password reset token with the given
+// hash, sets the password hash of its user and revokes their sessions, all
+// or nothing. It returns the uuid of the user. Each token works once.
+func (st *StDb) ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (string, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var userUuid string
+	err := st.inTx(ctx, func(tx *StDb) error {
+		err := tx.queryRow(ctx, "DELETE FROM password_resets WHERE token_hash = $1 AND expires_at > $2 RETURNING user_uuid", tokenHash, time.Now()).Scan(&userUuid)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrResetTokenInvalid
+		}
+		if err != nil {
+			return wrapErr(ctx, err)
+		}
+		if err := tx.SetPassword(ctx, userUuid, passwordHash); err != nil {
+			return err
+		}
+		// Whoever knew the old password may be logged in.
+		_, err = tx.RevokeSessions(ctx, userUuid)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return userUuid, nil
+}
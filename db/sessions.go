@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"time"
+)
+
+var (
+	ErrSessionNotFound = &Error{Kind: ErrNotFound, Msg: "session not found"}
+	// ErrRefreshTokenReused is returned when a refresh token is presented
+	// after it was rotated. The session it belongs to has been revoked, as
+	// either it or its successor was stolen.
+	ErrRefreshTokenReused = &Error{Kind: ErrConflict, Msg: "refresh token was already used"}
+)
+
+// Session is a login of a user on some device. It is kept alive by
+// rotating its refresh token, of which only the hash is stored.
+type Session struct {
+	Id         string
+	UserUuid   string
+	Device     string
+	UserAgent  string
+	Ip         string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+// AddSession starts a session of a user that isn't soft-deleted, with the
+// hash of its first refresh token. Device, UserAgent, Ip and ExpiresAt are
+// taken from s. Expired sessions are dropped along the way.
+func (st *StDb) AddSession(ctx context.Context, s Session, refreshHash string) (*Session, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if err := st.deleteExpiredSessions(ctx); err != nil {
+		return nil, err
+	}
+	var exists int
+	if err := st.queryRow(ctx, "SELECT 1 FROM users WHERE uuid = $1 AND deleted_at IS NULL", s.UserUuid).Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, wrapErr(ctx, err)
+	}
+	s.Id = uuid.New().String()
+	s.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	s.LastUsedAt, s.RevokedAt = s.CreatedAt, nil
+	s.ExpiresAt = s.ExpiresAt.UTC().Truncate(time.Millisecond)
+	_, err := st.exec(ctx, `INSERT INTO sessions (id, user_uuid, refresh_hash, device, user_agent, ip, created_at, last_used_at, expires_at)
+VALUES($1, $2, $3, $4, $5, $6, $7, $7, $8)`,
+		s.Id, s.UserUuid, refreshHash, s.Device, s.UserAgent, s.Ip, s.CreatedAt, s.ExpiresAt)
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	return &s, nil
+}
+
+// RotateRefreshToken replaces the refresh token with the given hash by
+// newHash and returns its session. Expired and revoked sessions, and those
+// of soft-deleted users, are not found. Presenting a token that was already
+// rotated revokes its session and returns ErrRefreshTokenReused. Expired
+// sessions are dropped along the way.
+func (st *StDb) RotateRefreshToken(ctx context.Context, hash string, newHash string) (*Session, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if err := st.deleteExpiredSessions(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	row := st.queryRow(ctx, "SELECT "+sessionColumns+" FROM sessions s JOIN users u ON u.uuid = s.user_uuid WHERE s.refresh_hash = $1 AND u.deleted_at IS NULL", hash)
+	s, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		var sessionId string
+		err := st.queryRow(ctx, "SELECT session_id FROM rotated_refresh_tokens WHERE hash = $1", hash).Scan(&sessionId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSessionNotFound
+		}
+		if err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+		return nil, st.revokeReused(ctx, sessionId)
+	}
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	if s.RevokedAt != nil || !s.ExpiresAt.After(now) {
+		return nil, ErrSessionNotFound
+	}
+
+	// Keeping the old hash first makes a concurrent rotation with the same
+	// token collide on it, which counts as reuse too.
+	_, err = st.exec(ctx, "INSERT INTO rotated_refresh_tokens (hash, session_id, rotated_at) VALUES($1, $2, $3)", hash, s.Id, now)
+	if err = wrapErr(ctx, err); errors.Is(err, ErrConflict) {
+		return nil, st.revokeReused(ctx, s.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := st.exec(ctx, "UPDATE sessions SET refresh_hash = $1, last_used_at = $2 WHERE id = $3 AND refresh_hash = $4 AND revoked_at IS NULL",
+		newHash, now, s.Id, hash)
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	if n == 0 {
+		// Revoked meanwhile.
+		return nil, ErrSessionNotFound
+	}
+	s.LastUsedAt = now.UTC().Truncate(time.Millisecond)
+	return s, nil
+}
+
+// deleteExpiredSessions drops sessions that can no longer be used, and with
+// them the hashes of their rotated refresh tokens.
+func (st *StDb) deleteExpiredSessions(ctx context.Context) error {
+	_, err := st.exec(ctx, "DELETE FROM sessions WHERE expires_at < $1", time.Now())
+	return wrapErr(ctx, err)
+}
+
+func (st *StDb) revokeReused(ctx context.Context, sessionId string) error {
+	_, err := st.exec(ctx, "UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", time.Now(), sessionId)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	return ErrRefreshTokenReused
+}
+
+// ListSessions returns the sessions of a user that are neither expired nor
+// revoked, most recently used first.
+func (st *StDb) ListSessions(ctx context.Context, userUuid string) ([]Session, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := st.query(ctx, "SELECT "+sessionColumns+" FROM sessions s WHERE user_uuid = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY last_used_at DESC, id",
+		userUuid, time.Now())
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+		sessions = append(sessions, *s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	return sessions, nil
+}
+
+// SessionActive reports whether a session of a user is neither expired nor
+// revoked, and the user not soft-deleted.
+func (st *StDb) SessionActive(ctx context.Context, userUuid string, id string) (bool, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return false, nil
+	}
+	var exists int
+	err := st.queryRow(ctx, `SELECT 1 FROM sessions s JOIN users u ON u.uuid = s.user_uuid
+WHERE s.id = $1 AND s.user_uuid = $2 AND s.revoked_at IS NULL AND s.expires_at > $3 AND u.deleted_at IS NULL`,
+		id, userUuid, time.Now()).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapErr(ctx, err)
+	}
+	return true, nil
+}
+
+// RevokeSession ends an active session of a user. Its refresh token and the
+// access tokens issued for it stop working at once.
+func (st *StDb) RevokeSession(ctx context.Context, userUuid string, id string) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrSessionNotFound
+	}
+	now := time.Now()
+	res, err := st.exec(ctx, "UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND user_uuid = $3 AND revoked_at IS NULL AND expires_at > $1", now, id, userUuid)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeSessions ends every active session of a user and returns how many
+// there were.
+func (st *StDb) RevokeSessions(ctx context.Context, userUuid string) (int, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	res, err := st.exec(ctx, "UPDATE sessions SET revoked_at = $1 WHERE user_uuid = $2 AND revoked_at IS NULL AND expires_at > $1", now, userUuid)
+	if err != nil {
+		return 0, wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapErr(ctx, err)
+	}
+	return int(n), nil
+}
+
+const sessionColumns = "s.id, s.user_uuid, s.device, s.user_agent, s.ip, s.created_at, s.last_used_at, s.expires_at, s.revoked_at"
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var s Session
+	if err := row.Scan(&s.Id, &s.UserUuid, &s.Device, &s.UserAgent, &s.Ip, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.RevokedAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
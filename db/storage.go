@@ -1,68 +1,361 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"strings"
 	"time"
 )
 
 type StDb struct {
 	db *sql.DB
+	// tx, if set, is the transaction every query runs in.
+	tx           *sql.Tx
+	dialect      Dialect
+	emailNorm    EmailNormalization
+	queryTimeout time.Duration
+}
+
+// AnyVersion makes compare-and-swap updates apply whatever the current
+// version is.
+const AnyVersion = 0
+
+type Option func(*StDb)
+
+// WithEmailNormalization sets the rules used to detect duplicate emails.
+func WithEmailNormalization(n EmailNormalization) Option {
+	return func(st *StDb) {
+		st.emailNorm = n
+	}
 }
 
 type User struct {
-	Uuid  string `sql:"uuid"`
-	Name  string `sql:"name"`
-	Email string `sql:"email"`
+	Uuid      string     `sql:"uuid"`
+	Name      string     `sql:"name"`
+	Email     string     `sql:"email"`
+	Version   int        `sql:"version"`
+	CreatedAt time.Time  `sql:"created_at"`
+	UpdatedAt *time.Time `sql:"updated_at"`
+	DeletedAt *time.Time `sql:"deleted_at"`
+	// EmailVerifiedAt is when the user proved to own the email. Changing
+	// the email clears it.
+	EmailVerifiedAt *time.Time `sql:"email_verified_at"`
+}
+
+// WithQueryTimeout bounds every storage operation, on top of whatever
+// deadline the caller's context carries. Zero means no extra bound.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(st *StDb) {
+		st.queryTimeout = d
+	}
+}
+
+func NewStorage(db *sql.DB, opts ...Option) *StDb {
+	st := &StDb{db: db}
+	for _, opt := range opts {
+		opt(st)
+	}
+	return st
+}
+
+func (st *StDb) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if st.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, st.queryTimeout)
+}
+
+// queryRow, query and exec run a query written for Postgres in the storage's
+// dialect, each in a span of its own.
+func (st *StDb) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := st.startQuery(ctx, query)
+	query, args = st.dialect.rebind(query, args)
+	row := st.querier().QueryRowContext(ctx, query, args...)
+	endQuery(span, row.Err())
+	return row
+}
+
+func (st *StDb) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := st.startQuery(ctx, query)
+	query, args = st.dialect.rebind(query, args)
+	rows, err := st.querier().QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (st *StDb) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := st.startQuery(ctx, query)
+	query, args = st.dialect.rebind(query, args)
+	res, err := st.querier().ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func (st *StDb) querier() querier {
+	if st.tx != nil {
+		return st.tx
+	}
+	return st.db
 }
 
-func NewStorage(db *sql.DB) *StDb {
-	return &StDb{db: db}
+// inTx runs fn with a copy of the storage whose queries all go to a single
+// transaction. It is committed if fn succeeds and rolled back otherwise.
+func (st *StDb) inTx(ctx context.Context, fn func(tx *StDb) error) error {
+	sqlTx, err := st.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	tx := *st
+	tx.tx = sqlTx
+	if err := fn(&tx); err != nil {
+		_ = sqlTx.Rollback()
+		return err
+	}
+	return wrapErr(ctx, sqlTx.Commit())
 }
 
-func (st *StDb) AddUser(name string, email string) (*User, error) {
+func (st *StDb) AddUser(ctx context.Context, name string, email string) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
 	var user User
 	newUuid := uuid.New().String()
-	row := st.db.QueryRow("INSERT INTO users (uuid, name, email, created_at) VALUES($1, $2, $3, $4) RETURNING uuid, name, email",
-		newUuid, name, email, time.Now())
+	row := st.queryRow(ctx, "INSERT INTO users (uuid, name, email, email_normalized, created_at) VALUES($1, $2, $3, $4, $5) RETURNING uuid, name, email, version",
+		newUuid, name, strings.TrimSpace(email), st.emailNorm.Normalize(email), time.Now())
 
-	if err := row.Scan(&user.Uuid, &user.Name, &user.Email); err != nil {
+	if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version); err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	return &user, nil
+
+}
+
+// GetUser returns the user with the given uuid. Soft-deleted users are
+// reported as not found unless withDeleted is set.
+func (st *StDb) GetUser(ctx context.Context, uuid string, withDeleted bool) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var user User
+
+	query := "SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1"
+	if !withDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	row := st.queryRow(ctx, query, uuid)
+
+	if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.DeletedAt, &user.EmailVerifiedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf(err.Error())
+			return nil, ErrUserNotFound
 		}
-		return nil, err
+		return nil, wrapErr(ctx, err)
 	}
 	return &user, nil
+}
 
+// UserChanges lists the fields to update. Nil fields are left untouched.
+type UserChanges struct {
+	Name  *string
+	Email *string
 }
 
-func (st *StDb) GetUser(uuid string) (*User, error) {
-	var user User
+// UpdateUser writes only the fields set in changes, so concurrent partial
+// updates of different fields don't overwrite each other. The update only
+// applies if the user is still at the given version, unless version is
+// AnyVersion, and bumps the version.
+func (st *StDb) UpdateUser(ctx context.Context, uuid string, changes UserChanges, version int) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
 
-	row := st.db.QueryRow("SELECT uuid, name, email FROM users WHERE uuid = $1", uuid)
+	var (
+		sets []string
+		args []any
+	)
+	set := func(column string, value any) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if changes.Name != nil {
+		set("name", *changes.Name)
+	}
+	if changes.Email != nil {
+		set("email", strings.TrimSpace(*changes.Email))
+		// A new email is unverified; the right-hand sides see the old row.
+		sets = append(sets, fmt.Sprintf("email_verified_at = CASE WHEN email = $%d THEN email_verified_at END", len(args)))
+		set("email_normalized", st.emailNorm.Normalize(*changes.Email))
+	}
+	if len(sets) == 0 {
+		user, err := st.GetUser(ctx, uuid, false)
+		if err != nil {
+			return nil, err
+		}
+		if version != AnyVersion && user.Version != version {
+			return nil, ErrStale
+		}
+		return user, nil
+	}
+	set("updated_at", time.Now())
+	sets = append(sets, "version = version + 1")
+	args = append(args, uuid)
+	query := fmt.Sprintf("UPDATE users SET %s WHERE uuid = $%d AND deleted_at IS NULL", strings.Join(sets, ", "), len(args))
+	if version != AnyVersion {
+		args = append(args, version)
+		query += fmt.Sprintf(" AND version = $%d", len(args))
+	}
+	query += " RETURNING uuid, name, email, version, email_verified_at"
 
-	if err := row.Scan(&user.Uuid, &user.Name, &user.Email); err != nil {
+	var user User
+	row := st.queryRow(ctx, query, args...)
+	if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.EmailVerifiedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("user not found: %w", sql.ErrNoRows)
+			return nil, st.missOrStale(ctx, uuid, false)
 		}
-		return nil, err
+		return nil, wrapErr(ctx, err)
 	}
+
 	return &user, nil
 }
 
-func (st *StDb) ChangeUser(uuid string, name string) (*User, error) {
+// DeleteUser soft-deletes the user by stamping deleted_at. With hard set the
+// row is removed for good, whether or not it was soft-deleted before. Like
+// UpdateUser it only applies to the given version.
+func (st *StDb) DeleteUser(ctx context.Context, uuid string, hard bool, version int) error {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		query string
+		args  []any
+	)
+	if hard {
+		query, args = "DELETE FROM users WHERE uuid = $1", []any{uuid}
+	} else {
+		query, args = "UPDATE users SET deleted_at = $1, version = version + 1 WHERE uuid = $2 AND deleted_at IS NULL", []any{time.Now(), uuid}
+	}
+	if version != AnyVersion {
+		args = append(args, version)
+		query += fmt.Sprintf(" AND version = $%d", len(args))
+	}
+
+	res, err := st.exec(ctx, query, args...)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	if n == 0 {
+		return st.missOrStale(ctx, uuid, hard)
+	}
+
+	return nil
+}
+
+// RestoreUser clears deleted_at on a soft-deleted user.
+func (st *StDb) RestoreUser(ctx context.Context, uuid string) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
 	var user User
 
-	row := st.db.QueryRow("UPDATE users SET name = $1, updated_at = $2 WHERE uuid = $3 RETURNING uuid, name, email", name, time.Now(), uuid)
+	row := st.queryRow(ctx, "UPDATE users SET deleted_at = NULL, updated_at = $1, version = version + 1 WHERE uuid = $2 AND deleted_at IS NOT NULL RETURNING uuid, name, email, version, email_verified_at", time.Now(), uuid)
 
-	if err := row.Scan(&user.Uuid, &user.Name, &user.Email); err != nil {
+	if err := row.Scan(&user.Uuid, &user.Name, &user.Email, &user.Version, &user.EmailVerifiedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, fmt.Errorf("user not found: %w", sql.ErrNoRows)
+			return nil, &Error{Kind: ErrNotFound, Msg: "deleted user not found"}
 		}
-		return nil, err
+		return nil, wrapErr(ctx, err)
 	}
 
 	return &user, nil
 }
+
+// missOrStale tells why a compare-and-swap on the user matched no row.
+func (st *StDb) missOrStale(ctx context.Context, uuid string, withDeleted bool) error {
+	_, err := st.GetUser(ctx, uuid, withDeleted)
+	if err != nil {
+		return err
+	}
+	return ErrStale
+}
+
+// ListUsers returns one page of live users matching the filter, ordered by the
+// requested column with uuid as a tie breaker. Paging is keyset based: the
+// NextCursor of a page is passed back as UserFilter.Cursor to get the next one.
+func (st *StDb) ListUsers(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	sortExpr, ok := userSortColumns[filter.sortColumn()]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort column %q", ErrInvalidFilter, filter.Sort)
+	}
+	limit := filter.limit()
+
+	where, args := filter.where(st.dialect)
+	page := &UserPage{Users: []User{}}
+	if filter.WithTotal {
+		var total int
+		row := st.queryRow(ctx, "SELECT COUNT(*) FROM users WHERE "+strings.Join(where, " AND "), args...)
+		if err := row.Scan(&total); err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+		page.Total = &total
+	}
+
+	dir, cmp := "ASC", ">"
+	if filter.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		c, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != filter.sortColumn() || c.Desc != filter.Desc {
+			return nil, fmt.Errorf("%w: cursor was issued for a different sort order", ErrInvalidCursor)
+		}
+		value, err := c.sortValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value, c.Uuid)
+		where = append(where, fmt.Sprintf("(%s, uuid) %s ($%d, $%d)", sortExpr, cmp, len(args)-1, len(args)))
+	}
+	args = append(args, limit+1)
+	query := fmt.Sprintf("SELECT uuid, name, email, created_at, updated_at, email_verified_at FROM users WHERE %s ORDER BY %s %s, uuid %s LIMIT $%d",
+		strings.Join(where, " AND "), sortExpr, dir, dir, len(args))
+
+	rows, err := st.query(ctx, query, args...)
+	if err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Uuid, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.EmailVerifiedAt); err != nil {
+			return nil, wrapErr(ctx, err)
+		}
+		page.Users = append(page.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapErr(ctx, err)
+	}
+
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		page.NextCursor = encodeCursor(filter.sortColumn(), filter.Desc, page.Users[limit-1])
+	}
+
+	return page, nil
+}
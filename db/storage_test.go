@@ -0,0 +1,128 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"user-service/db"
+	"user-service/db/storagetest"
+)
+
+// TestConformance runs against the migrated Postgres database given by
+// TEST_DB_DATA_SOURCE_NAME and is skipped without one.
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DATA_SOURCE_NAME")
+	if dsn == "" {
+		t.Skip("TEST_DB_DATA_SOURCE_NAME is not set")
+	}
+	conn, err := db.Open(db.Postgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	st := db.NewStorage(conn)
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		return st
+	})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Backend {
+		conn := openSQLite(t)
+		migrator, err := db.NewMigrator(conn, db.SQLite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return db.NewStorage(conn, db.WithDialect(db.SQLite))
+	})
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	migrator, err := db.NewMigrator(openSQLite(t), db.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	current, target, err := migrator.GetVersions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current == 0 || current != target {
+		t.Fatalf("migrated to version %d, want %d", current, target)
+	}
+	if _, err := migrator.DownTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	conn, err := db.Open(db.SQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestSQLiteRenormalize(t *testing.T) {
+	ctx := context.Background()
+	conn := openSQLite(t)
+	migrator, err := db.NewMigrator(conn, db.SQLite)
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+	withNorm := func(n db.EmailNormalization) *db.StDb {
+		return db.NewStorage(conn, db.WithDialect(db.SQLite), db.WithEmailNormalization(n))
+	}
+	normalized := func(uuid string) string {
+		var email string
+		require.NoError(t, conn.QueryRow("SELECT email_normalized FROM users WHERE uuid = ?", uuid).Scan(&email))
+		return email
+	}
+	st := withNorm(db.EmailNormalization{})
+	john, err := st.AddUser(ctx, "John Doe", "John.Doe@gmail.com")
+	require.NoError(t, err)
+	news, err := st.AddUser(ctx, "John Doe", "johndoe+news@gmail.com")
+	require.NoError(t, err)
+	jane, err := st.AddUser(ctx, "Jane Doe", "Jane+news@Example.com")
+	require.NoError(t, err)
+
+	// Ignoring dots as well would merge both Johns.
+	_, err = withNorm(db.EmailNormalization{IgnoreDots: true, IgnorePlusTags: true}).Renormalize(ctx)
+	var dups *db.DuplicateEmailsError
+	require.ErrorAs(t, err, &dups)
+	assert.ErrorIs(t, err, db.ErrConflict)
+	assert.ElementsMatch(t, []string{john.Uuid, news.Uuid}, dups.Users["johndoe@gmail.com"])
+	assert.Len(t, dups.Users, 1)
+	assert.Equal(t, "johndoe+news@gmail.com", normalized(news.Uuid), "nothing is changed")
+
+	plusTags := withNorm(db.EmailNormalization{IgnorePlusTags: true})
+	n, err := plusTags.Renormalize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "john.doe@gmail.com", normalized(john.Uuid))
+	assert.Equal(t, "johndoe@gmail.com", normalized(news.Uuid))
+	assert.Equal(t, "jane@example.com", normalized(jane.Uuid))
+	_, err = plusTags.AddUser(ctx, "Jane Doe", "jane@example.com")
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+
+	n, err = plusTags.Renormalize(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
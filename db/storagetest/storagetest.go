@@ -0,0 +1,709 @@
+// Package storagetest is a conformance suite for handlers.Storage
+// implementations, so that every backend behaves like the Postgres one.
+package storagetest
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"user-service/db"
+	"user-service/handlers"
+)
+
+type Backend interface {
+	handlers.Storage
+	handlers.IdempotencyStore
+	handlers.APIKeyStore
+	AddAPIKey(ctx context.Context, key db.APIKey) (*db.APIKey, error)
+	ListAPIKeys(ctx context.Context) ([]db.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	handlers.CredentialStore
+	handlers.SessionStore
+	handlers.VerificationStore
+	handlers.EmailChangeStore
+	handlers.PasswordResetStore
+}
+
+// Run runs the suite. newBackend may return the same backend every time, so
+// tests only rely on the data they create themselves.
+func Run(t *testing.T, newBackend func(t *testing.T) Backend) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, st Backend)
+	}{
+		{"AddGet", testAddGet},
+		{"NotFound", testNotFound},
+		{"EmailTaken", testEmailTaken},
+		{"Update", testUpdate},
+		{"DeleteRestore", testDeleteRestore},
+		{"Purge", testPurge},
+		{"List", testList},
+		{"Idempotency", testIdempotency},
+		{"APIKeys", testAPIKeys},
+		{"Credentials", testCredentials},
+		{"Sessions", testSessions},
+		{"Verification", testVerification},
+		{"EmailChange", testEmailChange},
+		{"PasswordReset", testPasswordReset},
+		{"Cancelled", testCancelled},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newBackend(t))
+		})
+	}
+}
+
+// unique returns a prefix that keeps data of different runs apart.
+func unique() string {
+	return uuid.New().String()[:8]
+}
+
+// newToken returns a single-use token that wasn't used yet.
+func newToken() db.UsedToken {
+	return db.UsedToken{Id: uuid.New().String(), ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func testAddGet(t *testing.T, st Backend) {
+	ctx := context.Background()
+	email := unique() + ".john@example.com"
+
+	user, err := st.AddUser(ctx, "John Doe", " "+email+" ")
+	require.NoError(t, err)
+	assert.NotEmpty(t, user.Uuid)
+	assert.Equal(t, "John Doe", user.Name)
+	assert.Equal(t, email, user.Email)
+	assert.Equal(t, 1, user.Version)
+
+	got, err := st.GetUser(ctx, user.Uuid, false)
+	require.NoError(t, err)
+	assert.Equal(t, user.Uuid, got.Uuid)
+	assert.Equal(t, "John Doe", got.Name)
+	assert.Equal(t, email, got.Email)
+	assert.Equal(t, 1, got.Version)
+	assert.Nil(t, got.DeletedAt)
+}
+
+func testNotFound(t *testing.T, st Backend) {
+	ctx := context.Background()
+	missing := uuid.New().String()
+
+	_, err := st.GetUser(ctx, missing, true)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	name := "Nobody"
+	_, err = st.UpdateUser(ctx, missing, db.UserChanges{Name: &name}, db.AnyVersion)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorIs(t, st.DeleteUser(ctx, missing, false, db.AnyVersion), db.ErrNotFound)
+	assert.ErrorIs(t, st.DeleteUser(ctx, missing, true, db.AnyVersion), db.ErrNotFound)
+	_, err = st.RestoreUser(ctx, missing)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+}
+
+func testEmailTaken(t *testing.T, st Backend) {
+	ctx := context.Background()
+	prefix := unique()
+
+	user, err := st.AddUser(ctx, "John Doe", prefix+".john@example.com")
+	require.NoError(t, err)
+	_, err = st.AddUser(ctx, "Johnny", " "+prefix+".JOHN@Example.com")
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+	assert.ErrorIs(t, err, db.ErrConflict)
+
+	other, err := st.AddUser(ctx, "Jane Doe", prefix+".jane@example.com")
+	require.NoError(t, err)
+	taken := prefix + ".John@example.com"
+	_, err = st.UpdateUser(ctx, other.Uuid, db.UserChanges{Email: &taken}, db.AnyVersion)
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+
+	// Soft-deleted users keep their email so they can be restored.
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion))
+	_, err = st.AddUser(ctx, "John Doe", prefix+".john@example.com")
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+
+	// Changing the email frees the old one.
+	moved := prefix + ".jane2@example.com"
+	_, err = st.UpdateUser(ctx, other.Uuid, db.UserChanges{Email: &moved}, db.AnyVersion)
+	require.NoError(t, err)
+	_, err = st.AddUser(ctx, "Jane Doe", prefix+".jane@example.com")
+	assert.NoError(t, err)
+}
+
+func testUpdate(t *testing.T, st Backend) {
+	ctx := context.Background()
+	email := unique() + ".john@example.com"
+	user, err := st.AddUser(ctx, "John Doe", email)
+	require.NoError(t, err)
+
+	name := "Jane Doe"
+	updated, err := st.UpdateUser(ctx, user.Uuid, db.UserChanges{Name: &name}, user.Version)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", updated.Name)
+	assert.Equal(t, email, updated.Email)
+	assert.Equal(t, 2, updated.Version)
+
+	other := "Someone Else"
+	_, err = st.UpdateUser(ctx, user.Uuid, db.UserChanges{Name: &other}, user.Version)
+	assert.ErrorIs(t, err, db.ErrStale)
+	_, err = st.UpdateUser(ctx, user.Uuid, db.UserChanges{}, user.Version)
+	assert.ErrorIs(t, err, db.ErrStale)
+
+	unchanged, err := st.UpdateUser(ctx, user.Uuid, db.UserChanges{}, updated.Version)
+	require.NoError(t, err)
+	assert.Equal(t, updated.Version, unchanged.Version)
+
+	newEmail := unique() + ".jane@example.com"
+	updated, err = st.UpdateUser(ctx, user.Uuid, db.UserChanges{Email: &newEmail}, db.AnyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", updated.Name)
+	assert.Equal(t, newEmail, updated.Email)
+	assert.Equal(t, 3, updated.Version)
+
+	got, err := st.GetUser(ctx, user.Uuid, false)
+	require.NoError(t, err)
+	assert.Equal(t, newEmail, got.Email)
+	assert.Equal(t, 3, got.Version)
+}
+
+func testDeleteRestore(t *testing.T, st Backend) {
+	ctx := context.Background()
+	user, err := st.AddUser(ctx, "John Doe", unique()+".john@example.com")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, st.DeleteUser(ctx, user.Uuid, false, user.Version+1), db.ErrStale)
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, user.Version))
+	assert.ErrorIs(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion), db.ErrNotFound)
+
+	_, err = st.GetUser(ctx, user.Uuid, false)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	deleted, err := st.GetUser(ctx, user.Uuid, true)
+	require.NoError(t, err)
+	assert.NotNil(t, deleted.DeletedAt)
+	name := "Jane Doe"
+	_, err = st.UpdateUser(ctx, user.Uuid, db.UserChanges{Name: &name}, db.AnyVersion)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	restored, err := st.RestoreUser(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, user.Uuid, restored.Uuid)
+	assert.Greater(t, restored.Version, deleted.Version)
+	_, err = st.RestoreUser(ctx, user.Uuid)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	got, err := st.GetUser(ctx, user.Uuid, false)
+	require.NoError(t, err)
+	assert.Nil(t, got.DeletedAt)
+}
+
+func testPurge(t *testing.T, st Backend) {
+	ctx := context.Background()
+	email := unique() + ".john@example.com"
+	user, err := st.AddUser(ctx, "John Doe", email)
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion))
+
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, true, db.AnyVersion))
+	_, err = st.GetUser(ctx, user.Uuid, true)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	_, err = st.AddUser(ctx, "John Doe", email)
+	assert.NoError(t, err)
+}
+
+func testList(t *testing.T, st Backend) {
+	ctx := context.Background()
+	prefix := unique()
+	domain := prefix + ".example.com"
+	var created []string
+	for i := 0; i < 5; i++ {
+		user, err := st.AddUser(ctx, prefix+" user", uuid.New().String()+"@"+domain)
+		require.NoError(t, err)
+		created = append(created, user.Uuid)
+	}
+	_, err := st.AddUser(ctx, prefix+" other", uuid.New().String()+"@elsewhere.example.com")
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteUser(ctx, created[4], false, db.AnyVersion))
+
+	filter := db.UserFilter{EmailDomain: domain, Limit: 2, WithTotal: true}
+	var seen []string
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 5, "pagination does not end")
+		page, err := st.ListUsers(ctx, filter)
+		require.NoError(t, err)
+		require.NotNil(t, page.Total)
+		assert.Equal(t, 4, *page.Total)
+		assert.LessOrEqual(t, len(page.Users), 2)
+		for _, user := range page.Users {
+			assert.False(t, user.CreatedAt.IsZero())
+			seen = append(seen, user.Uuid)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	assert.ElementsMatch(t, created[:4], seen)
+
+	page, err := st.ListUsers(ctx, db.UserFilter{NamePrefix: prefix + " oth"})
+	require.NoError(t, err)
+	assert.Len(t, page.Users, 1)
+
+	name := prefix + " renamed"
+	_, err = st.UpdateUser(ctx, created[0], db.UserChanges{Name: &name}, db.AnyVersion)
+	require.NoError(t, err)
+	page, err = st.ListUsers(ctx, db.UserFilter{
+		EmailDomain: domain,
+		UpdatedFrom: time.Now().Add(-time.Hour),
+		Sort:        "updated_at",
+		Desc:        true,
+	})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, created[0], page.Users[0].Uuid)
+	assert.NotNil(t, page.Users[0].UpdatedAt)
+
+	page, err = st.ListUsers(ctx, db.UserFilter{EmailDomain: domain, Sort: "name", Limit: 1})
+	require.NoError(t, err)
+	_, err = st.ListUsers(ctx, db.UserFilter{EmailDomain: domain, Sort: "email", Cursor: page.NextCursor})
+	assert.ErrorIs(t, err, db.ErrInvalidInput)
+	_, err = st.ListUsers(ctx, db.UserFilter{Cursor: "garbage"})
+	assert.ErrorIs(t, err, db.ErrInvalidInput)
+	_, err = st.ListUsers(ctx, db.UserFilter{Sort: "password"})
+	assert.ErrorIs(t, err, db.ErrInvalidInput)
+}
+
+func testIdempotency(t *testing.T, st Backend) {
+	ctx := context.Background()
+	key := uuid.New().String()
+
+	rec, err := st.ClaimIdempotencyKey(ctx, "alice", key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", key, "other", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "hash", rec.RequestHash)
+	assert.Zero(t, rec.Status)
+
+	rec, err = st.ClaimIdempotencyKey(ctx, "bob", key, "other", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec, "keys are per client")
+
+	header := http.Header{"Etag": []string{`"1"`}}
+	require.NoError(t, st.CompleteIdempotencyKey(ctx, "alice", key, http.StatusCreated, header, []byte(`{"uuid":"x"}`)))
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, http.StatusCreated, rec.Status)
+	assert.Equal(t, header, rec.Header)
+	assert.Equal(t, `{"uuid":"x"}`, string(rec.Body))
+
+	require.NoError(t, st.ReleaseIdempotencyKey(ctx, "alice", key))
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, rec, "completed keys are kept")
+
+	require.NoError(t, st.ReleaseIdempotencyKey(ctx, "bob", key))
+	rec, err = st.ClaimIdempotencyKey(ctx, "bob", key, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+
+	// A claim whose lease ran out is taken over.
+	crashed := uuid.New().String()
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", crashed, "hash", time.Hour, -time.Second)
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", crashed, "retry", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec, "lapsed claim was not taken over")
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", crashed, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+	assert.Equal(t, "retry", rec.RequestHash)
+
+	expiring := uuid.New().String()
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", expiring, "hash", -time.Second, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec)
+	require.NoError(t, st.CompleteIdempotencyKey(ctx, "alice", expiring, http.StatusCreated, header, nil))
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", expiring, "hash", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec, "expired key was not reclaimed")
+
+	swept := uuid.New().String()
+	_, err = st.ClaimIdempotencyKey(ctx, "alice", swept, "hash", -time.Second, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, st.CompleteIdempotencyKey(ctx, "alice", swept, http.StatusCreated, header, nil))
+	require.NoError(t, st.DeleteExpiredIdempotencyKeys(ctx))
+	rec, err = st.ClaimIdempotencyKey(ctx, "alice", swept, "other", time.Hour, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, rec, "expired key was not dropped")
+}
+
+func testAPIKeys(t *testing.T, st Backend) {
+	ctx := context.Background()
+	hash := unique() + "-hash"
+
+	key, err := st.AddAPIKey(ctx, db.APIKey{Name: "ci", Prefix: "usk_abc", Hash: hash, Scopes: []string{"users:read", "users:write"}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, key.Id)
+	assert.False(t, key.CreatedAt.IsZero())
+	_, err = st.AddAPIKey(ctx, db.APIKey{Name: "dup", Prefix: "usk_abc", Hash: hash, Scopes: []string{"users:read"}})
+	assert.ErrorIs(t, err, db.ErrConflict)
+
+	got, err := st.GetAPIKey(ctx, hash)
+	require.NoError(t, err)
+	assert.Equal(t, key.Id, got.Id)
+	assert.Equal(t, "ci", got.Name)
+	assert.Equal(t, "usk_abc", got.Prefix)
+	assert.Equal(t, []string{"users:read", "users:write"}, got.Scopes)
+	assert.Nil(t, got.LastUsedAt)
+	_, err = st.GetAPIKey(ctx, unique())
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	usedAt := time.Now().UTC().Truncate(time.Millisecond)
+	require.NoError(t, st.TouchAPIKey(ctx, key.Id, usedAt))
+	got, err = st.GetAPIKey(ctx, hash)
+	require.NoError(t, err)
+	require.NotNil(t, got.LastUsedAt)
+	assert.True(t, usedAt.Equal(*got.LastUsedAt), "last used at %v, want %v", got.LastUsedAt, usedAt)
+
+	require.NoError(t, st.RevokeAPIKey(ctx, key.Id))
+	_, err = st.GetAPIKey(ctx, hash)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorIs(t, st.RevokeAPIKey(ctx, key.Id), db.ErrNotFound)
+	assert.ErrorIs(t, st.RevokeAPIKey(ctx, uuid.New().String()), db.ErrNotFound)
+
+	keys, err := st.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	var listed *db.APIKey
+	for i := range keys {
+		if keys[i].Id == key.Id {
+			listed = &keys[i]
+		}
+	}
+	require.NotNil(t, listed, "revoked keys are listed")
+	assert.NotNil(t, listed.RevokedAt)
+}
+
+func testCredentials(t *testing.T, st Backend) {
+	ctx := context.Background()
+	email := unique() + ".john@example.com"
+	user, err := st.AddUser(ctx, "John Doe", email)
+	require.NoError(t, err)
+
+	_, err = st.GetCredentials(ctx, user.Uuid)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorIs(t, st.SetPassword(ctx, uuid.New().String(), "hash"), db.ErrNotFound)
+	require.NoError(t, st.SetPassword(ctx, user.Uuid, "hash1"))
+	require.NoError(t, st.SetPassword(ctx, user.Uuid, "hash2"))
+
+	creds, err := st.GetCredentialsByEmail(ctx, strings.ToUpper(email))
+	require.NoError(t, err)
+	assert.Equal(t, user.Uuid, creds.UserUuid)
+	assert.Equal(t, "hash2", creds.PasswordHash)
+	assert.Zero(t, creds.FailedAttempts)
+	assert.Nil(t, creds.LockedUntil)
+
+	require.NoError(t, st.RecordFailedLogin(ctx, user.Uuid, 2, time.Hour))
+	creds, err = st.GetCredentials(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, 1, creds.FailedAttempts)
+	assert.Nil(t, creds.LockedUntil)
+	require.NoError(t, st.RecordFailedLogin(ctx, user.Uuid, 2, time.Hour))
+	creds, err = st.GetCredentials(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Zero(t, creds.FailedAttempts)
+	require.NotNil(t, creds.LockedUntil)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *creds.LockedUntil, time.Minute)
+
+	require.NoError(t, st.RecordLogin(ctx, user.Uuid, "hash3"))
+	creds, err = st.GetCredentials(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, "hash3", creds.PasswordHash)
+	assert.Nil(t, creds.LockedUntil)
+
+	// Changing the password revokes the other sessions.
+	laptop, err := st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, unique())
+	require.NoError(t, err)
+	phone, err := st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, unique())
+	require.NoError(t, err)
+	assert.ErrorIs(t, st.ChangePassword(ctx, uuid.New().String(), "hash", laptop.Id), db.ErrNotFound)
+	require.NoError(t, st.ChangePassword(ctx, user.Uuid, "hash4", laptop.Id))
+	creds, err = st.GetCredentials(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, "hash4", creds.PasswordHash)
+	sessions, err := st.ListSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, laptop.Id, sessions[0].Id)
+	assert.NotEqual(t, phone.Id, sessions[0].Id)
+	require.NoError(t, st.ChangePassword(ctx, user.Uuid, "hash5", ""))
+	sessions, err = st.ListSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion))
+	_, err = st.GetCredentialsByEmail(ctx, email)
+	assert.ErrorIs(t, err, db.ErrNotFound, "soft-deleted users can't log in")
+	assert.ErrorIs(t, st.SetPassword(ctx, user.Uuid, "hash6"), db.ErrNotFound)
+	_, err = st.RestoreUser(ctx, user.Uuid)
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, true, db.AnyVersion))
+	_, err = st.GetCredentials(ctx, user.Uuid)
+	assert.ErrorIs(t, err, db.ErrNotFound, "purging drops credentials")
+}
+
+func testSessions(t *testing.T, st Backend) {
+	ctx := context.Background()
+	user, err := st.AddUser(ctx, "John Doe", unique()+".john@example.com")
+	require.NoError(t, err)
+	hash := func(n string) string { return unique() + "-" + n }
+
+	_, err = st.AddSession(ctx, db.Session{UserUuid: uuid.New().String(), ExpiresAt: time.Now().Add(time.Hour)}, hash("none"))
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	laptop, phone := hash("laptop"), hash("phone")
+	s, err := st.AddSession(ctx, db.Session{UserUuid: user.Uuid, Device: "laptop", UserAgent: "curl/8", Ip: "192.0.2.1", ExpiresAt: time.Now().Add(time.Hour)}, laptop)
+	require.NoError(t, err)
+	assert.NotEmpty(t, s.Id)
+	assert.Equal(t, "laptop", s.Device)
+	active, err := st.SessionActive(ctx, user.Uuid, s.Id)
+	require.NoError(t, err)
+	assert.True(t, active)
+	active, err = st.SessionActive(ctx, uuid.New().String(), s.Id)
+	require.NoError(t, err)
+	assert.False(t, active, "another user's session")
+	active, err = st.SessionActive(ctx, user.Uuid, "not-a-uuid")
+	require.NoError(t, err)
+	assert.False(t, active)
+	_, err = st.AddSession(ctx, db.Session{UserUuid: user.Uuid, Device: "phone", ExpiresAt: time.Now().Add(time.Hour)}, phone)
+	require.NoError(t, err)
+	_, err = st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(-time.Hour)}, hash("expired"))
+	require.NoError(t, err)
+
+	// Refresh tokens rotate, and the old ones are no good any more.
+	time.Sleep(2 * time.Millisecond)
+	laptop2 := hash("laptop2")
+	rotated, err := st.RotateRefreshToken(ctx, laptop, laptop2)
+	require.NoError(t, err)
+	assert.Equal(t, s.Id, rotated.Id)
+	assert.Equal(t, "curl/8", rotated.UserAgent)
+	assert.Equal(t, "192.0.2.1", rotated.Ip)
+	assert.True(t, rotated.LastUsedAt.After(s.LastUsedAt), "last used at %v, created at %v", rotated.LastUsedAt, s.LastUsedAt)
+	_, err = st.RotateRefreshToken(ctx, unique(), hash("x"))
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	sessions, err := st.ListSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2, "expired sessions aren't listed")
+	assert.Equal(t, s.Id, sessions[0].Id, "most recently used first")
+	assert.Equal(t, "phone", sessions[1].Device)
+
+	// Reusing a rotated token revokes its session, successor included.
+	_, err = st.RotateRefreshToken(ctx, laptop, hash("again"))
+	assert.ErrorIs(t, err, db.ErrRefreshTokenReused)
+	_, err = st.RotateRefreshToken(ctx, laptop2, hash("laptop3"))
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	active, err = st.SessionActive(ctx, user.Uuid, s.Id)
+	require.NoError(t, err)
+	assert.False(t, active, "revoked sessions aren't active")
+	sessions, err = st.ListSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "phone", sessions[0].Device)
+
+	assert.ErrorIs(t, st.RevokeSession(ctx, uuid.New().String(), sessions[0].Id), db.ErrNotFound, "another user's session")
+	require.NoError(t, st.RevokeSession(ctx, user.Uuid, sessions[0].Id))
+	assert.ErrorIs(t, st.RevokeSession(ctx, user.Uuid, sessions[0].Id), db.ErrNotFound)
+	_, err = st.RotateRefreshToken(ctx, phone, hash("phone2"))
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	tablet := hash("tablet")
+	s, err = st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, tablet)
+	require.NoError(t, err)
+	// The expired session was dropped meanwhile, freeing its hash.
+	_, err = st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(-time.Hour)}, hash("expired"))
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion))
+	_, err = st.RotateRefreshToken(ctx, tablet, hash("tablet2"))
+	assert.ErrorIs(t, err, db.ErrNotFound, "soft-deleted users can't refresh")
+	active, err = st.SessionActive(ctx, user.Uuid, s.Id)
+	require.NoError(t, err)
+	assert.False(t, active, "sessions of soft-deleted users aren't active")
+	_, err = st.RestoreUser(ctx, user.Uuid)
+	require.NoError(t, err)
+	n, err := st.RevokeSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	sessions, err = st.ListSessions(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func testVerification(t *testing.T, st Backend) {
+	ctx := context.Background()
+	domain := unique() + ".example.com"
+	user, err := st.AddUser(ctx, "John Doe", "john@"+domain)
+	require.NoError(t, err)
+	other, err := st.AddUser(ctx, "Jane Doe", "jane@"+domain)
+	require.NoError(t, err)
+
+	token := newToken()
+	_, err = st.VerifyEmail(ctx, user.Uuid, "someone@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrEmailChanged)
+	_, err = st.VerifyEmail(ctx, uuid.New().String(), "john@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	verified, err := st.VerifyEmail(ctx, user.Uuid, "john@"+domain, token)
+	require.NoError(t, err, "failures leave the token unused")
+	require.NotNil(t, verified.EmailVerifiedAt)
+	assert.Equal(t, user.Version+1, verified.Version)
+	_, err = st.VerifyEmail(ctx, user.Uuid, "john@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrTokenUsed)
+	again, err := st.VerifyEmail(ctx, user.Uuid, "john@"+domain, newToken())
+	require.NoError(t, err)
+	assert.Equal(t, verified.Version, again.Version, "verifying twice changes nothing")
+
+	got, err := st.GetUser(ctx, user.Uuid, false)
+	require.NoError(t, err)
+	require.NotNil(t, got.EmailVerifiedAt)
+	name := "Johnny"
+	renamed, err := st.UpdateUser(ctx, user.Uuid, db.UserChanges{Name: &name}, db.AnyVersion)
+	require.NoError(t, err)
+	assert.NotNil(t, renamed.EmailVerifiedAt, "other changes keep the email verified")
+
+	listed := func(verified bool) []string {
+		page, err := st.ListUsers(ctx, db.UserFilter{EmailDomain: domain, Verified: &verified})
+		require.NoError(t, err)
+		var uuids []string
+		for _, u := range page.Users {
+			uuids = append(uuids, u.Uuid)
+		}
+		return uuids
+	}
+	assert.Equal(t, []string{user.Uuid}, listed(true))
+	assert.Equal(t, []string{other.Uuid}, listed(false))
+
+	email := "john.doe@" + domain
+	moved, err := st.UpdateUser(ctx, user.Uuid, db.UserChanges{Email: &email}, db.AnyVersion)
+	require.NoError(t, err)
+	assert.Nil(t, moved.EmailVerifiedAt, "a new email is unverified")
+	assert.ElementsMatch(t, []string{user.Uuid, other.Uuid}, listed(false))
+}
+
+func testEmailChange(t *testing.T, st Backend) {
+	ctx := context.Background()
+	domain := unique() + ".example.com"
+	user, err := st.AddUser(ctx, "John Doe", "john@"+domain)
+	require.NoError(t, err)
+	_, err = st.AddUser(ctx, "Jane Doe", "jane@"+domain)
+	require.NoError(t, err)
+
+	_, err = st.RequestEmailChange(ctx, user.Uuid, "JANE@"+domain)
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+	_, err = st.RequestEmailChange(ctx, uuid.New().String(), "john.doe@"+domain)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	requested, err := st.RequestEmailChange(ctx, user.Uuid, "john.doe@"+domain)
+	require.NoError(t, err)
+	assert.Equal(t, "john@"+domain, requested.Email, "nothing changes until confirmed")
+	_, err = st.RequestEmailChange(ctx, user.Uuid, "johnny@"+domain)
+	require.NoError(t, err)
+
+	token := newToken()
+	_, err = st.ConfirmEmailChange(ctx, user.Uuid, "john.doe@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrNoEmailChange, "only the latest change is pending")
+	changed, err := st.ConfirmEmailChange(ctx, user.Uuid, "johnny@"+domain, token)
+	require.NoError(t, err, "failures leave the token unused")
+	assert.Equal(t, "johnny@"+domain, changed.Email)
+	assert.NotNil(t, changed.EmailVerifiedAt)
+	assert.Equal(t, user.Version+1, changed.Version)
+	_, err = st.ConfirmEmailChange(ctx, user.Uuid, "johnny@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrTokenUsed)
+	_, err = st.ConfirmEmailChange(ctx, user.Uuid, "johnny@"+domain, newToken())
+	assert.ErrorIs(t, err, db.ErrNoEmailChange)
+	_, err = st.AddUser(ctx, "John Doe", "john@"+domain)
+	require.NoError(t, err, "the former email is free")
+
+	// Whoever took the email meanwhile keeps it.
+	_, err = st.RequestEmailChange(ctx, user.Uuid, "jack@"+domain)
+	require.NoError(t, err)
+	_, err = st.AddUser(ctx, "Jack Doe", "jack@"+domain)
+	require.NoError(t, err)
+	_, err = st.ConfirmEmailChange(ctx, user.Uuid, "jack@"+domain, newToken())
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+	token = newToken()
+	_, err = st.RevertEmailChange(ctx, user.Uuid, "john@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrEmailTaken)
+
+	reverted, err := st.RevertEmailChange(ctx, user.Uuid, "john.smith@"+domain, token)
+	require.NoError(t, err)
+	_, err = st.RevertEmailChange(ctx, user.Uuid, "john.smith@"+domain, token)
+	assert.ErrorIs(t, err, db.ErrTokenUsed)
+	assert.Equal(t, "john.smith@"+domain, reverted.Email)
+	assert.NotNil(t, reverted.EmailVerifiedAt)
+	got, err := st.GetUser(ctx, user.Uuid, false)
+	require.NoError(t, err)
+	assert.Equal(t, reverted, got)
+	_, err = st.ConfirmEmailChange(ctx, user.Uuid, "jack@"+domain, newToken())
+	assert.ErrorIs(t, err, db.ErrNoEmailChange, "reverting drops the pending change")
+}
+
+func testPasswordReset(t *testing.T, st Backend) {
+	ctx := context.Background()
+	user, err := st.AddUser(ctx, "John Doe", unique()+"@example.com")
+	require.NoError(t, err)
+	other, err := st.AddUser(ctx, "Jane Doe", unique()+"@example.com")
+	require.NoError(t, err)
+	prefix := unique()
+	hash := func(n string) string { return prefix + "-" + n }
+
+	assert.ErrorIs(t, st.AddPasswordReset(ctx, uuid.New().String(), hash("none"), time.Now().Add(time.Hour)), db.ErrNotFound)
+	require.NoError(t, st.AddPasswordReset(ctx, user.Uuid, hash("first"), time.Now().Add(time.Hour)))
+	require.NoError(t, st.AddPasswordReset(ctx, user.Uuid, hash("second"), time.Now().Add(time.Hour)))
+	require.NoError(t, st.AddPasswordReset(ctx, other.Uuid, hash("other"), time.Now().Add(-time.Second)))
+
+	_, err = st.AddSession(ctx, db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, hash("session"))
+	require.NoError(t, err)
+
+	_, err = st.ResetPassword(ctx, hash("first"), "first")
+	assert.ErrorIs(t, err, db.ErrResetTokenInvalid, "a newer token replaces older ones")
+	_, err = st.ResetPassword(ctx, hash("other"), "other")
+	assert.ErrorIs(t, err, db.ErrResetTokenInvalid, "expired")
+
+	// A soft-deleted user keeps the token, unused.
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, false, db.AnyVersion))
+	_, err = st.ResetPassword(ctx, hash("second"), "deleted")
+	assert.ErrorIs(t, err, db.ErrUserNotFound)
+	_, err = st.RestoreUser(ctx, user.Uuid)
+	require.NoError(t, err)
+
+	got, err := st.ResetPassword(ctx, hash("second"), "second")
+	require.NoError(t, err)
+	assert.Equal(t, user.Uuid, got)
+	creds, err := st.GetCredentials(ctx, user.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, "second", creds.PasswordHash)
+	_, err = st.RotateRefreshToken(ctx, hash("session"), hash("session2"))
+	assert.ErrorIs(t, err, db.ErrSessionNotFound, "sessions are revoked")
+	_, err = st.ResetPassword(ctx, hash("second"), "again")
+	assert.ErrorIs(t, err, db.ErrResetTokenInvalid, "tokens work once")
+
+	require.NoError(t, st.AddPasswordReset(ctx, user.Uuid, hash("purged"), time.Now().Add(time.Hour)))
+	require.NoError(t, st.DeleteUser(ctx, user.Uuid, true, db.AnyVersion))
+	_, err = st.ResetPassword(ctx, hash("purged"), "purged")
+	assert.ErrorIs(t, err, db.ErrResetTokenInvalid, "purging drops the user's token")
+}
+
+func testCancelled(t *testing.T, st Backend) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := st.AddUser(ctx, "John Doe", unique()+".john@example.com")
+	assert.ErrorIs(t, err, db.ErrUnavailable)
+	_, err = st.GetUser(ctx, uuid.New().String(), false)
+	assert.ErrorIs(t, err, db.ErrUnavailable)
+}
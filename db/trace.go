@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+	"strings"
+)
+
+var (
+	collectionRe    = regexp.MustCompile(`\b(?:FROM|INTO|UPDATE)\s+(\w+)`)
+	systemByDialect = map[Dialect]string{
+		Postgres: semconv.DBSystemNamePostgreSQL.Value.AsString(),
+		SQLite:   semconv.DBSystemNameSQLite.Value.AsString(),
+	}
+)
+
+// startQuery opens a client span for a query, named and attributed after
+// the OpenTelemetry database conventions. The query text carries
+// placeholders only, never the arguments.
+func (st *StDb) startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation, _, _ := strings.Cut(query, " ")
+	name := operation
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemNameKey.String(systemByDialect[st.dialect]),
+		semconv.DBOperationName(operation),
+		semconv.DBQueryText(query),
+	}
+	if m := collectionRe.FindStringSubmatch(query); m != nil {
+		name += " " + m[1]
+		attrs = append(attrs, semconv.DBCollectionName(m[1]))
+	}
+	return otel.Tracer("user-service/db").Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func endQuery(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
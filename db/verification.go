@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	ErrTokenUsed = &Error{Kind: ErrConflict, Msg: "token was already used"}
+	// ErrEmailChanged is returned when verifying an email the user no
+	// longer has.
+	ErrEmailChanged = &Error{Kind: ErrConflict, Msg: "email changed since the token was issued"}
+)
+
+// UsedToken is a single-use token being used: its id, kept until the token
+// expires, after which it is refused anyway.
+type UsedToken struct {
+	Id        string
+	ExpiresAt time.Time
+}
+
+// useToken records that token was used, or returns ErrTokenUsed if it was
+// before. Expired ids are dropped along the way.
+func (st *StDb) useToken(ctx context.Context, token UsedToken) error {
+	if _, err := st.exec(ctx, "DELETE FROM used_tokens WHERE expires_at < $1", time.Now()); err != nil {
+		return wrapErr(ctx, err)
+	}
+	res, err := st.exec(ctx, "INSERT INTO used_tokens (id, expires_at) VALUES($1, $2) ON CONFLICT (id) DO NOTHING", token.Id, token.ExpiresAt)
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapErr(ctx, err)
+	}
+	if n == 0 {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// VerifyEmail marks the email of a user as verified, provided the user
+// still has that email, and uses token up in the same transaction: it fails
+// with ErrTokenUsed if the token was used before, and a failure leaves the
+// token unused. Verifying a verified email changes nothing.
+func (st *StDb) VerifyEmail(ctx context.Context, uuid string, email string, token UsedToken) (*User, error) {
+	ctx, cancel := st.withTimeout(ctx)
+	defer cancel()
+
+	var user *User
+	err := st.inTx(ctx, func(tx *StDb) error {
+		if err := tx.useToken(ctx, token); err != nil {
+			return err
+		}
+		_, err := tx.exec(ctx, "UPDATE users SET email_verified_at = $1, version = version + 1 WHERE uuid = $2 AND email = $3 AND deleted_at IS NULL AND email_verified_at IS NULL",
+			time.Now(), uuid, email)
+		if err != nil {
+			return wrapErr(ctx, err)
+		}
+		if user, err = tx.GetUser(ctx, uuid, false); err != nil {
+			return err
+		}
+		if user.Email != email {
+			return ErrEmailChanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
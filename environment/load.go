@@ -1,31 +1,431 @@
 package environment
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Env is the service configuration. Every setting has a `key` used in config
+// files and, joined with its section as section-key, as the command line flag,
+// and an `env` variable. Settings tagged secret are redacted when printed.
 type Env struct {
-	App App
-	Db  Db
+	App       App       `key:"app"`
+	Db        Db        `key:"db"`
+	Email     Email     `key:"email"`
+	Log       Log       `key:"log"`
+	Cors      Cors      `key:"cors"`
+	Tls       Tls       `key:"tls"`
+	Tracing   Tracing   `key:"tracing"`
+	RateLimit RateLimit `key:"rate_limit"`
+	Jwt       Jwt       `key:"jwt"`
+	Password  Password  `key:"password"`
+	Session   Session   `key:"session"`
+	Mail      Mail      `key:"mail"`
 }
 
 type App struct {
-	Port string
+	Port              string        `key:"port" env:"APP_PORT"`
+	AdminToken        string        `key:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+	IdempotencyTTL    time.Duration `key:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+	ShutdownTimeout   time.Duration `key:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `key:"read_header_timeout" env:"APP_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `key:"read_timeout" env:"APP_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `key:"write_timeout" env:"APP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `key:"idle_timeout" env:"APP_IDLE_TIMEOUT"`
+	ReadyTimeout      time.Duration `key:"ready_timeout" env:"APP_READY_TIMEOUT"`
+	// DrainDelay is how long /readyz fails before shutdown starts, giving
+	// load balancers time to stop routing to the instance.
+	DrainDelay time.Duration `key:"drain_delay" env:"APP_DRAIN_DELAY"`
+	// TrustedProxies are the addresses or CIDRs whose X-Forwarded-For
+	// header is believed when telling clients apart.
+	TrustedProxies []string `key:"trusted_proxies" env:"APP_TRUSTED_PROXIES"`
 }
 
 type Db struct {
-	Dsn string
+	Driver          string        `key:"driver" env:"DB_DRIVER"`
+	Dsn             string        `key:"dsn" env:"DB_DATA_SOURCE_NAME" secret:"true"`
+	QueryTimeout    time.Duration `key:"query_timeout" env:"DB_QUERY_TIMEOUT"`
+	AutoMigrate     bool          `key:"auto_migrate" env:"AUTO_MIGRATE"`
+	MaxOpenConns    int           `key:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `key:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `key:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `key:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
 }
 
-func LoadEnv() *Env {
-	env := &Env{
+type Email struct {
+	IgnoreDots      bool          `key:"ignore_dots" env:"EMAIL_IGNORE_DOTS"`
+	IgnorePlusTags  bool          `key:"ignore_plus_tags" env:"EMAIL_IGNORE_PLUS_TAGS"`
+	VerificationTTL time.Duration `key:"verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	RevertTTL       time.Duration `key:"revert_ttl" env:"EMAIL_REVERT_TTL"`
+}
+
+// Log is JSON unless Format is "text". Personal data such as emails is
+// redacted from logs unless LogPII is set.
+type Log struct {
+	Level  string `key:"level" env:"LOG_LEVEL"`
+	Format string `key:"format" env:"LOG_FORMAT"`
+	LogPII bool   `key:"pii" env:"LOG_PII"`
+}
+
+// Cors is disabled while AllowedOrigins is empty.
+type Cors struct {
+	AllowedOrigins   []string      `key:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedHeaders   []string      `key:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	AllowCredentials bool          `key:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	MaxAge           time.Duration `key:"max_age" env:"CORS_MAX_AGE"`
+}
+
+// Tls serves HTTPS when both files are set.
+type Tls struct {
+	CertFile string `key:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `key:"key_file" env:"TLS_KEY_FILE"`
+}
+
+// Tracing exports spans to an OTLP/HTTP collector, to stdout or to a file,
+// or nowhere with the "none" exporter.
+type Tracing struct {
+	Exporter    string  `key:"exporter" env:"TRACING_EXPORTER"`
+	Endpoint    string  `key:"endpoint" env:"TRACING_OTLP_ENDPOINT"`
+	Insecure    bool    `key:"insecure" env:"TRACING_OTLP_INSECURE"`
+	File        string  `key:"file" env:"TRACING_FILE"`
+	ServiceName string  `key:"service_name" env:"TRACING_SERVICE_NAME"`
+	SampleRatio float64 `key:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// RateLimit has a limit such as "100/m" per route group, told apart by the
+// client's IP address, API key or authenticated subject. An empty limit
+// leaves the group unlimited.
+type RateLimit struct {
+	Key    string `key:"key" env:"RATE_LIMIT_KEY"`
+	Read   string `key:"read" env:"RATE_LIMIT_READ"`
+	Write  string `key:"write" env:"RATE_LIMIT_WRITE"`
+	Create string `key:"create" env:"RATE_LIMIT_CREATE"`
+	Login  string `key:"login" env:"RATE_LIMIT_LOGIN"`
+}
+
+// Jwt accepts bearer JWTs signed by a key of the JWKS, a file or an http(s)
+// URL, when it is set. The roles in RolesClaim are granted scopes by the
+// role=scope pairs of RoleScopes.
+type Jwt struct {
+	Jwks        string        `key:"jwks" env:"JWT_JWKS"`
+	JwksRefresh time.Duration `key:"jwks_refresh" env:"JWT_JWKS_REFRESH"`
+	Issuer      string        `key:"issuer" env:"JWT_ISSUER"`
+	Audience    string        `key:"audience" env:"JWT_AUDIENCE"`
+	RolesClaim  string        `key:"roles_claim" env:"JWT_ROLES_CLAIM"`
+	RoleScopes  []string      `key:"role_scopes" env:"JWT_ROLE_SCOPES"`
+}
+
+// Password is the password policy, the Argon2id parameters (memory in KiB)
+// and the lockout after failed logins. DenylistFile lists refused passwords,
+// one per line.
+type Password struct {
+	MinLength         int           `key:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	DenylistFile      string        `key:"denylist_file" env:"PASSWORD_DENYLIST_FILE"`
+	Argon2Memory      int           `key:"argon2_memory" env:"PASSWORD_ARGON2_MEMORY"`
+	Argon2Iterations  int           `key:"argon2_iterations" env:"PASSWORD_ARGON2_ITERATIONS"`
+	Argon2Parallelism int           `key:"argon2_parallelism" env:"PASSWORD_ARGON2_PARALLELISM"`
+	MaxFailedLogins   int           `key:"max_failed_logins" env:"PASSWORD_MAX_FAILED_LOGINS"`
+	Lockout           time.Duration `key:"lockout" env:"PASSWORD_LOCKOUT"`
+	ResetTTL          time.Duration `key:"reset_ttl" env:"PASSWORD_RESET_TTL"`
+}
+
+// Session is how long sessions started by logging in and their access
+// tokens last. Access tokens are signed with SigningKey; when it is empty a
+// random key is made at start, so tokens don't survive restarts and aren't
+// accepted by other instances.
+type Session struct {
+	SigningKey string        `key:"signing_key" env:"SESSION_SIGNING_KEY" secret:"true"`
+	AccessTTL  time.Duration `key:"access_ttl" env:"SESSION_ACCESS_TTL"`
+	TTL        time.Duration `key:"ttl" env:"SESSION_TTL"`
+}
+
+// Mail is how emails are delivered: written to files in Dir by the dir
+// driver, sent through the server at SmtpAddr by smtp, or not at all with
+// none, the default, as the emails hold live tokens. Links in emails point to pages under LinkURL, the front end that
+// handles them.
+type Mail struct {
+	Driver       string `key:"driver" env:"MAIL_DRIVER"`
+	From         string `key:"from" env:"MAIL_FROM"`
+	Dir          string `key:"dir" env:"MAIL_DIR"`
+	SmtpAddr     string `key:"smtp_addr" env:"MAIL_SMTP_ADDR"`
+	SmtpUsername string `key:"smtp_username" env:"MAIL_SMTP_USERNAME"`
+	SmtpPassword string `key:"smtp_password" env:"MAIL_SMTP_PASSWORD" secret:"true"`
+	LinkURL      string `key:"link_url" env:"MAIL_LINK_URL"`
+}
+
+// Defaults returns the configuration used for settings no source sets.
+func Defaults() *Env {
+	return &Env{
 		App: App{
-			Port: os.Getenv("APP_PORT"),
+			Port:              "4000",
+			IdempotencyTTL:    24 * time.Hour,
+			ShutdownTimeout:   5 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      15 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ReadyTimeout:      2 * time.Second,
 		},
 		Db: Db{
-			Dsn: os.Getenv("DB_DATA_SOURCE_NAME"),
+			Driver:          "postgres",
+			QueryTimeout:    3 * time.Second,
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Cors: Cors{
+			AllowedHeaders: []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "Idempotency-Key"},
+			MaxAge:         12 * time.Hour,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			ServiceName: "users-service",
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimit{
+			Key:    "ip",
+			Read:   "600/m",
+			Write:  "120/m",
+			Create: "30/m",
+			Login:  "10/m",
+		},
+		Jwt: Jwt{
+			JwksRefresh: 15 * time.Minute,
+			RolesClaim:  "roles",
+		},
+		Password: Password{
+			MinLength:         8,
+			Argon2Memory:      64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 4,
+			MaxFailedLogins:   5,
+			Lockout:           15 * time.Minute,
+			ResetTTL:          30 * time.Minute,
+		},
+		Session: Session{
+			AccessTTL: 15 * time.Minute,
+			TTL:       30 * 24 * time.Hour,
+		},
+		Email: Email{
+			VerificationTTL: 24 * time.Hour,
+			RevertTTL:       7 * 24 * time.Hour,
+		},
+		Mail: Mail{
+			Driver: "none",
+			From:   "users-service <no-reply@localhost>",
+			Dir:    "outbox",
 		},
 	}
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the YAML or TOML file named by -config or CONFIG_FILE, environment
+// variables and command line flags, and validates it. Flags must come before
+// any command; the arguments left after them are returned.
+func Load(args []string) (*Env, []string, error) {
+	// Flags are parsed twice: once to find the config file, then again on
+	// top of the file and the environment.
+	configFile := os.Getenv("CONFIG_FILE")
+	if err := newFlagSet(Defaults().settings(), &configFile, new([]error)).Parse(args); err != nil {
+		return nil, nil, err
+	}
 
-	return env
+	env := Defaults()
+	settings := env.settings()
+	var errs []error
+	if configFile != "" {
+		if err := loadFile(configFile, settings); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, s := range settings {
+		// Empty variables count as unset, as .env.template leaves them.
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	fs := newFlagSet(settings, &configFile, &errs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := errors.Join(append(errs, env.Validate())...); err != nil {
+		return nil, nil, err
+	}
+
+	return env, fs.Args(), nil
+}
+
+// newFlagSet has a flag per setting. Invalid values are collected in errs
+// rather than stopping the parse, so they are reported with the others.
+func newFlagSet(settings []*setting, configFile *string, errs *[]error) *flag.FlagSet {
+	fs := flag.NewFlagSet("users-service", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", *configFile, "YAML or TOML config file")
+	for _, s := range settings {
+		fs.Func(s.flag, "overrides "+s.env, func(v string) error {
+			if err := s.set(v); err != nil {
+				*errs = append(*errs, fmt.Errorf("-%s: %w", s.flag, err))
+			}
+			return nil
+		})
+	}
+	return fs
+}
+
+// setting is a single configuration value found by walking Env.
+type setting struct {
+	path   string // section.key, as in the config file
+	flag   string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+func (env *Env) settings() []*setting {
+	var settings []*setting
+	root := reflect.ValueOf(env).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section, sectionKey := root.Field(i), root.Type().Field(i).Tag.Get("key")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			key := field.Tag.Get("key")
+			settings = append(settings, &setting{
+				path:   sectionKey + "." + key,
+				flag:   strings.ReplaceAll(sectionKey+"-"+key, "_", "-"),
+				env:    field.Tag.Get("env"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  section.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses v into the setting. Lists are comma separated.
+func (s *setting) set(v string) error {
+	v = strings.TrimSpace(v)
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		s.value.SetInt(int64(n))
+	case s.value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", v)
+		}
+		s.value.SetFloat(f)
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		s.value.SetBool(b)
+	case s.value.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(list))
+	default:
+		s.value.SetString(v)
+	}
+	return nil
+}
+
+// String formats the value the way set parses it.
+func (s *setting) String() string {
+	switch v := s.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// loadFile applies a YAML or TOML file, picked by its extension. Values
+// are set like environment variables, so both parse the same way.
+func loadFile(path string, settings []*setting) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		return fmt.Errorf("config file %s: unknown format, use .yaml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	byPath := make(map[string]*setting, len(settings))
+	for _, s := range settings {
+		byPath[s.path] = s
+	}
+	var errs []error
+	for sectionKey, section := range doc {
+		values, ok := section.(map[string]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("config file %s: %s must be a section", path, sectionKey))
+			continue
+		}
+		for key, value := range values {
+			s, ok := byPath[sectionKey+"."+key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("config file %s: unknown setting %s.%s", path, sectionKey, key))
+				continue
+			}
+			if err := s.set(fileValue(value)); err != nil {
+				errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, s.path, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func fileValue(v any) string {
+	if v == nil {
+		return ""
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = fmt.Sprint(item)
+	}
+	return strings.Join(items, ",")
 }
@@ -0,0 +1,61 @@
+package environment
+
+import (
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// Print writes the configuration as a YAML config file with the secrets
+// redacted. Passwords in URLs are masked but the rest is kept, so a redacted
+// DSN still tells which database is used.
+func (env *Env) Print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	var section *yaml.Node
+	for _, s := range env.settings() {
+		sectionKey, key, _ := strings.Cut(s.path, ".")
+		if section == nil || doc.Content[len(doc.Content)-2].Value != sectionKey {
+			section = &yaml.Node{Kind: yaml.MappingNode}
+			doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: sectionKey}, section)
+		}
+		value := &yaml.Node{}
+		if list, ok := s.value.Interface().([]string); ok {
+			value.Kind, value.Style = yaml.SequenceNode, yaml.FlowStyle
+			for _, item := range list {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+			}
+		} else {
+			value.Kind, value.Value = yaml.ScalarNode, s.String()
+			if s.secret {
+				value.Value = redact(value.Value)
+			}
+			if value.Value == "" {
+				value.Style = yaml.DoubleQuotedStyle
+			}
+		}
+		section.Content = append(section.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func redact(v string) string {
+	if v == "" {
+		return ""
+	}
+	if u, err := url.Parse(v); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+		return v
+	}
+	return redacted
+}
@@ -0,0 +1,160 @@
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"user-service/auth"
+	"user-service/ratelimit"
+)
+
+var (
+	drivers    = []string{"postgres", "sqlite", "memory"}
+	logLevels  = []string{"debug", "info", "warn", "error"}
+	logFormats = []string{"json", "text"}
+	exporters  = []string{"none", "otlp", "stdout", "file"}
+	rateKeys   = []string{"ip", "api_key", "subject"}
+	mailers    = []string{"dir", "smtp", "none"}
+)
+
+// Validate checks the whole configuration and reports every problem at once.
+func (env *Env) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(env.App.Port)
+	check(err == nil && port > 0 && port < 65536, "app.port: %q is not a port number", env.App.Port)
+	check(env.App.IdempotencyTTL > 0, "app.idempotency_ttl: must be positive")
+	check(env.App.ShutdownTimeout > 0, "app.shutdown_timeout: must be positive")
+	check(env.App.ReadHeaderTimeout >= 0, "app.read_header_timeout: must not be negative")
+	check(env.App.ReadTimeout >= 0, "app.read_timeout: must not be negative")
+	check(env.App.WriteTimeout >= 0, "app.write_timeout: must not be negative")
+	check(env.App.IdleTimeout >= 0, "app.idle_timeout: must not be negative")
+	check(env.App.ReadyTimeout > 0, "app.ready_timeout: must be positive")
+	check(env.App.DrainDelay >= 0, "app.drain_delay: must not be negative")
+	for _, proxy := range env.App.TrustedProxies {
+		check(validProxy(proxy), "app.trusted_proxies: %q is not an IP address or CIDR", proxy)
+	}
+
+	check(oneOf(env.Db.Driver, drivers), "db.driver: %q is not one of %v", env.Db.Driver, drivers)
+	check(env.Db.Driver == "memory" || env.Db.Dsn != "", "db.dsn: required by the %s driver", env.Db.Driver)
+	check(env.Db.QueryTimeout > 0, "db.query_timeout: must be positive")
+	check(env.Db.MaxOpenConns >= 0, "db.max_open_conns: must not be negative")
+	check(env.Db.MaxIdleConns >= 0, "db.max_idle_conns: must not be negative")
+	check(env.Db.MaxOpenConns == 0 || env.Db.MaxIdleConns <= env.Db.MaxOpenConns,
+		"db.max_idle_conns: %d is more than db.max_open_conns %d", env.Db.MaxIdleConns, env.Db.MaxOpenConns)
+	check(env.Db.ConnMaxLifetime >= 0, "db.conn_max_lifetime: must not be negative")
+	check(env.Db.ConnMaxIdleTime >= 0, "db.conn_max_idle_time: must not be negative")
+
+	check(env.Email.VerificationTTL > 0, "email.verification_ttl: must be positive")
+	check(env.Email.RevertTTL > 0, "email.revert_ttl: must be positive")
+
+	check(oneOf(env.Log.Level, logLevels), "log.level: %q is not one of %v", env.Log.Level, logLevels)
+	check(oneOf(env.Log.Format, logFormats), "log.format: %q is not one of %v", env.Log.Format, logFormats)
+
+	for _, origin := range env.Cors.AllowedOrigins {
+		if origin == "*" {
+			check(!env.Cors.AllowCredentials, "cors.allowed_origins: * can't be combined with cors.allow_credentials")
+			continue
+		}
+		u, err := url.Parse(origin)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Path == "",
+			"cors.allowed_origins: %q is not an origin like https://example.com", origin)
+	}
+	check(env.Cors.MaxAge >= 0, "cors.max_age: must not be negative")
+
+	check((env.Tls.CertFile == "") == (env.Tls.KeyFile == ""), "tls: cert_file and key_file must be set together")
+	for key, file := range map[string]string{"tls.cert_file": env.Tls.CertFile, "tls.key_file": env.Tls.KeyFile} {
+		if file != "" {
+			_, err := os.Stat(file)
+			check(err == nil, "%s: %v", key, err)
+		}
+	}
+
+	check(oneOf(env.Tracing.Exporter, exporters), "tracing.exporter: %q is not one of %v", env.Tracing.Exporter, exporters)
+	check(env.Tracing.Exporter != "file" || env.Tracing.File != "", "tracing.file: required by the file exporter")
+	check(env.Tracing.ServiceName != "", "tracing.service_name: must not be empty")
+	check(env.Tracing.SampleRatio >= 0 && env.Tracing.SampleRatio <= 1, "tracing.sample_ratio: %v is not between 0 and 1", env.Tracing.SampleRatio)
+
+	check(oneOf(env.RateLimit.Key, rateKeys), "rate_limit.key: %q is not one of %v", env.RateLimit.Key, rateKeys)
+	for key, limit := range map[string]string{
+		"rate_limit.read":   env.RateLimit.Read,
+		"rate_limit.write":  env.RateLimit.Write,
+		"rate_limit.create": env.RateLimit.Create,
+		"rate_limit.login":  env.RateLimit.Login,
+	} {
+		_, err := ratelimit.ParseLimit(limit)
+		check(err == nil, "%s: %v", key, err)
+	}
+
+	if env.Jwt.Jwks != "" {
+		check(env.Jwt.Issuer != "", "jwt.issuer: required with jwt.jwks")
+		check(env.Jwt.Audience != "", "jwt.audience: required with jwt.jwks")
+		check(env.Jwt.JwksRefresh > 0, "jwt.jwks_refresh: must be positive")
+		check(env.Jwt.RolesClaim != "", "jwt.roles_claim: must not be empty")
+		_, err := auth.ParseRoleScopes(env.Jwt.RoleScopes)
+		check(err == nil, "jwt.role_scopes: %v", err)
+	}
+
+	check(env.Password.MinLength > 0 && env.Password.MinLength <= auth.MaxPasswordLength,
+		"password.min_length: %d is not between 1 and %d", env.Password.MinLength, auth.MaxPasswordLength)
+	check(env.Password.Argon2Memory >= 8*env.Password.Argon2Parallelism && env.Password.Argon2Memory <= 4<<20,
+		"password.argon2_memory: %d KiB is not between 8 KiB per thread and 4 GiB", env.Password.Argon2Memory)
+	check(env.Password.Argon2Iterations > 0, "password.argon2_iterations: must be positive")
+	check(env.Password.Argon2Parallelism > 0 && env.Password.Argon2Parallelism < 256,
+		"password.argon2_parallelism: %d is not between 1 and 255", env.Password.Argon2Parallelism)
+	if env.Password.DenylistFile != "" {
+		_, err := os.Stat(env.Password.DenylistFile)
+		check(err == nil, "password.denylist_file: %v", err)
+	}
+	check(env.Password.MaxFailedLogins > 0, "password.max_failed_logins: must be positive")
+	check(env.Password.Lockout > 0, "password.lockout: must be positive")
+	check(env.Password.ResetTTL > 0, "password.reset_ttl: must be positive")
+
+	check(env.Session.SigningKey == "" || len(env.Session.SigningKey) >= auth.MinSigningKeyLength,
+		"session.signing_key: must be at least %d bytes", auth.MinSigningKeyLength)
+	check(env.Session.AccessTTL > 0, "session.access_ttl: must be positive")
+	check(env.Session.TTL >= env.Session.AccessTTL, "session.ttl: must be at least session.access_ttl")
+
+	check(oneOf(env.Mail.Driver, mailers), "mail.driver: %q is not one of %v", env.Mail.Driver, mailers)
+	if env.Mail.Driver != "none" {
+		_, err := mail.ParseAddress(env.Mail.From)
+		check(err == nil, "mail.from: %q is not an email address", env.Mail.From)
+	}
+	check(env.Mail.Driver != "dir" || env.Mail.Dir != "", "mail.dir: required by the dir driver")
+	if env.Mail.Driver == "smtp" {
+		_, _, err := net.SplitHostPort(env.Mail.SmtpAddr)
+		check(err == nil, "mail.smtp_addr: %q is not a host:port", env.Mail.SmtpAddr)
+	}
+	if env.Mail.LinkURL != "" {
+		u, err := url.Parse(env.Mail.LinkURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"mail.link_url: %q is not an http(s) URL", env.Mail.LinkURL)
+	}
+
+	return errors.Join(errs...)
+}
+
+func validProxy(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+func oneOf(v string, allowed []string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/logging"
+)
+
+// apiKeyTouchInterval is how often the last use of a key is written down, so
+// busy keys don't cost a write per request.
+const apiKeyTouchInterval = time.Minute
+
+const (
+	// scopesKey is the gin context key of the scopes the request was granted.
+	scopesKey = "scopes"
+	// selfKey is the gin context key of the uuid of the user a token was
+	// issued to.
+	selfKey = "self"
+	// apiKeyIdKey is the gin context key of the id of the API key the
+	// request authenticated with.
+	apiKeyIdKey = "api_key_id"
+)
+
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, hash string) (*db.APIKey, error)
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+// TokenVerifier checks bearer JWTs. auth.Verifier checks them against a JWKS.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*auth.Principal, error)
+}
+
+// anonymousScopes are granted to requests without credentials while
+// authentication is off.
+var anonymousScopes = []string{auth.ScopeRead, auth.ScopeWrite}
+
+// Authenticate checks the Authorization: Bearer credentials of the request,
+// an API key, a JWT or the access token of a session, and grants it their
+// scopes. AdminToken is accepted as
+// a key with every scope. Requests without credentials go on
+// unauthenticated, and Require decides whether that's enough.
+func (h *Handler) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		ok := true
+		switch {
+		case token != "" && h.AdminToken != "" &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) == 1:
+			c.Set(scopesKey, auth.Scopes)
+			c.Set(logging.SubjectKey, "admin")
+		case h.APIKeys == nil && h.Tokens == nil && h.AccessTokens == nil:
+			c.Set(scopesKey, anonymousScopes)
+		case token == "":
+		case (h.Tokens != nil || h.AccessTokens != nil) && auth.IsJWT(token):
+			ok = h.authenticateToken(c, token)
+		case h.APIKeys != nil:
+			ok = h.authenticateAPIKey(c, token)
+		default:
+			h.rejectCredentials(c, "invalid bearer credentials")
+			ok = false
+		}
+		if !ok {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticateToken reports whether token is an access token of ours or a
+// valid JWT. Otherwise the response has been written already.
+func (h *Handler) authenticateToken(c *gin.Context, token string) bool {
+	ctx := c.Request.Context()
+	p, err := h.verifyToken(ctx, token)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		slog.DebugContext(ctx, "rejected token", "error", err)
+		h.rejectCredentials(c, "invalid or expired token")
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "verifying token", "error", err)
+		writeProblem(c, http.StatusServiceUnavailable, CodeUnavailable, "tokens can't be verified right now")
+		return false
+	}
+	c.Set(scopesKey, p.Scopes)
+	c.Set(selfKey, p.Subject)
+	c.Set(sessionKey, p.SessionId)
+	c.Set(logging.SubjectKey, "user:"+p.Subject)
+	return true
+}
+
+// verifyToken checks token as an access token of a session first, then
+// against the JWKS. A session that can't be looked up fails the request
+// rather than being taken for some other token.
+func (h *Handler) verifyToken(ctx context.Context, token string) (*auth.Principal, error) {
+	if h.AccessTokens != nil {
+		p, err := h.AccessTokens.Verify(ctx, token)
+		if err == nil || h.Tokens == nil || !errors.Is(err, auth.ErrInvalidToken) {
+			return p, err
+		}
+	}
+	return h.Tokens.Verify(ctx, token)
+}
+
+// authenticateAPIKey reports whether token is a valid API key. Otherwise the
+// response has been written already.
+func (h *Handler) authenticateAPIKey(c *gin.Context, token string) bool {
+	ctx := c.Request.Context()
+	key, err := h.APIKeys.GetAPIKey(ctx, auth.HashAPIKey(token))
+	if errors.Is(err, db.ErrNotFound) {
+		h.rejectCredentials(c, "invalid or revoked api key")
+		return false
+	}
+	if err != nil {
+		writeStorageProblem(c, err)
+		return false
+	}
+	if now := time.Now(); key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := h.APIKeys.TouchAPIKey(ctx, key.Id, now); err != nil {
+			slog.WarnContext(ctx, "recording api key use", "api_key_id", key.Id, "error", err)
+		}
+	}
+	c.Set(scopesKey, key.Scopes)
+	c.Set(apiKeyIdKey, key.Id)
+	c.Set(logging.SubjectKey, "api_key:"+key.Id)
+	return true
+}
+
+// Require lets the request through if it was granted scope: 401 if it has no
+// valid credentials, 403 if they lack the scope.
+func (h *Handler) Require(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get(scopesKey); !ok {
+			writeUnauthorized(c, "Bearer", "missing bearer credentials")
+			c.Abort()
+			return
+		}
+		if !hasScope(c, scope) {
+			writeProblem(c, http.StatusForbidden, CodeForbidden, "credentials lack the "+scope+" scope")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireOrSelf is Require, except that a token issued to the user the
+// route is about needs no scope.
+func (h *Handler) RequireOrSelf(scope string) gin.HandlerFunc {
+	require := h.Require(scope)
+	return func(c *gin.Context) {
+		if self := c.GetString(selfKey); self != "" && self == c.Param("uuid") {
+			c.Next()
+			return
+		}
+		require(c)
+	}
+}
+
+// RequireOrOwnSession is RequireOrSelf for routes that touch the user's
+// credentials: only the access token of one of the user's sessions needs no
+// scope. Any issuer behind JWT_JWKS can mint a token naming the user, so
+// those get no say in their password or sessions.
+func (h *Handler) RequireOrOwnSession(scope string) gin.HandlerFunc {
+	require := h.Require(scope)
+	return func(c *gin.Context) {
+		if self := c.GetString(selfKey); self != "" && self == c.Param("uuid") && c.GetString(sessionKey) != "" {
+			c.Next()
+			return
+		}
+		require(c)
+	}
+}
+
+// hasScope reports whether the request was granted scope.
+func hasScope(c *gin.Context, scope string) bool {
+	return auth.HasScope(c.GetStringSlice(scopesKey), scope)
+}
+
+// rejectCredentials answers a request with bad credentials with 401. Each
+// such request is charged to the login limit of its IP address, as the
+// limits of the routes only apply once a client is authenticated; guessing
+// too often gets 429 instead.
+func (h *Handler) rejectCredentials(c *gin.Context, detail string) {
+	if !h.takeRateLimit(c, RateLimitLogin, "ip:"+c.ClientIP()) {
+		return
+	}
+	writeUnauthorized(c, `Bearer error="invalid_token"`, detail)
+}
+
+func writeUnauthorized(c *gin.Context, challenge string, detail string) {
+	c.Header("WWW-Authenticate", challenge)
+	writeProblem(c, http.StatusUnauthorized, CodeUnauthorized, detail)
+}
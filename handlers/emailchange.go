@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/mail"
+)
+
+const DefaultEmailRevertTTL = 7 * 24 * time.Hour
+
+type EmailChangeStore interface {
+	RequestEmailChange(ctx context.Context, uuid string, email string) (*db.User, error)
+	ConfirmEmailChange(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error)
+	RevertEmailChange(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error)
+}
+
+type ChangeEmailReq struct {
+	Email string `json:"email" binding:"required,email,max=100"`
+}
+
+// ChangeEmail godoc
+//
+//	@Summary		Change email
+//	@Description	Ask to change the email of a user. A link to confirm the change is sent to the new email and a link to undo it to the current one; the email only changes once confirmed.
+//	@Tags			Users
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string			true	"User uuid"
+//	@Param			data	body		ChangeEmailReq	true	"New email"
+//	@Success		202		{object}	MessageResp		"Emails sent"
+//	@Failure		400		{object}	Problem			"Bad request"
+//	@Failure		401		{object}	Problem			"Missing or invalid credentials"
+//	@Failure		403		{object}	Problem			"Forbidden"
+//	@Failure		404		{object}	Problem			"Not found"
+//	@Failure		409		{object}	Problem			"Email taken or unchanged"
+//	@Failure		429		{object}	Problem			"Rate limit exceeded"
+//	@Failure		503		{object}	Problem			"Storage or mail server unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/email [post]
+func (h *Handler) ChangeEmail() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req ChangeEmailReq
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.emailChangeEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "email changes are not enabled")
+			return
+		}
+		email := strings.TrimSpace(req.Email)
+		ctx := c.Request.Context()
+		user, err := h.Storage.GetUser(ctx, userUuid, false)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		if email == user.Email {
+			writeProblem(c, http.StatusConflict, CodeConflict, "email is unchanged")
+			return
+		}
+		if user, err = h.EmailChanges.RequestEmailChange(ctx, userUuid, email); err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+
+		ttl, revertTTL := h.VerificationTTL, h.EmailRevertTTL
+		if ttl <= 0 {
+			ttl = DefaultVerificationTTL
+		}
+		if revertTTL <= 0 {
+			revertTTL = DefaultEmailRevertTTL
+		}
+		confirm, err := h.EmailTokens.Issue(auth.PurposeChangeEmail, user.Uuid, email, ttl)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		revert, err := h.EmailTokens.Issue(auth.PurposeRevertEmail, user.Uuid, user.Email, revertTTL)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		// The current address hears first: nothing can be confirmed unless
+		// its owner can also undo it.
+		if !h.sendMail(c, mail.Message{
+			To:      user.Email,
+			Subject: "Your email is being changed",
+			Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to change the email of your account to %s. It changes once they confirm from that address.\n\nIf it wasn't you, undo the change and sign everyone out of your account:\n\n%s\n",
+				user.Name, email, h.link("/email/revert", revert)),
+		}) {
+			return
+		}
+		if !h.sendMail(c, mail.Message{
+			To:      email,
+			Subject: "Confirm your new email",
+			Body: fmt.Sprintf("Hello %s,\n\nplease confirm that this is your new email address:\n\n%s\n\nIf you didn't ask for this, ignore this email.\n",
+				user.Name, h.link("/email/confirm", confirm)),
+		}) {
+			return
+		}
+		c.JSON(http.StatusAccepted, &MessageResp{Message: "confirmation email sent"})
+	}
+}
+
+// ConfirmEmail godoc
+//
+//	@Summary		Confirm an email change
+//	@Description	Consume the token sent to the new email of a user and swap it for the current one. Only the latest change asked for can be confirmed, once.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		VerifyReq	true	"Token"
+//	@Success		200		{object}	UserResp	"Email changed"
+//	@Failure		400		{object}	Problem		"Invalid, expired or used token"
+//	@Failure		404		{object}	Problem		"Email changes are not enabled"
+//	@Failure		409		{object}	Problem		"Email taken"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Router			/email/confirm [post]
+func (h *Handler) ConfirmEmail() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req VerifyReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.emailChangeEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "email changes are not enabled")
+			return
+		}
+		token, ok := h.checkEmailToken(c, auth.PurposeChangeEmail, req.Token)
+		if !ok {
+			return
+		}
+		user, err := h.EmailChanges.ConfirmEmailChange(c.Request.Context(), token.UserUuid, token.Email, usedToken(token))
+		if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrTokenUsed) || errors.Is(err, db.ErrNoEmailChange) {
+			writeProblem(c, http.StatusBadRequest, CodeInvalidToken, err.Error())
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		writeEmailUser(c, "email changed", user)
+	}
+}
+
+// RevertEmail godoc
+//
+//	@Summary		Undo an email change
+//	@Description	Consume the token sent to the former email of a user, give it back to them and cancel any pending change. As the change may not have been theirs, their sessions are revoked.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		VerifyReq	true	"Token"
+//	@Success		200		{object}	UserResp	"Email restored"
+//	@Failure		400		{object}	Problem		"Invalid, expired or used token"
+//	@Failure		404		{object}	Problem		"Email changes are not enabled"
+//	@Failure		409		{object}	Problem		"Email taken"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Router			/email/revert [post]
+func (h *Handler) RevertEmail() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req VerifyReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.emailChangeEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "email changes are not enabled")
+			return
+		}
+		token, ok := h.checkEmailToken(c, auth.PurposeRevertEmail, req.Token)
+		if !ok {
+			return
+		}
+		ctx := c.Request.Context()
+		user, err := h.EmailChanges.RevertEmailChange(ctx, token.UserUuid, token.Email, usedToken(token))
+		if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrTokenUsed) {
+			writeProblem(c, http.StatusBadRequest, CodeInvalidToken, err.Error())
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		// The email is back already, so a failure here is only logged.
+		if h.Sessions != nil {
+			if _, err := h.Sessions.RevokeSessions(ctx, user.Uuid); err != nil {
+				slog.ErrorContext(ctx, "revoking sessions after an email change was undone", "error", err)
+			}
+		}
+		writeEmailUser(c, "email restored", user)
+	}
+}
+
+func (h *Handler) emailChangeEnabled() bool {
+	return h.verificationEnabled() && h.EmailChanges != nil
+}
+
+func writeEmailUser(c *gin.Context, message string, user *db.User) {
+	c.Header("ETag", etag(user))
+	c.JSON(http.StatusOK, &UserResp{
+		Message:         message,
+		Uuid:            user.Uuid,
+		Name:            &user.Name,
+		Email:           &user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+	})
+}
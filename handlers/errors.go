@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"user-service/db"
+)
+
+// Machine-readable error codes returned in Problem.Code.
+const (
+	CodeMalformedBody         = "malformed_body"
+	CodeValidation            = "validation_failed"
+	CodeInvalidInput          = "invalid_input"
+	CodeMediaType             = "unsupported_media_type"
+	CodePatchFailed           = "patch_failed"
+	CodePatchTest             = "patch_test_failed"
+	CodeNotFound              = "not_found"
+	CodeUnauthorized          = "unauthorized"
+	CodeForbidden             = "forbidden"
+	CodeConflict              = "conflict"
+	CodePreconditionRequired  = "precondition_required"
+	CodePreconditionFailed    = "precondition_failed"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+	CodeEmailTaken            = "email_taken"
+	CodeRateLimited           = "rate_limited"
+	CodeWeakPassword          = "weak_password"
+	CodeInvalidCredentials    = "invalid_credentials"
+	CodeInvalidToken          = "invalid_token"
+	CodeAlreadyVerified       = "already_verified"
+	CodeUnavailable           = "unavailable"
+	CodeInternal              = "internal"
+)
+
+// storageError maps an error returned by Storage to the HTTP status, error
+// code and message sent to the client. Only messages of classified storage
+// errors are passed through; anything else is reported as an internal error
+// so driver details never reach clients.
+func storageError(err error) (int, string, string) {
+	message := "internal error"
+	var dbErr *db.Error
+	if errors.As(err, &dbErr) {
+		message = err.Error()
+	}
+
+	switch {
+	case errors.Is(err, db.ErrStale):
+		return http.StatusPreconditionFailed, CodePreconditionFailed, message
+	case errors.Is(err, db.ErrEmailTaken):
+		return http.StatusConflict, CodeEmailTaken, message
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound, message
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict, CodeConflict, message
+	case errors.Is(err, db.ErrInvalidInput):
+		return http.StatusBadRequest, CodeInvalidInput, message
+	case errors.Is(err, db.ErrUnavailable):
+		return http.StatusServiceUnavailable, CodeUnavailable, message
+	default:
+		return http.StatusInternalServerError, CodeInternal, "internal error"
+	}
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"user-service/db"
+)
+
+var (
+	errIfMatchMissing = errors.New("If-Match header is required")
+	errIfMatchInvalid = errors.New("If-Match must be a single strong ETag or *")
+)
+
+// etag returns the strong entity tag of the user's current version.
+func etag(user *db.User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// ifMatchVersion returns the user version the request's If-Match header
+// expects, or db.AnyVersion for "*".
+func ifMatchVersion(c *gin.Context) (int, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		return 0, errIfMatchMissing
+	}
+	if header == "*" {
+		return db.AnyVersion, nil
+	}
+	if len(header) < 3 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, errIfMatchInvalid
+	}
+	version, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || version <= 0 {
+		return 0, errIfMatchInvalid
+	}
+	return version, nil
+}
+
+// ifNoneMatch reports whether the If-None-Match header matches the tag. As
+// RFC 9110 asks, weak tags compare equal to their strong counterpart.
+func ifNoneMatch(c *gin.Context, tag string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writePreconditionProblem writes the problem for a missing or malformed
+// If-Match header.
+func writePreconditionProblem(c *gin.Context, err error) {
+	if errors.Is(err, errIfMatchMissing) {
+		writeProblem(c, http.StatusPreconditionRequired, CodePreconditionRequired, err.Error())
+		return
+	}
+	writeProblem(c, http.StatusBadRequest, CodeInvalidInput, err.Error())
+}
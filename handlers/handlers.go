@@ -1,19 +1,88 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"user-service/auth"
 	"user-service/db"
+	"user-service/logging"
+	"user-service/ratelimit"
 )
 
 type Storage interface {
-	AddUser(name string, email string) (*db.User, error)
-	GetUser(uuid string) (*db.User, error)
-	ChangeUser(uuid string, name string) (*db.User, error)
+	AddUser(ctx context.Context, name string, email string) (*db.User, error)
+	GetUser(ctx context.Context, uuid string, withDeleted bool) (*db.User, error)
+	UpdateUser(ctx context.Context, uuid string, changes db.UserChanges, version int) (*db.User, error)
+	DeleteUser(ctx context.Context, uuid string, hard bool, version int) error
+	RestoreUser(ctx context.Context, uuid string) (*db.User, error)
+	ListUsers(ctx context.Context, filter db.UserFilter) (*db.UserPage, error)
 }
 type Handler struct {
 	Storage Storage
+	// Idempotency stores responses for Idempotency-Key replays. When it is
+	// nil the header is ignored.
+	Idempotency    IdempotencyStore
+	IdempotencyTTL time.Duration
+	// APIKeys authenticates the Authorization: Bearer keys of requests.
+	// When it, Tokens and AccessTokens are nil authentication is off: anyone may read and
+	// write users, and admin operations need AdminToken.
+	APIKeys APIKeyStore
+	// Tokens checks bearer JWTs. When it is nil only API keys are accepted.
+	Tokens TokenVerifier
+	// AdminToken is a bearer key with every scope, e.g. to bootstrap. When
+	// it is empty only API keys are accepted.
+	AdminToken string
+	// ReadyChecks are run by /readyz, each bounded by ReadyTimeout.
+	ReadyChecks  []ReadyCheck
+	ReadyTimeout time.Duration
+	// Credentials keeps password hashes, checked with Passwords. Accounts
+	// are locked for Lockout after MaxFailedLogins failed logins in a row.
+	Credentials     CredentialStore
+	Passwords       *auth.Passwords
+	MaxFailedLogins int
+	Lockout         time.Duration
+	// Sessions keeps the sessions started by logging in, whose access tokens
+	// are issued and checked by AccessTokens. Logins start no session when
+	// either is nil.
+	Sessions     SessionStore
+	AccessTokens *auth.AccessTokens
+	SessionTTL   time.Duration
+	// Mailer sends the emails with tokens signed by EmailTokens, whose
+	// links point to LinkURL. Verification tokens last VerificationTTL.
+	// Email verification is off unless Mailer, EmailTokens and
+	// Verification are set.
+	Mailer          Mailer
+	EmailTokens     *auth.EmailTokens
+	Verification    VerificationStore
+	VerificationTTL time.Duration
+	LinkURL         string
+	// EmailChanges keeps the email changes waiting for confirmation, which
+	// need email verification on too. Confirmation links last
+	// VerificationTTL, the links to undo a change EmailRevertTTL.
+	EmailChanges   EmailChangeStore
+	EmailRevertTTL time.Duration
+	// PasswordResets keeps the tokens that let users who forgot their
+	// password set a new one, for PasswordResetTTL. Resets need Mailer and
+	// Credentials too.
+	PasswordResets   PasswordResetStore
+	PasswordResetTTL time.Duration
+	// RateLimits are the limits per route group, enforced per client told
+	// apart by RateLimitKey. Nothing is limited when RateLimitStore is nil.
+	RateLimitStore RateLimitStore
+	RateLimits     map[string]ratelimit.Limit
+	RateLimitKey   string
+	draining       atomic.Bool
+	mailing        sync.WaitGroup
 }
 
 type CrUserReq struct {
@@ -24,17 +93,50 @@ type ChUserReq struct {
 	Name string `json:"name,required" binding:"required"`
 }
 type UserResp struct {
-	Message string  `json:"message"`
-	Uuid    string  `json:"uuid"`
-	Name    *string `json:"name"`
-	Email   *string `json:"email"`
+	Message   string     `json:"message"`
+	Uuid      string     `json:"uuid"`
+	Name      *string    `json:"name"`
+	Email     *string    `json:"email"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// EmailVerifiedAt is missing while the email isn't verified.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+}
+type ListUsersReq struct {
+	Limit       int       `form:"limit" binding:"omitempty,min=1,max=500"`
+	Cursor      string    `form:"cursor"`
+	Name        string    `form:"name"`
+	EmailDomain string    `form:"email_domain" binding:"omitempty,fqdn"`
+	CreatedFrom time.Time `form:"created_from"`
+	CreatedTo   time.Time `form:"created_to"`
+	UpdatedFrom time.Time `form:"updated_from"`
+	UpdatedTo   time.Time `form:"updated_to"`
+	Verified    *bool     `form:"verified"`
+	Sort        string    `form:"sort" binding:"omitempty,oneof=created_at updated_at name email"`
+	Order       string    `form:"order" binding:"omitempty,oneof=asc desc"`
+	Total       bool      `form:"total"`
+}
+type UserItem struct {
+	Uuid      string     `json:"uuid"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	// EmailVerifiedAt is null while the email isn't verified.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+}
+type UserListResp struct {
+	Message    string     `json:"message"`
+	Users      []UserItem `json:"users"`
+	NextCursor *string    `json:"next_cursor"`
+	Total      *int       `json:"total,omitempty"`
 }
 type Param struct {
-	uuid string `binding:"uuid"`
+	Uuid string `uri:"uuid" binding:"required,uuid"`
 }
 
 func NewHandler(storage *sql.DB) *Handler {
-	return &Handler{Storage: db.NewStorage(storage)}
+	st := db.NewStorage(storage)
+	return &Handler{Storage: st, Idempotency: st}
 }
 
 // GetUser godoc
@@ -43,42 +145,51 @@ func NewHandler(storage *sql.DB) *Handler {
 //	@Description	Get user
 //	@Tags			Users
 //	@Accept			json
-//	@Produce		json
-//	@Param			uuid	path		string		true	"User uuid"
-//	@Success		200		{object}	UserResp	"Get successfully"
-//	@Failure		400		{object}	UserResp
-//	@Failure		404		{object}	UserResp
+//	@Produce		json,application/problem+json
+//	@Param			uuid			path		string		true	"User uuid"
+//	@Param			include_deleted	query		bool		false	"Return the user even if soft-deleted"
+//	@Param			If-None-Match	header		string		false	"ETag of the cached user"
+//	@Success		200				{object}	UserResp	"Get successfully"
+//	@Header			200				{string}	ETag		"User version"
+//	@Success		304				"Not modified"
+//	@Failure		400				{object}	Problem	"Bad request"
+//	@Failure		401				{object}	Problem	"Missing or invalid API key"
+//	@Failure		403				{object}	Problem	"Missing scope"
+//	@Failure		404				{object}	Problem	"Not found"
+//	@Failure		429				{object}	Problem	"Rate limit exceeded"
+//	@Failure		500				{object}	Problem	"Internal error"
+//	@Failure		503				{object}	Problem	"Storage unavailable"
+//	@Security		BearerAuth
 //	@Router			/users/{uuid} [get]
 func (h *Handler) GetUser() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		userUuid := c.Param("uuid")
-		if err := c.ShouldBindUri(&Param{
-			uuid: userUuid,
-		}); err != nil {
-			r := UserResp{
-				Message: err.Error(),
-			}
-			c.JSON(http.StatusBadRequest, r)
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
 		}
-		user, err := h.Storage.GetUser(userUuid)
+		withDeleted := c.Query("include_deleted") == "true"
+		user, err := h.Storage.GetUser(c.Request.Context(), userUuid, withDeleted)
 
 		if err == nil {
+			tag := etag(user)
+			c.Header("ETag", tag)
+			if ifNoneMatch(c, tag) {
+				c.Status(http.StatusNotModified)
+				return
+			}
 			r := &UserResp{
-				Message: "user exists",
-				Uuid:    user.Uuid,
-				Name:    &user.Name,
-				Email:   &user.Email,
+				Message:         "user exists",
+				Uuid:            user.Uuid,
+				Name:            &user.Name,
+				Email:           &user.Email,
+				DeletedAt:       user.DeletedAt,
+				EmailVerifiedAt: user.EmailVerifiedAt,
 			}
 			c.JSON(http.StatusOK, r)
 			return
 		} else {
-			r := &UserResp{
-				Message: err.Error(),
-				Uuid:    userUuid,
-				Name:    nil,
-				Email:   nil,
-			}
-			c.JSON(http.StatusNotFound, r)
+			writeStorageProblem(c, err)
 			return
 		}
 	}
@@ -90,11 +201,19 @@ func (h *Handler) GetUser() func(c *gin.Context) {
 //	@Description	Create user
 //	@Tags			Users
 //	@Accept			json
-//	@Produce		json
-//	@Param			data	body		CrUserReq	true	"User data"
-//	@Success		201		{object}	UserResp	"Create successfully"
-//	@Failure		400		{object}	UserResp	"Bad request"
-//	@Failure		422		{object}	UserResp	"Unprocessable"
+//	@Produce		json,application/problem+json
+//	@Param			Idempotency-Key	header		string		false	"Makes retries return the original response instead of creating another user"
+//	@Param			data			body		CrUserReq	true	"User data"
+//	@Success		201				{object}	UserResp	"Create successfully"
+//	@Failure		400				{object}	Problem		"Bad request"
+//	@Failure		401				{object}	Problem		"Missing or invalid API key"
+//	@Failure		403				{object}	Problem		"Missing scope"
+//	@Failure		409				{object}	Problem		"Email already taken, or a request with the same Idempotency-Key is still running"
+//	@Failure		422				{object}	Problem		"Idempotency-Key reused with a different body"
+//	@Failure		429				{object}	Problem		"Rate limit exceeded"
+//	@Failure		500				{object}	Problem		"Internal error"
+//	@Failure		503				{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
 //	@Router			/users [post]
 func (h *Handler) CreateUser() func(c *gin.Context) {
 	return func(c *gin.Context) {
@@ -106,17 +225,17 @@ func (h *Handler) CreateUser() func(c *gin.Context) {
 			Email:   nil,
 		}
 		if err := c.ShouldBindJSON(&user); err != nil {
-			r.Message = err.Error()
-			c.JSON(http.StatusBadRequest, r)
+			writeBindProblem(c, err)
 			return
 		}
-		res, err := h.Storage.AddUser(user.Name, user.Email)
+		res, err := h.Storage.AddUser(c.Request.Context(), user.Name, user.Email)
 
 		if err != nil {
-			r.Message = err.Error()
-			c.JSON(http.StatusUnprocessableEntity, r)
+			writeStorageProblem(c, err)
 			return
 		}
+		c.Set(logging.UserUuidKey, res.Uuid)
+		c.Header("ETag", etag(res))
 		r.Message = "user created"
 		r.Uuid = res.Uuid
 		r.Name = &res.Name
@@ -133,24 +252,192 @@ func (h *Handler) CreateUser() func(c *gin.Context) {
 //	@Description	Change user
 //	@Tags			Users
 //	@Accept			json
-//	@Produce		json
-//	@Param			uuid	path		string		true	"User uuid"
-//	@Param			data	body		ChUserReq	true	"User data"
-//	@Success		200		{object}	UserResp	"Change successfully"
-//	@Failure		400		{object}	UserResp	"Bad request"
-//	@Failure		422		{object}	UserResp	"Unprocessable"
+//	@Produce		json,application/problem+json
+//	@Param			uuid		path		string		true	"User uuid"
+//	@Param			If-Match	header		string		true	"ETag of the user being changed, or *"
+//	@Param			data		body		ChUserReq	true	"User data"
+//	@Success		200			{object}	UserResp	"Change successfully"
+//	@Header			200			{string}	ETag		"New user version"
+//	@Failure		400			{object}	Problem		"Bad request"
+//	@Failure		401			{object}	Problem		"Missing or invalid API key"
+//	@Failure		403			{object}	Problem		"Missing scope"
+//	@Failure		404			{object}	Problem		"Not found"
+//	@Failure		412			{object}	Problem		"User was changed since it was read"
+//	@Failure		428			{object}	Problem		"If-Match is missing"
+//	@Failure		429			{object}	Problem		"Rate limit exceeded"
+//	@Failure		500			{object}	Problem		"Internal error"
+//	@Failure		503			{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
 //	@Router			/users/{uuid} [put]
 func (h *Handler) ChangeUser() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var user ChUserReq
 		userUuid := c.Param("uuid")
-		if err := c.ShouldBindUri(&Param{
-			uuid: userUuid,
-		}); err != nil {
-			r := UserResp{
-				Message: err.Error(),
-			}
-			c.JSON(http.StatusBadRequest, r)
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		version, err := ifMatchVersion(c)
+		if err != nil {
+			writePreconditionProblem(c, err)
+			return
+		}
+		if err := c.ShouldBindJSON(&user); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+
+		res, err := h.Storage.UpdateUser(c.Request.Context(), userUuid, db.UserChanges{Name: &user.Name}, version)
+
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.Header("ETag", etag(res))
+		r := &UserResp{
+			Message:         "user data changed",
+			Uuid:            res.Uuid,
+			Name:            &res.Name,
+			Email:           &res.Email,
+			EmailVerifiedAt: res.EmailVerifiedAt,
+		}
+		c.JSON(http.StatusOK, r)
+		return
+	}
+}
+
+// PatchUser godoc
+//
+//	@Summary		Patch user
+//	@Description	Partially update user with a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902). Only changed fields are written
+//	@Tags			Users
+//	@Accept			application/merge-patch+json,application/json-patch+json
+//	@Produce		json,application/problem+json
+//	@Param			uuid		path		string		true	"User uuid"
+//	@Param			If-Match	header		string		true	"ETag of the user being changed, or *"
+//	@Param			data		body		UserDoc		true	"Patch document"
+//	@Success		200			{object}	UserResp	"Change successfully"
+//	@Header			200			{string}	ETag		"New user version"
+//	@Failure		400			{object}	Problem		"Bad request"
+//	@Failure		401			{object}	Problem		"Missing or invalid API key"
+//	@Failure		403			{object}	Problem		"Missing scope, or users changing their own email"
+//	@Failure		404			{object}	Problem		"Not found"
+//	@Failure		409			{object}	Problem		"Conflict"
+//	@Failure		412			{object}	Problem		"User was changed since it was read"
+//	@Failure		415			{object}	Problem		"Unsupported media type"
+//	@Failure		422			{object}	Problem		"Patch could not be applied"
+//	@Failure		428			{object}	Problem		"If-Match is missing"
+//	@Failure		429			{object}	Problem		"Rate limit exceeded"
+//	@Failure		503			{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid} [patch]
+func (h *Handler) PatchUser() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		contentType := c.ContentType()
+		if contentType != MergePatchContentType && contentType != JSONPatchContentType {
+			writeProblem(c, http.StatusUnsupportedMediaType, CodeMediaType,
+				fmt.Sprintf("use %s or %s", MergePatchContentType, JSONPatchContentType))
+			return
+		}
+		patch, err := c.GetRawData()
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, CodeMalformedBody, "request body could not be read")
+			return
+		}
+
+		version, err := ifMatchVersion(c)
+		if err != nil {
+			writePreconditionProblem(c, err)
+			return
+		}
+
+		user, err := h.Storage.GetUser(c.Request.Context(), userUuid, false)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		if version != db.AnyVersion && version != user.Version {
+			writeStorageProblem(c, db.ErrStale)
+			return
+		}
+		doc, err := applyPatch(user, contentType, patch)
+		switch {
+		case errors.Is(err, errPatchMalformed), errors.Is(err, jsonpatch.ErrBadJSONPatch):
+			writeProblem(c, http.StatusBadRequest, CodeMalformedBody, err.Error())
+			return
+		case errors.Is(err, jsonpatch.ErrTestFailed):
+			writeProblem(c, http.StatusConflict, CodePatchTest, err.Error())
+			return
+		case err != nil:
+			writeProblem(c, http.StatusUnprocessableEntity, CodePatchFailed, err.Error())
+			return
+		}
+		if err := binding.Validator.ValidateStruct(doc); err != nil {
+			var validationErrs validator.ValidationErrors
+			errors.As(err, &validationErrs)
+			writeProblem(c, http.StatusUnprocessableEntity, CodeValidation, "patched user is invalid", fieldErrors(validationErrs)...)
+			return
+		}
+
+		changes := diffUser(user, doc)
+		// When emails can be confirmed, users changing their own email must
+		// do so by confirmation.
+		if changes.Email != nil && c.GetString(selfKey) == userUuid && h.emailChangeEnabled() {
+			writeProblem(c, http.StatusForbidden, CodeForbidden, "change your email with POST /users/"+userUuid+"/email")
+			return
+		}
+
+		// The patch was computed against this exact version, so only write
+		// it if nobody changed the user in the meantime.
+		res, err := h.Storage.UpdateUser(c.Request.Context(), userUuid, changes, user.Version)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.Header("ETag", etag(res))
+		r := &UserResp{
+			Message:         "user data changed",
+			Uuid:            res.Uuid,
+			Name:            &res.Name,
+			Email:           &res.Email,
+			EmailVerifiedAt: res.EmailVerifiedAt,
+		}
+		c.JSON(http.StatusOK, r)
+		return
+	}
+}
+
+// DeleteUser godoc
+//
+//	@Summary		Delete user
+//	@Description	Soft-delete user. With hard=true the user is purged for good, which requires the users:admin scope
+//	@Tags			Users
+//	@Produce		json,application/problem+json
+//	@Param			uuid		path		string		true	"User uuid"
+//	@Param			hard		query		bool		false	"Purge the user instead of soft-deleting"
+//	@Param			If-Match	header		string		true	"ETag of the user being deleted, or *"
+//	@Success		200			{object}	UserResp	"Delete successfully"
+//	@Failure		400			{object}	Problem		"Bad request"
+//	@Failure		401			{object}	Problem		"Missing or invalid API key"
+//	@Failure		403			{object}	Problem		"Forbidden"
+//	@Failure		404			{object}	Problem		"Not found"
+//	@Failure		412			{object}	Problem		"User was changed since it was read"
+//	@Failure		428			{object}	Problem		"If-Match is missing"
+//	@Failure		429			{object}	Problem		"Rate limit exceeded"
+//	@Failure		503			{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid} [delete]
+func (h *Handler) DeleteUser() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
 		}
 		r := &UserResp{
 			Message: "",
@@ -158,26 +445,144 @@ func (h *Handler) ChangeUser() func(c *gin.Context) {
 			Name:    nil,
 			Email:   nil,
 		}
-		if err := c.ShouldBindJSON(&user); err != nil {
-			r.Message = "name field is required"
-			c.JSON(http.StatusBadRequest, r)
+		hard := c.Query("hard") == "true"
+		if hard && !hasScope(c, auth.ScopeAdmin) {
+			writeProblem(c, http.StatusForbidden, CodeForbidden, "hard delete requires the "+auth.ScopeAdmin+" scope")
+			return
+		}
+		version, err := ifMatchVersion(c)
+		if err != nil {
+			writePreconditionProblem(c, err)
 			return
 		}
 
-		res, err := h.Storage.ChangeUser(userUuid, user.Name)
+		if err := h.Storage.DeleteUser(c.Request.Context(), userUuid, hard, version); err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		r.Message = "user deleted"
+		if hard {
+			r.Message = "user purged"
+		}
+		c.JSON(http.StatusOK, r)
+		return
+	}
+}
+
+// RestoreUser godoc
+//
+//	@Summary		Restore user
+//	@Description	Restore soft-deleted user
+//	@Tags			Users
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string		true	"User uuid"
+//	@Success		200		{object}	UserResp	"Restore successfully"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Missing or invalid API key"
+//	@Failure		403		{object}	Problem		"Missing scope"
+//	@Failure		404		{object}	Problem		"Not found"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/restore [post]
+func (h *Handler) RestoreUser() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+
+		res, err := h.Storage.RestoreUser(c.Request.Context(), userUuid)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.Header("ETag", etag(res))
+		r := &UserResp{
+			Message:         "user restored",
+			Uuid:            res.Uuid,
+			Name:            &res.Name,
+			Email:           &res.Email,
+			EmailVerifiedAt: res.EmailVerifiedAt,
+		}
+		c.JSON(http.StatusOK, r)
+		return
+	}
+}
+
+// ListUsers godoc
+//
+//	@Summary		List users
+//	@Description	List users page by page. Pass next_cursor back as cursor to get the following page
+//	@Tags			Users
+//	@Produce		json,application/problem+json
+//	@Param			limit			query		int				false	"Page size, 50 by default"	minimum(1)	maximum(500)
+//	@Param			cursor			query		string			false	"Cursor from the previous page"
+//	@Param			name			query		string			false	"Name prefix"
+//	@Param			email_domain	query		string			false	"Email domain"
+//	@Param			created_from	query		string			false	"Created at or after, RFC 3339"
+//	@Param			created_to		query		string			false	"Created before, RFC 3339"
+//	@Param			updated_from	query		string			false	"Updated at or after, RFC 3339"
+//	@Param			updated_to		query		string			false	"Updated before, RFC 3339"
+//	@Param			verified		query		bool			false	"Only users whose email is verified, or not"
+//	@Param			sort			query		string			false	"Sort column"	Enums(created_at, updated_at, name, email)
+//	@Param			order			query		string			false	"Sort order"	Enums(asc, desc)
+//	@Param			total			query		bool			false	"Count all matching users"
+//	@Success		200				{object}	UserListResp	"List successfully"
+//	@Failure		400				{object}	Problem			"Bad request"
+//	@Failure		401				{object}	Problem			"Missing or invalid API key"
+//	@Failure		403				{object}	Problem			"Missing scope"
+//	@Failure		429				{object}	Problem			"Rate limit exceeded"
+//	@Failure		500				{object}	Problem			"Internal error"
+//	@Failure		503				{object}	Problem			"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users [get]
+func (h *Handler) ListUsers() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req ListUsersReq
+		r := &UserListResp{
+			Message: "",
+			Users:   []UserItem{},
+		}
+		if err := c.ShouldBindQuery(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
 
+		page, err := h.Storage.ListUsers(c.Request.Context(), db.UserFilter{
+			NamePrefix:  req.Name,
+			EmailDomain: req.EmailDomain,
+			CreatedFrom: req.CreatedFrom,
+			CreatedTo:   req.CreatedTo,
+			UpdatedFrom: req.UpdatedFrom,
+			UpdatedTo:   req.UpdatedTo,
+			Verified:    req.Verified,
+			Sort:        req.Sort,
+			Desc:        req.Order == "desc",
+			Cursor:      req.Cursor,
+			Limit:       req.Limit,
+			WithTotal:   req.Total,
+		})
 		if err != nil {
-			r.Message = err.Error()
-			r.Name = &user.Name
-			c.JSON(http.StatusUnprocessableEntity, r)
+			writeStorageProblem(c, err)
 			return
 		}
-		r = &UserResp{
-			Message: "user data changed",
-			Uuid:    res.Uuid,
-			Name:    &res.Name,
-			Email:   &res.Email,
+		for _, u := range page.Users {
+			r.Users = append(r.Users, UserItem{
+				Uuid:            u.Uuid,
+				Name:            u.Name,
+				Email:           u.Email,
+				CreatedAt:       u.CreatedAt,
+				UpdatedAt:       u.UpdatedAt,
+				EmailVerifiedAt: u.EmailVerifiedAt,
+			})
+		}
+		if page.NextCursor != "" {
+			r.NextCursor = &page.NextCursor
 		}
+		r.Total = page.Total
+		r.Message = "users found"
 		c.JSON(http.StatusOK, r)
 		return
 	}
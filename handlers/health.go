@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultReadyTimeout bounds the readiness checks when Handler.ReadyTimeout
+// is zero.
+const DefaultReadyTimeout = 2 * time.Second
+
+// ReadyCheck is a dependency the service needs to serve requests, such as the
+// database.
+type ReadyCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type HealthResp struct {
+	Status string                 `json:"status" example:"ok"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type CheckResult struct {
+	Status     string `json:"status" example:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Drain makes readiness fail from now on, so load balancers stop sending
+// requests before the server shuts down.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Healthz godoc
+//
+//	@Summary		Liveness probe
+//	@Description	Reports that the process is up. It doesn't check any dependency.
+//	@Tags			Health
+//	@Produce		json
+//	@Success		200	{object}	HealthResp	"Alive"
+//	@Router			/healthz [get]
+func (h *Handler) Healthz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, &HealthResp{Status: "ok"})
+	}
+}
+
+// Readyz godoc
+//
+//	@Summary		Readiness probe
+//	@Description	Runs every readiness check, such as database connectivity and the migration version, and reports each of them. Fails while the service is draining.
+//	@Tags			Health
+//	@Produce		json
+//	@Success		200	{object}	HealthResp	"Ready"
+//	@Failure		503	{object}	HealthResp	"Not ready"
+//	@Router			/readyz [get]
+func (h *Handler) Readyz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		timeout := h.ReadyTimeout
+		if timeout <= 0 {
+			timeout = DefaultReadyTimeout
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		r := &HealthResp{Status: "ok", Checks: make(map[string]CheckResult, len(h.ReadyChecks)+1)}
+		draining := CheckResult{Status: "ok"}
+		if h.draining.Load() {
+			draining = CheckResult{Status: "fail", Error: "shutting down"}
+		}
+		r.Checks["draining"] = draining
+
+		var (
+			mu sync.Mutex
+			wg sync.WaitGroup
+		)
+		for _, check := range h.ReadyChecks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				res := CheckResult{Status: "ok"}
+				if err := check.Check(ctx); err != nil {
+					res.Status, res.Error = "fail", err.Error()
+				}
+				res.DurationMs = time.Since(start).Milliseconds()
+				mu.Lock()
+				r.Checks[check.Name] = res
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		for _, res := range r.Checks {
+			if res.Status != "ok" {
+				r.Status, status = "unavailable", http.StatusServiceUnavailable
+			}
+		}
+		c.JSON(status, r)
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"user-service/db"
+	"user-service/logging"
+)
+
+const (
+	DefaultIdempotencyTTL = 24 * time.Hour
+	// idempotencyWait bounds how long a duplicate request waits for the
+	// original one to finish before giving up with 409.
+	idempotencyWait         = 10 * time.Second
+	idempotencyPollInterval = 50 * time.Millisecond
+	// idempotencyLease is how long a claim holds without being completed or
+	// released. Past it, a request that crashed the process is assumed gone
+	// and a retry may take its key over.
+	idempotencyLease     = time.Minute
+	maxIdempotencyKeyLen = 255
+)
+
+type IdempotencyStore interface {
+	ClaimIdempotencyKey(ctx context.Context, client string, key string, requestHash string, ttl time.Duration, lease time.Duration) (*db.IdempotencyRecord, error)
+	CompleteIdempotencyKey(ctx context.Context, client string, key string, status int, header http.Header, body []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, client string, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context) error
+}
+
+// replayedHeaders are the response headers stored along with the body.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// Idempotent makes the route honor the Idempotency-Key header. The first
+// request with a key is processed and its response stored; repeating the key
+// with the same body replays that response, with a different body it is
+// rejected. Duplicates arriving while the first request is still running
+// wait for it to finish. Keys are scoped to the authenticated client, so
+// clients picking the same key don't get each other's responses.
+func (h *Handler) Idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || h.Idempotency == nil {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeProblem(c, http.StatusBadRequest, CodeInvalidInput, "Idempotency-Key is too long")
+			c.Abort()
+			return
+		}
+		body, err := c.GetRawData()
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, CodeMalformedBody, "request body could not be read")
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		hash := requestHash(c.Request.Method, c.FullPath(), body)
+
+		client := c.GetString(logging.SubjectKey)
+		if !h.claimIdempotencyKey(c, client, key, hash) {
+			c.Abort()
+			return
+		}
+
+		// Record the outcome even if the client has gone away meanwhile, or
+		// its retries would wait for a key nobody completes. Unless a
+		// response was stored, the key is released, also when the handler
+		// panics.
+		ctx := context.WithoutCancel(c.Request.Context())
+		stored := false
+		defer func() {
+			if !stored {
+				h.releaseIdempotencyKey(ctx, client, key)
+			}
+		}()
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		if w.Status() >= http.StatusInternalServerError {
+			return
+		}
+		header := http.Header{}
+		for _, name := range replayedHeaders {
+			if v := w.Header().Get(name); v != "" {
+				header.Set(name, v)
+			}
+		}
+		if err := h.Idempotency.CompleteIdempotencyKey(ctx, client, key, w.Status(), header, w.body.Bytes()); err != nil {
+			// The response is already out; a retry runs the request again.
+			slog.WarnContext(ctx, "storing idempotent response", "idempotency_key", key, "error", err)
+			return
+		}
+		stored = true
+	}
+}
+
+func (h *Handler) releaseIdempotencyKey(ctx context.Context, client string, key string) {
+	if err := h.Idempotency.ReleaseIdempotencyKey(ctx, client, key); err != nil {
+		slog.WarnContext(ctx, "releasing idempotency key", "idempotency_key", key, "error", err)
+	}
+}
+
+// claimIdempotencyKey reports whether the request owns the key and should be
+// processed. Otherwise the response has been written already.
+func (h *Handler) claimIdempotencyKey(c *gin.Context, client string, key string, hash string) bool {
+	ttl := h.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	ctx := c.Request.Context()
+	// Claims ignore expired keys, so they are dropped once per request rather
+	// than on every poll below, and a failure is only logged.
+	if err := h.Idempotency.DeleteExpiredIdempotencyKeys(ctx); err != nil {
+		slog.WarnContext(ctx, "dropping expired idempotency keys", "error", err)
+	}
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		rec, err := h.Idempotency.ClaimIdempotencyKey(ctx, client, key, hash, ttl, idempotencyLease)
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			// Released between our insert and read, try again.
+		case err != nil:
+			writeStorageProblem(c, err)
+			return false
+		case rec == nil:
+			return true
+		case rec.RequestHash != hash:
+			writeProblem(c, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+				"Idempotency-Key was already used for a different request")
+			return false
+		case rec.Status != 0:
+			for name, values := range rec.Header {
+				c.Writer.Header()[name] = values
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Status(rec.Status)
+			_, _ = c.Writer.Write(rec.Body)
+			return false
+		}
+
+		if time.Now().After(deadline) {
+			writeProblem(c, http.StatusConflict, CodeIdempotencyInProgress,
+				"a request with this Idempotency-Key is still being processed")
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+func requestHash(method string, route string, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(method + " " + route + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
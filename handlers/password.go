@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/logging"
+)
+
+const (
+	DefaultMaxFailedLogins = 5
+	DefaultLockout         = 15 * time.Minute
+)
+
+type CredentialStore interface {
+	SetPassword(ctx context.Context, userUuid string, hash string) error
+	ChangePassword(ctx context.Context, userUuid string, hash string, keepSessionId string) error
+	GetCredentials(ctx context.Context, userUuid string) (*db.Credentials, error)
+	GetCredentialsByEmail(ctx context.Context, email string) (*db.Credentials, error)
+	RecordLogin(ctx context.Context, userUuid string, rehash string) error
+	RecordFailedLogin(ctx context.Context, userUuid string, maxAttempts int, lockout time.Duration) error
+}
+
+type SetPasswordReq struct {
+	// CurrentPassword is required when users change their own password.
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password" binding:"required"`
+}
+type LoginReq struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+	// Device names the device logging in, to tell sessions apart.
+	Device string `json:"device" binding:"max=100"`
+}
+type LoginResp struct {
+	Message string `json:"message"`
+	Uuid    string `json:"uuid"`
+	// TokenResp holds the tokens of the session the login started, when
+	// sessions are on.
+	TokenResp
+}
+type MessageResp struct {
+	Message string `json:"message"`
+}
+
+// SetPassword godoc
+//
+//	@Summary		Set password
+//	@Description	Set or change the password of a user. Users changing their own password must send the current one. Every other session of the user is revoked.
+//	@Tags			Users
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string			true	"User uuid"
+//	@Param			data	body		SetPasswordReq	true	"Password"
+//	@Success		200		{object}	MessageResp		"Password set"
+//	@Failure		400		{object}	Problem			"Bad request"
+//	@Failure		401		{object}	Problem			"Missing or invalid API key"
+//	@Failure		403		{object}	Problem			"Missing scope or wrong current password"
+//	@Failure		404		{object}	Problem			"Not found"
+//	@Failure		422		{object}	Problem			"Password too weak"
+//	@Failure		429		{object}	Problem			"Rate limit exceeded"
+//	@Failure		503		{object}	Problem			"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/password [post]
+func (h *Handler) SetPassword() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req SetPasswordReq
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if h.Credentials == nil {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "passwords are not enabled")
+			return
+		}
+		if err := h.passwords().Check(req.Password); err != nil {
+			writeProblem(c, http.StatusUnprocessableEntity, CodeWeakPassword, err.Error())
+			return
+		}
+		ctx := c.Request.Context()
+		// Users changing their own password stay logged in where they are.
+		var keepSession string
+		if c.GetString(selfKey) == userUuid {
+			keepSession = c.GetString(sessionKey)
+			creds, err := h.Credentials.GetCredentials(ctx, userUuid)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				writeStorageProblem(c, err)
+				return
+			}
+			if creds != nil && !h.checkPassword(ctx, creds, req.CurrentPassword) {
+				writeProblem(c, http.StatusForbidden, CodeInvalidCredentials, "current password is wrong")
+				return
+			}
+		}
+
+		hash, err := h.passwords().Hash(req.Password)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		if err := h.Credentials.ChangePassword(ctx, userUuid, hash, keepSession); err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, &MessageResp{Message: "password set"})
+	}
+}
+
+// Login godoc
+//
+//	@Summary		Log in
+//	@Description	Check the email and password of a user and start a session. Accounts are locked for a while after repeated failures; the response doesn't tell.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		LoginReq	true	"Credentials"
+//	@Success		200		{object}	LoginResp	"Logged in"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Wrong email or password, or account locked"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Router			/auth/login [post]
+func (h *Handler) Login() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req LoginReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if h.Credentials == nil {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "passwords are not enabled")
+			return
+		}
+		ctx := c.Request.Context()
+		creds, err := h.Credentials.GetCredentialsByEmail(ctx, req.Email)
+		if errors.Is(err, db.ErrNotFound) {
+			// Take as long as for a known user, so timing doesn't tell
+			// which emails have an account.
+			h.passwords().VerifyDummy(req.Password)
+			writeProblem(c, http.StatusUnauthorized, CodeInvalidCredentials, "wrong email or password")
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.Set(logging.UserUuidKey, creds.UserUuid)
+		if !h.checkPassword(ctx, creds, req.Password) {
+			writeProblem(c, http.StatusUnauthorized, CodeInvalidCredentials, "wrong email or password")
+			return
+		}
+		r := &LoginResp{Message: "logged in", Uuid: creds.UserUuid}
+		if h.Sessions != nil && h.AccessTokens != nil {
+			tokens, err := h.startSession(c, creds.UserUuid, req.Device)
+			if err != nil {
+				writeStorageProblem(c, err)
+				return
+			}
+			r.TokenResp = *tokens
+		}
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+// checkPassword reports whether password is the user's and the user isn't
+// locked out, and records the attempt. The hash is upgraded when it was made
+// with other parameters than the current ones.
+func (h *Handler) checkPassword(ctx context.Context, creds *db.Credentials, password string) bool {
+	// Verify even when locked out, so the answer takes as long.
+	ok, rehash := h.passwords().Verify(password, creds.PasswordHash)
+	if creds.LockedUntil != nil && time.Now().Before(*creds.LockedUntil) {
+		slog.InfoContext(ctx, "login while locked out", "user_uuid", creds.UserUuid)
+		return false
+	}
+	if !ok {
+		maxAttempts, lockout := h.MaxFailedLogins, h.Lockout
+		if maxAttempts <= 0 {
+			maxAttempts = DefaultMaxFailedLogins
+		}
+		if lockout <= 0 {
+			lockout = DefaultLockout
+		}
+		if err := h.Credentials.RecordFailedLogin(ctx, creds.UserUuid, maxAttempts, lockout); err != nil {
+			slog.WarnContext(ctx, "recording failed login", "user_uuid", creds.UserUuid, "error", err)
+		}
+		return false
+	}
+
+	var newHash string
+	if rehash {
+		var err error
+		if newHash, err = h.passwords().Hash(password); err != nil {
+			slog.WarnContext(ctx, "rehashing password", "user_uuid", creds.UserUuid, "error", err)
+		}
+	}
+	if newHash != "" || creds.FailedAttempts > 0 || creds.LockedUntil != nil {
+		if err := h.Credentials.RecordLogin(ctx, creds.UserUuid, newHash); err != nil {
+			slog.WarnContext(ctx, "recording login", "user_uuid", creds.UserUuid, "error", err)
+		}
+	}
+	return true
+}
+
+var defaultPasswords = &auth.Passwords{Params: auth.DefaultArgon2Params, MinLength: 8}
+
+func (h *Handler) passwords() *auth.Passwords {
+	if h.Passwords == nil {
+		return defaultPasswords
+	}
+	return h.Passwords
+}
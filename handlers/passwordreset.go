@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/logging"
+	"user-service/mail"
+)
+
+const DefaultPasswordResetTTL = 30 * time.Minute
+
+type PasswordResetStore interface {
+	AddPasswordReset(ctx context.Context, userUuid string, tokenHash string, expiresAt time.Time) error
+	ResetPassword(ctx context.Context, tokenHash string, passwordHash string) (string, error)
+}
+
+type PasswordResetReq struct {
+	Email string `json:"email" binding:"required,email"`
+}
+type ConfirmPasswordResetReq struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// RequestPasswordReset godoc
+//
+//	@Summary		Request a password reset
+//	@Description	Email a link to reset their password to the user with the email, if there is one with a password. The response is the same either way. Only the latest link works.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		PasswordResetReq	true	"Email"
+//	@Success		202		{object}	MessageResp			"Request accepted"
+//	@Failure		400		{object}	Problem				"Bad request"
+//	@Failure		404		{object}	Problem				"Password resets are not enabled"
+//	@Failure		429		{object}	Problem				"Rate limit exceeded"
+//	@Router			/auth/password-reset [post]
+func (h *Handler) RequestPasswordReset() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req PasswordResetReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.passwordResetEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "password resets are not enabled")
+			return
+		}
+		// Even the lookup happens in the background, as a known email
+		// takes longer to handle than an unknown one.
+		h.mailLater(c.Request.Context(), func(ctx context.Context) error {
+			return h.sendPasswordReset(ctx, req.Email)
+		})
+		c.JSON(http.StatusAccepted, &MessageResp{Message: "if the email has an account, a reset link was sent to it"})
+	}
+}
+
+// sendPasswordReset stores a new reset token for the user with email, if
+// they have a password, and emails it to them.
+func (h *Handler) sendPasswordReset(ctx context.Context, email string) error {
+	creds, err := h.Credentials.GetCredentialsByEmail(ctx, email)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	user, err := h.Storage.GetUser(ctx, creds.UserUuid, false)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl := h.PasswordResetTTL
+	if ttl <= 0 {
+		ttl = DefaultPasswordResetTTL
+	}
+	token, hash, err := auth.NewResetToken()
+	if err != nil {
+		return err
+	}
+	if err := h.PasswordResets.AddPasswordReset(ctx, user.Uuid, hash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+	// Sent to the stored email, which the one asked for only matches once
+	// normalized.
+	return h.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset your password. To choose a new one within %s, follow:\n\n%s\n\nIf it wasn't you, ignore this email; your password stays as it is.\n",
+			user.Name, ttl, h.link("/password-reset", token)),
+	})
+}
+
+// ConfirmPasswordReset godoc
+//
+//	@Summary		Reset a password
+//	@Description	Consume a password reset token and set the new password of its user, whose sessions are all revoked. Each token works once.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		ConfirmPasswordResetReq	true	"Token and new password"
+//	@Success		200		{object}	MessageResp				"Password reset"
+//	@Failure		400		{object}	Problem					"Invalid, expired or used token"
+//	@Failure		404		{object}	Problem					"Password resets are not enabled"
+//	@Failure		422		{object}	Problem					"Password too weak"
+//	@Failure		429		{object}	Problem					"Rate limit exceeded"
+//	@Failure		503		{object}	Problem					"Storage unavailable"
+//	@Router			/auth/password-reset/confirm [post]
+func (h *Handler) ConfirmPasswordReset() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req ConfirmPasswordResetReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.passwordResetEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "password resets are not enabled")
+			return
+		}
+		// Checked first, so a weak password doesn't use the token up.
+		if err := h.passwords().Check(req.Password); err != nil {
+			writeProblem(c, http.StatusUnprocessableEntity, CodeWeakPassword, err.Error())
+			return
+		}
+		hash, err := h.passwords().Hash(req.Password)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		// The token is only used up along with the password being set and
+		// the sessions revoked.
+		userUuid, err := h.PasswordResets.ResetPassword(c.Request.Context(), auth.HashResetToken(req.Token), hash)
+		if errors.Is(err, db.ErrNotFound) {
+			writeProblem(c, http.StatusBadRequest, CodeInvalidToken, err.Error())
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.Set(logging.UserUuidKey, userUuid)
+		c.JSON(http.StatusOK, &MessageResp{Message: "password reset"})
+	}
+}
+
+func (h *Handler) passwordResetEnabled() bool {
+	return h.Mailer != nil && h.Credentials != nil && h.PasswordResets != nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"user-service/db"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	errPatchMalformed = errors.New("malformed patch document")
+	errPatchReadOnly  = errors.New("uuid is read-only")
+)
+
+// UserDoc is the representation of a user that PATCH documents are applied
+// to. Every field but uuid can be changed.
+type UserDoc struct {
+	Uuid  string `json:"uuid"`
+	Name  string `json:"name" binding:"required"`
+	Email string `json:"email" binding:"required,email"`
+}
+
+// applyPatch applies a merge patch or JSON patch, depending on contentType,
+// to the user and returns the patched document. It does not validate it.
+func applyPatch(user *db.User, contentType string, patch []byte) (*UserDoc, error) {
+	doc, err := json.Marshal(UserDoc{Uuid: user.Uuid, Name: user.Name, Email: user.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	switch contentType {
+	case MergePatchContentType:
+		if !json.Valid(patch) || bytes.TrimSpace(patch)[0] != '{' {
+			return nil, errPatchMalformed
+		}
+		doc, err = jsonpatch.MergePatch(doc, patch)
+	case JSONPatchContentType:
+		var ops jsonpatch.Patch
+		ops, err = jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errPatchMalformed, err)
+		}
+		doc, err = ops.Apply(doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var patched UserDoc
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return nil, err
+	}
+	if patched.Uuid != user.Uuid {
+		return nil, errPatchReadOnly
+	}
+
+	return &patched, nil
+}
+
+// diffUser returns the changes needed to turn the user into the document.
+func diffUser(user *db.User, doc *UserDoc) db.UserChanges {
+	var changes db.UserChanges
+	if doc.Name != user.Name {
+		changes.Name = &doc.Name
+	}
+	if doc.Email != user.Email {
+		changes.Email = &doc.Email
+	}
+	return changes
+}
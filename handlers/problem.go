@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"user-service/db"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 error response. Code is an extension member with
+// the machine-readable error code, Errors lists the fields that failed
+// validation and TraceId the trace of the request, to find it in the logs.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	TraceId  string       `json:"trace_id,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+func init() {
+	// Report fields by the names clients send rather than Go field names.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			for _, tag := range []string{"json", "form", "uri"} {
+				name := strings.SplitN(f.Tag.Get(tag), ",", 2)[0]
+				if name == "-" {
+					return ""
+				}
+				if name != "" {
+					return name
+				}
+			}
+			return f.Name
+		})
+	}
+}
+
+func problemType(code string) string {
+	if code == "" {
+		return "about:blank"
+	}
+	return "urn:users-service:problem:" + code
+}
+
+func writeProblem(c *gin.Context, status int, code string, detail string, fields ...FieldError) {
+	p := &Problem{
+		Type:     problemType(code),
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: c.Request.URL.Path,
+		Code:     code,
+		Errors:   fields,
+	}
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.HasTraceID() {
+		p.TraceId = sc.TraceID().String()
+	}
+	c.Header("Content-Type", ProblemContentType)
+	c.JSON(status, p)
+}
+
+// writeStorageProblem writes the problem for an error returned by Storage.
+// Failures of the storage itself are logged with the driver error, which
+// the response never shows.
+func writeStorageProblem(c *gin.Context, err error) {
+	status, code, message := storageError(err)
+	if status >= http.StatusInternalServerError {
+		attrs := []any{"code", code, "error", err.Error()}
+		var e *db.Error
+		if errors.As(err, &e) && e.Err != nil {
+			attrs = append(attrs, "cause", e.Err.Error())
+		}
+		slog.ErrorContext(c.Request.Context(), "storage error", attrs...)
+	}
+	writeProblem(c, status, code, message)
+}
+
+// writeBindProblem writes the problem for a request that failed to bind,
+// listing every invalid field.
+func writeBindProblem(c *gin.Context, err error) {
+	var (
+		validationErrs validator.ValidationErrors
+		typeErr        *json.UnmarshalTypeError
+		syntaxErr      *json.SyntaxError
+	)
+	switch {
+	case errors.As(err, &validationErrs):
+		writeProblem(c, http.StatusBadRequest, CodeValidation, "request validation failed", fieldErrors(validationErrs)...)
+	case errors.As(err, &typeErr):
+		writeProblem(c, http.StatusBadRequest, CodeValidation, "request validation failed", FieldError{
+			Field:   typeErr.Field,
+			Tag:     "type",
+			Message: fmt.Sprintf("%s: must be a %s", typeErr.Field, typeErr.Type),
+		})
+	case errors.As(err, &syntaxErr):
+		writeProblem(c, http.StatusBadRequest, CodeMalformedBody, "request body is not valid JSON")
+	default:
+		writeProblem(c, http.StatusBadRequest, CodeMalformedBody, "request could not be parsed")
+	}
+}
+
+func fieldErrors(errs validator.ValidationErrors) []FieldError {
+	fields := make([]FieldError, 0, len(errs))
+	for _, fe := range errs {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Tag:     fe.Tag(),
+			Message: fmt.Sprintf("%s: %s", fe.Field(), validationMessage(fe)),
+		})
+	}
+	return fields
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email"
+	case "uuid":
+		return "must be a valid uuid"
+	case "fqdn":
+		return "must be a valid domain name"
+	case "min":
+		return "must be at least " + fe.Param()
+	case "max":
+		return "must be at most " + fe.Param()
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	default:
+		return fmt.Sprintf("failed the %q rule", fe.Tag())
+	}
+}
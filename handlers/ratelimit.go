@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"user-service/logging"
+	"user-service/ratelimit"
+)
+
+// Rate limit route groups, each with its own budget.
+const (
+	RateLimitRead   = "read"
+	RateLimitWrite  = "write"
+	RateLimitCreate = "create"
+	RateLimitLogin  = "login"
+)
+
+// Clients are told apart by their IP address, by the API key they present or
+// by the subject they authenticated as.
+const (
+	RateLimitByIP      = "ip"
+	RateLimitByAPIKey  = "api_key"
+	RateLimitBySubject = "subject"
+)
+
+// RateLimitStore keeps the token buckets. ratelimit.MemoryStore keeps them in
+// process; a store shared by every instance enforces the limits globally.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error)
+}
+
+// RateLimit limits the requests each client makes to the routes of group to
+// the group's limit in RateLimits. Routes of a group without a limit, or
+// every route when RateLimitStore is nil, are not limited.
+func (h *Handler) RateLimit(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !h.takeRateLimit(c, group, h.rateLimitClient(c)) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// takeRateLimit reports whether client may make another request of group,
+// and sets the RateLimit headers. Otherwise the response has been written
+// already.
+func (h *Handler) takeRateLimit(c *gin.Context, group string, client string) bool {
+	limit, ok := h.RateLimits[group]
+	if h.RateLimitStore == nil || !ok || limit.Burst == 0 {
+		return true
+	}
+	res, err := h.RateLimitStore.Take(c.Request.Context(), group+":"+client, limit)
+	if err != nil {
+		// Better to serve a few requests too many than none at all.
+		slog.WarnContext(c.Request.Context(), "rate limit store", "error", err)
+		return true
+	}
+	c.Header("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", ceilSeconds(res.Reset))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limit.Burst, ceilSeconds(limit.Window())))
+	if !res.Allowed {
+		c.Header("Retry-After", ceilSeconds(res.RetryAfter))
+		writeProblem(c, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded, retry later")
+		return false
+	}
+	return true
+}
+
+// rateLimitClient identifies the client by RateLimitKey, falling back to its
+// IP address for anonymous requests. Only credentials Authenticate checked
+// count: anyone can make up a new bearer value for each request.
+func (h *Handler) rateLimitClient(c *gin.Context) string {
+	switch h.RateLimitKey {
+	case RateLimitByAPIKey:
+		if id := c.GetString(apiKeyIdKey); id != "" {
+			return "key:" + id
+		}
+	case RateLimitBySubject:
+		if sub := c.GetString(logging.SubjectKey); sub != "" {
+			return "sub:" + sub
+		}
+	}
+	// ClientIP only believes X-Forwarded-For from the router's trusted proxies.
+	return "ip:" + c.ClientIP()
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(c *gin.Context) string {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
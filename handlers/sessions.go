@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+)
+
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// sessionKey is the gin context key of the session an access token was
+// issued in.
+const sessionKey = "session"
+
+type SessionStore interface {
+	AddSession(ctx context.Context, s db.Session, refreshHash string) (*db.Session, error)
+	RotateRefreshToken(ctx context.Context, hash string, newHash string) (*db.Session, error)
+	ListSessions(ctx context.Context, userUuid string) ([]db.Session, error)
+	SessionActive(ctx context.Context, userUuid string, id string) (bool, error)
+	RevokeSession(ctx context.Context, userUuid string, id string) error
+	RevokeSessions(ctx context.Context, userUuid string) (int, error)
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+type TokenResp struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	SessionId    string `json:"session_id,omitempty"`
+}
+type SessionResp struct {
+	Id         string    `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"user_agent"`
+	Ip         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current is set on the session of the access token of the request.
+	Current bool `json:"current"`
+}
+type SessionsResp struct {
+	Sessions []SessionResp `json:"sessions"`
+}
+type SessionParam struct {
+	Uuid string `uri:"uuid" binding:"required,uuid"`
+	Id   string `uri:"id" binding:"required,uuid"`
+}
+
+// Refresh godoc
+//
+//	@Summary		Refresh tokens
+//	@Description	Trade a refresh token for a new access token and a new refresh token. Each refresh token works once: presenting one again revokes its session.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		RefreshReq	true	"Refresh token"
+//	@Success		200		{object}	TokenResp	"New tokens"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Invalid, expired, revoked or reused refresh token"
+//	@Failure		404		{object}	Problem		"Sessions are not enabled"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Router			/auth/refresh [post]
+func (h *Handler) Refresh() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req RefreshReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if h.Sessions == nil || h.AccessTokens == nil {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "sessions are not enabled")
+			return
+		}
+		ctx := c.Request.Context()
+		refreshToken, hash, err := auth.NewRefreshToken()
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		s, err := h.Sessions.RotateRefreshToken(ctx, auth.HashRefreshToken(req.RefreshToken), hash)
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			slog.WarnContext(ctx, "refresh token reused, session revoked")
+			writeUnauthorized(c, `Bearer error="invalid_token"`, "invalid or expired refresh token")
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			writeUnauthorized(c, `Bearer error="invalid_token"`, "invalid or expired refresh token")
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		resp, err := h.tokenResp(s, refreshToken)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// ListSessions godoc
+//
+//	@Summary		List sessions
+//	@Description	List the active sessions of a user, most recently used first.
+//	@Tags			Sessions
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string			true	"User uuid"
+//	@Success		200		{object}	SessionsResp	"Sessions"
+//	@Failure		400		{object}	Problem			"Bad request"
+//	@Failure		401		{object}	Problem			"Missing or invalid credentials"
+//	@Failure		403		{object}	Problem			"Forbidden"
+//	@Failure		404		{object}	Problem			"Not found"
+//	@Failure		429		{object}	Problem			"Rate limit exceeded"
+//	@Failure		503		{object}	Problem			"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/sessions [get]
+func (h *Handler) ListSessions() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.sessionsEnabled(c, userUuid) {
+			return
+		}
+		sessions, err := h.Sessions.ListSessions(c.Request.Context(), userUuid)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		r := &SessionsResp{Sessions: make([]SessionResp, 0, len(sessions))}
+		current := c.GetString(sessionKey)
+		for _, s := range sessions {
+			r.Sessions = append(r.Sessions, SessionResp{
+				Id:         s.Id,
+				Device:     s.Device,
+				UserAgent:  s.UserAgent,
+				Ip:         s.Ip,
+				CreatedAt:  s.CreatedAt,
+				LastUsedAt: s.LastUsedAt,
+				ExpiresAt:  s.ExpiresAt,
+				Current:    s.Id == current,
+			})
+		}
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+// RevokeSession godoc
+//
+//	@Summary		Revoke a session
+//	@Description	Revoke a session of a user: its refresh and access tokens stop working at once.
+//	@Tags			Sessions
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string		true	"User uuid"
+//	@Param			id		path		string		true	"Session id"
+//	@Success		200		{object}	MessageResp	"Session revoked"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Missing or invalid credentials"
+//	@Failure		403		{object}	Problem		"Forbidden"
+//	@Failure		404		{object}	Problem		"Not found"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/sessions/{id} [delete]
+func (h *Handler) RevokeSession() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var param SessionParam
+		if err := c.ShouldBindUri(&param); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if h.Sessions == nil {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "sessions are not enabled")
+			return
+		}
+		if err := h.Sessions.RevokeSession(c.Request.Context(), param.Uuid, param.Id); err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, &MessageResp{Message: "session revoked"})
+	}
+}
+
+// RevokeSessions godoc
+//
+//	@Summary		Revoke all sessions
+//	@Description	Revoke every session of a user, e.g. after a device was lost.
+//	@Tags			Sessions
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string		true	"User uuid"
+//	@Success		200		{object}	MessageResp	"Sessions revoked"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Missing or invalid credentials"
+//	@Failure		403		{object}	Problem		"Forbidden"
+//	@Failure		404		{object}	Problem		"Not found"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/sessions [delete]
+func (h *Handler) RevokeSessions() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.sessionsEnabled(c, userUuid) {
+			return
+		}
+		n, err := h.Sessions.RevokeSessions(c.Request.Context(), userUuid)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, &MessageResp{Message: fmt.Sprintf("%d sessions revoked", n)})
+	}
+}
+
+// sessionsEnabled reports whether sessions are on and the user exists.
+// Otherwise the response has been written already.
+func (h *Handler) sessionsEnabled(c *gin.Context, userUuid string) bool {
+	if h.Sessions == nil {
+		writeProblem(c, http.StatusNotFound, CodeNotFound, "sessions are not enabled")
+		return false
+	}
+	if _, err := h.Storage.GetUser(c.Request.Context(), userUuid, false); err != nil {
+		writeStorageProblem(c, err)
+		return false
+	}
+	return true
+}
+
+// startSession starts a session for a user who just logged in and returns
+// its tokens.
+func (h *Handler) startSession(c *gin.Context, userUuid string, device string) (*TokenResp, error) {
+	refreshToken, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	ttl := h.SessionTTL
+	if ttl <= 0 {
+		ttl = DefaultSessionTTL
+	}
+	s, err := h.Sessions.AddSession(c.Request.Context(), db.Session{
+		UserUuid:  userUuid,
+		Device:    device,
+		UserAgent: truncate(c.Request.UserAgent(), 255),
+		Ip:        c.ClientIP(),
+		ExpiresAt: time.Now().Add(ttl),
+	}, hash)
+	if err != nil {
+		return nil, err
+	}
+	return h.tokenResp(s, refreshToken)
+}
+
+func (h *Handler) tokenResp(s *db.Session, refreshToken string) (*TokenResp, error) {
+	accessToken, expiresAt, err := h.AccessTokens.Issue(s.UserUuid, s.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResp{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expiresAt).Round(time.Second).Seconds()),
+		RefreshToken: refreshToken,
+		SessionId:    s.Id,
+	}, nil
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
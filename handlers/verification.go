@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/mail"
+)
+
+const DefaultVerificationTTL = 24 * time.Hour
+
+// mailTimeout bounds the sending of an email in the background.
+const mailTimeout = 30 * time.Second
+
+// Mailer sends emails. mail.SMTP sends them for real, mail.Dir writes them
+// to a directory.
+type Mailer interface {
+	Send(ctx context.Context, msg mail.Message) error
+}
+
+type VerificationStore interface {
+	VerifyEmail(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error)
+}
+
+type VerifyReq struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// SendVerification godoc
+//
+//	@Summary		Send a verification email
+//	@Description	Email the user a link to verify their email address. Earlier links keep working until they expire.
+//	@Tags			Users
+//	@Produce		json,application/problem+json
+//	@Param			uuid	path		string		true	"User uuid"
+//	@Success		202		{object}	MessageResp	"Email sent"
+//	@Failure		400		{object}	Problem		"Bad request"
+//	@Failure		401		{object}	Problem		"Missing or invalid credentials"
+//	@Failure		403		{object}	Problem		"Forbidden"
+//	@Failure		404		{object}	Problem		"Not found"
+//	@Failure		409		{object}	Problem		"Email already verified"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage or mail server unavailable"
+//	@Security		BearerAuth
+//	@Router			/users/{uuid}/verification [post]
+func (h *Handler) SendVerification() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		userUuid := c.Param("uuid")
+		if err := c.ShouldBindUri(&Param{}); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.verificationEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "email verification is not enabled")
+			return
+		}
+		ctx := c.Request.Context()
+		user, err := h.Storage.GetUser(ctx, userUuid, false)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		if user.EmailVerifiedAt != nil {
+			writeProblem(c, http.StatusConflict, CodeAlreadyVerified, "email already verified")
+			return
+		}
+		ttl := h.VerificationTTL
+		if ttl <= 0 {
+			ttl = DefaultVerificationTTL
+		}
+		token, err := h.EmailTokens.Issue(auth.PurposeVerifyEmail, user.Uuid, user.Email, ttl)
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		if !h.sendMail(c, mail.Message{
+			To:      user.Email,
+			Subject: "Verify your email",
+			Body: fmt.Sprintf("Hello %s,\n\nplease confirm that this is your email address:\n\n%s\n\nIf you didn't ask for this, ignore this email.\n",
+				user.Name, h.link("/verify", token)),
+		}) {
+			return
+		}
+		c.JSON(http.StatusAccepted, &MessageResp{Message: "verification email sent"})
+	}
+}
+
+// Verify godoc
+//
+//	@Summary		Verify an email
+//	@Description	Consume the token of a verification email and mark the email of its user verified. Each token works once.
+//	@Tags			Auth
+//	@Accept			json
+//	@Produce		json,application/problem+json
+//	@Param			data	body		VerifyReq	true	"Token"
+//	@Success		200		{object}	UserResp	"Email verified"
+//	@Failure		400		{object}	Problem		"Invalid, expired or used token"
+//	@Failure		404		{object}	Problem		"Email verification is not enabled"
+//	@Failure		429		{object}	Problem		"Rate limit exceeded"
+//	@Failure		503		{object}	Problem		"Storage unavailable"
+//	@Router			/verify [post]
+func (h *Handler) Verify() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var req VerifyReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			writeBindProblem(c, err)
+			return
+		}
+		if !h.verificationEnabled() {
+			writeProblem(c, http.StatusNotFound, CodeNotFound, "email verification is not enabled")
+			return
+		}
+		ctx := c.Request.Context()
+		token, ok := h.checkEmailToken(c, auth.PurposeVerifyEmail, req.Token)
+		if !ok {
+			return
+		}
+		user, err := h.Verification.VerifyEmail(ctx, token.UserUuid, token.Email, usedToken(token))
+		if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrTokenUsed) || errors.Is(err, db.ErrEmailChanged) {
+			writeProblem(c, http.StatusBadRequest, CodeInvalidToken, err.Error())
+			return
+		}
+		if err != nil {
+			writeStorageProblem(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, &UserResp{
+			Message:         "email verified",
+			Uuid:            user.Uuid,
+			Name:            &user.Name,
+			Email:           &user.Email,
+			EmailVerifiedAt: user.EmailVerifiedAt,
+		})
+	}
+}
+
+func (h *Handler) verificationEnabled() bool {
+	return h.Mailer != nil && h.EmailTokens != nil && h.Verification != nil
+}
+
+// checkEmailToken checks a token sent by email for purpose. Otherwise the
+// response has been written already. The storage records the token as used
+// along with what it is for, so that it isn't used up by a failure.
+func (h *Handler) checkEmailToken(c *gin.Context, purpose string, s string) (*auth.EmailToken, bool) {
+	token, err := h.EmailTokens.Verify(purpose, s)
+	if err != nil {
+		slog.DebugContext(c.Request.Context(), "rejected email token", "error", err)
+		writeProblem(c, http.StatusBadRequest, CodeInvalidToken, "invalid or expired token")
+		return nil, false
+	}
+	return token, true
+}
+
+func usedToken(token *auth.EmailToken) db.UsedToken {
+	return db.UsedToken{Id: token.Id, ExpiresAt: token.ExpiresAt}
+}
+
+// sendMail reports whether msg was sent. Otherwise the response has been
+// written already.
+func (h *Handler) sendMail(c *gin.Context, msg mail.Message) bool {
+	if err := h.Mailer.Send(c.Request.Context(), msg); err != nil {
+		slog.ErrorContext(c.Request.Context(), "sending email", "error", err)
+		writeProblem(c, http.StatusServiceUnavailable, CodeUnavailable, "email can't be sent right now")
+		return false
+	}
+	return true
+}
+
+// mailLater runs send in the background, so that neither the response nor
+// its timing tells whether an email was sent. Failures are only logged.
+func (h *Handler) mailLater(ctx context.Context, send func(ctx context.Context) error) {
+	ctx = context.WithoutCancel(ctx)
+	h.mailing.Add(1)
+	go func() {
+		defer h.mailing.Done()
+		ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+		defer cancel()
+		if err := send(ctx); err != nil {
+			slog.ErrorContext(ctx, "sending email", "error", err)
+		}
+	}()
+}
+
+// WaitMail waits until the emails sent in the background are out, or ctx is
+// done.
+func (h *Handler) WaitMail(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.mailing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// link returns the link to path in LinkURL carrying token, or the bare
+// token when there is no LinkURL.
+func (h *Handler) link(path string, token string) string {
+	if h.LinkURL == "" {
+		return token
+	}
+	return strings.TrimRight(h.LinkURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
@@ -1,4 +1,4 @@
 # migrate
-goose up
+/userssrv migrate up
 # start
 exec /userssrv
@@ -0,0 +1,97 @@
+// Package logging sets up structured JSON logging with log/slog. Records
+// logged with a request context carry its request and trace ids.
+package logging
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"user-service/environment"
+)
+
+const redacted = "[REDACTED]"
+
+// piiKeys are attributes holding personal data, redacted whatever their
+// value.
+var piiKeys = map[string]bool{
+	"email": true,
+	"name":  true,
+}
+
+var emailRe = regexp.MustCompile(`[^\s@"'(),;<>]+@[^\s@"'(),;<>]+\.[^\s@"'(),;<>]+`)
+
+// New returns a logger writing to w in the configured format, at the
+// configured level. Unless cfg.LogPII is set, emails are redacted from every
+// value and personal attributes such as email and name are dropped.
+func New(cfg environment.Log, w io.Writer) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if !cfg.LogPII {
+		opts.ReplaceAttr = redact
+	}
+	var h slog.Handler
+	if cfg.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(&contextHandler{Handler: h})
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if piiKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); strings.Contains(s, "@") {
+			return slog.String(a.Key, emailRe.ReplaceAllString(s, redacted))
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok && strings.Contains(err.Error(), "@") {
+			return slog.String(a.Key, emailRe.ReplaceAllString(err.Error(), redacted))
+		}
+	}
+	return a
+}
+
+type requestIdKey struct{}
+
+// WithRequestID returns a context whose log records carry id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestIDFromContext returns the request id of ctx, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request id and the trace and span ids found in the
+// context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	// UserUuidKey is the gin context key handlers set the uuid of the user
+	// a request is about under, when it isn't in the path.
+	UserUuidKey = "user_uuid"
+	// SubjectKey is the gin context key authentication stores who made the
+	// request under.
+	SubjectKey = "subject"
+
+	maxRequestIDLen = 128
+)
+
+// RequestID propagates the X-Request-ID header of the request, or assigns
+// one, and echoes it in the response.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// validRequestID accepts ids of printable ASCII, so clients can't forge log
+// lines with them.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog logs every request once it's served, at error level for 5xx
+// responses, warn for 4xx and info otherwise.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", c.Writer.Size()),
+		}
+		userUuid := c.Param("uuid")
+		if userUuid == "" {
+			userUuid = c.GetString(UserUuidKey)
+		}
+		if userUuid != "" {
+			attrs = append(attrs, slog.String("user_uuid", userUuid))
+		}
+		if subject := c.GetString(SubjectKey); subject != "" {
+			attrs = append(attrs, slog.String("subject", subject))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Recovery answers 500 to requests whose handler panicked, and logs the
+// panic.
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, recovered any) {
+		slog.ErrorContext(c.Request.Context(), "panic serving request", "panic", recovered)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
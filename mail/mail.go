@@ -0,0 +1,161 @@
+// Package mail delivers the emails the service sends, over SMTP or into a
+// local directory for development and tests.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// format renders msg as an RFC 5322 message from from.
+func format(from string, msg Message) ([]byte, string, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, "", errors.New("mail: line break in header")
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", fmt.Errorf("mail: generating message id: %w", err)
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+	messageId := hex.EncodeToString(id)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", messageId, domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	for _, line := range strings.Split(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n") {
+		b.WriteString(line + "\r\n")
+	}
+	return b.Bytes(), messageId, nil
+}
+
+// Dir writes each message to a .eml file of its own in Path, which is
+// created if needed, instead of sending it.
+type Dir struct {
+	Path string
+	From string
+}
+
+func (d *Dir) Send(_ context.Context, msg Message) error {
+	b, id, err := format(d.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Path, 0o750); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	// Write then rename, so readers of the directory never see half a
+	// message. The timestamp keeps files in the order they were sent.
+	name := filepath.Join(d.Path, time.Now().UTC().Format("20060102T150405.000000000")+"-"+id[:8]+".eml")
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o640); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("mail: %w", err)
+	}
+	return nil
+}
+
+// SMTP sends messages through the server at Addr, a host:port. The
+// connection is upgraded with STARTTLS when the server offers it, and
+// authenticated with PLAIN when Username is set, which needs TLS unless the
+// server is local.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	b, _, err := format(s.From, msg)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("mail: starttls: %w", err)
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return fmt.Errorf("mail: auth: %w", err)
+		}
+	}
+	if err := c.Mail(address(s.From)); err != nil {
+		return fmt.Errorf("mail: from: %w", err)
+	}
+	if err := c.Rcpt(address(msg.To)); err != nil {
+		return fmt.Errorf("mail: to: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+	return c.Quit()
+}
+
+// address returns the bare address of "Name <address>".
+func address(s string) string {
+	if start, end := strings.LastIndex(s, "<"), strings.LastIndex(s, ">"); start >= 0 && end > start {
+		return s[start+1 : end]
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir(t *testing.T) {
+	d := &Dir{Path: filepath.Join(t.TempDir(), "outbox"), From: "users-service <no-reply@example.com>"}
+	require.NoError(t, d.Send(context.Background(), Message{To: "john@example.com", Subject: "Hello", Body: "first"}))
+	require.NoError(t, d.Send(context.Background(), Message{To: "john@example.com", Subject: "Grüße", Body: "second\nline"}))
+
+	entries, err := os.ReadDir(d.Path)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	first, err := os.ReadFile(filepath.Join(d.Path, entries[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(first), "From: users-service <no-reply@example.com>\r\n")
+	assert.Contains(t, string(first), "To: john@example.com\r\n")
+	assert.Contains(t, string(first), "Subject: Hello\r\n")
+	assert.Regexp(t, `Message-ID: <[0-9a-f]{32}@example\.com>`, string(first))
+	assert.True(t, strings.HasSuffix(string(first), "\r\n\r\nfirst\r\n"))
+	second, err := os.ReadFile(filepath.Join(d.Path, entries[1].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(second), "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.True(t, strings.HasSuffix(string(second), "\r\n\r\nsecond\r\nline\r\n"))
+}
+
+func TestHeaderInjection(t *testing.T) {
+	d := &Dir{Path: t.TempDir(), From: "no-reply@example.com"}
+	for _, msg := range []Message{
+		{To: "john@example.com\r\nBcc: jane@example.com", Subject: "Hello"},
+		{To: "john@example.com", Subject: "Hello\nBcc: jane@example.com"},
+	} {
+		assert.Error(t, d.Send(context.Background(), msg))
+	}
+	entries, err := os.ReadDir(d.Path)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+		var lines []string
+		reply("220 localhost ESMTP")
+		for data := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case data && line == ".":
+				data = false
+				reply("250 queued")
+			case data:
+				lines = append(lines, line)
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case line == "DATA":
+				data = true
+				reply("354 go ahead")
+			case line == "QUIT":
+				reply("221 bye")
+				received <- lines
+				return
+			default:
+				lines = append(lines, line)
+				reply("250 ok")
+			}
+		}
+	}()
+
+	s := &SMTP{Addr: l.Addr().String(), From: "users-service <no-reply@example.com>"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Send(ctx, Message{To: "john@example.com", Subject: "Hello", Body: "hi\n.\nbye"}))
+	lines := <-received
+	assert.Contains(t, lines, "MAIL FROM:<no-reply@example.com>")
+	assert.Contains(t, lines, "RCPT TO:<john@example.com>")
+	assert.Contains(t, lines, "To: john@example.com")
+	// A lone dot would end the message, so it's doubled on the wire.
+	assert.Equal(t, []string{"hi", "..", "bye"}, lines[len(lines)-3:])
+}
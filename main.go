@@ -4,71 +4,403 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/db/memory"
 	_ "user-service/docs"
 	"user-service/environment"
 	"user-service/handlers"
+	"user-service/logging"
+	"user-service/mail"
+	"user-service/metrics"
+	"user-service/ratelimit"
+	"user-service/tracing"
 )
 
-func router(h *handlers.Handler) *gin.Engine {
-	r := gin.Default()
-	r.GET("/users/:uuid", h.GetUser())
-	r.POST("/users", h.CreateUser())
-	r.PUT("/users/:uuid", h.ChangeUser())
+func router(h *handlers.Handler, middleware ...gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	r.Use(logging.RequestID(), logging.AccessLog(), logging.Recovery())
+	r.Use(middleware...)
+	r.GET("/healthz", h.Healthz())
+	r.GET("/readyz", h.Readyz())
+	// Authentication comes first, so rate limits can tell subjects apart;
+	// it charges bad credentials to the login limit itself.
+	users := r.Group("/users", h.Authenticate())
+	readLimit, writeLimit := h.RateLimit(handlers.RateLimitRead), h.RateLimit(handlers.RateLimitWrite)
+	users.GET("", readLimit, h.Require(auth.ScopeRead), h.ListUsers())
+	users.GET("/:uuid", readLimit, h.RequireOrSelf(auth.ScopeRead), h.GetUser())
+	users.POST("", h.RateLimit(handlers.RateLimitCreate), h.Require(auth.ScopeWrite), h.Idempotent(), h.CreateUser())
+	users.PUT("/:uuid", writeLimit, h.RequireOrSelf(auth.ScopeWrite), h.ChangeUser())
+	users.PATCH("/:uuid", writeLimit, h.RequireOrSelf(auth.ScopeWrite), h.PatchUser())
+	users.DELETE("/:uuid", writeLimit, h.Require(auth.ScopeWrite), h.DeleteUser())
+	users.POST("/:uuid/restore", writeLimit, h.Require(auth.ScopeWrite), h.RestoreUser())
+	users.POST("/:uuid/password", writeLimit, h.RequireOrOwnSession(auth.ScopeAdmin), h.SetPassword())
+	users.POST("/:uuid/verification", writeLimit, h.RequireOrOwnSession(auth.ScopeWrite), h.SendVerification())
+	users.POST("/:uuid/email", writeLimit, h.RequireOrOwnSession(auth.ScopeWrite), h.ChangeEmail())
+	users.GET("/:uuid/sessions", readLimit, h.RequireOrOwnSession(auth.ScopeAdmin), h.ListSessions())
+	users.DELETE("/:uuid/sessions", writeLimit, h.RequireOrOwnSession(auth.ScopeAdmin), h.RevokeSessions())
+	users.DELETE("/:uuid/sessions/:id", writeLimit, h.RequireOrOwnSession(auth.ScopeAdmin), h.RevokeSession())
+	loginLimit := h.RateLimit(handlers.RateLimitLogin)
+	r.POST("/auth/login", loginLimit, h.Login())
+	r.POST("/auth/refresh", loginLimit, h.Refresh())
+	r.POST("/auth/password-reset", loginLimit, h.RequestPasswordReset())
+	r.POST("/auth/password-reset/confirm", loginLimit, h.ConfirmPasswordReset())
+	r.POST("/verify", loginLimit, h.Verify())
+	r.POST("/email/confirm", loginLimit, h.ConfirmEmail())
+	r.POST("/email/revert", loginLimit, h.RevertEmail())
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	return r
 }
 
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func openDb(env *environment.Env) (*sql.DB, db.Dialect, error) {
+	dialect, err := db.ParseDialect(env.Db.Driver)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := db.Open(dialect, env.Db.Dsn)
+	if err != nil {
+		return nil, 0, err
+	}
+	// SQLite keeps the single connection db.Open gives it.
+	if dialect != db.SQLite {
+		conn.SetMaxOpenConns(env.Db.MaxOpenConns)
+		conn.SetMaxIdleConns(env.Db.MaxIdleConns)
+		conn.SetConnMaxLifetime(env.Db.ConnMaxLifetime)
+		conn.SetConnMaxIdleTime(env.Db.ConnMaxIdleTime)
+	}
+	if err := conn.Ping(); err != nil {
+		_ = conn.Close()
+		return nil, 0, fmt.Errorf("failed connect to db: %w", err)
+	}
+	return conn, dialect, nil
+}
+
+// readyChecks are the database checks /readyz runs: the database answers
+// and has every migration the binary embeds applied. A database ahead of the
+// binary is fine: a newer release migrated it while this one still runs.
+func readyChecks(conn *sql.DB, dialect db.Dialect) ([]handlers.ReadyCheck, error) {
+	migrator, err := db.NewMigrator(conn, dialect)
+	if err != nil {
+		return nil, err
+	}
+	return []handlers.ReadyCheck{
+		{Name: "db", Check: conn.PingContext},
+		{Name: "migrations", Check: func(ctx context.Context) error {
+			current, target, err := migrator.GetVersions(ctx)
+			if err != nil {
+				return err
+			}
+			if current < target {
+				return fmt.Errorf("db is at version %d, want %d", current, target)
+			}
+			return nil
+		}},
+	}, nil
+}
+
+func emailNormalization(c environment.Email) db.EmailNormalization {
+	return db.EmailNormalization{
+		IgnoreDots:     c.IgnoreDots,
+		IgnorePlusTags: c.IgnorePlusTags,
+	}
+}
+
+// rateLimits parses the limit of each route group. The configuration is
+// validated, so they parse.
+func rateLimits(c environment.RateLimit) map[string]ratelimit.Limit {
+	limits := make(map[string]ratelimit.Limit)
+	for group, s := range map[string]string{
+		handlers.RateLimitRead:   c.Read,
+		handlers.RateLimitWrite:  c.Write,
+		handlers.RateLimitCreate: c.Create,
+		handlers.RateLimitLogin:  c.Login,
+	} {
+		limits[group], _ = ratelimit.ParseLimit(s)
+	}
+	return limits
+}
+
+// tokenVerifier returns nil when no JWKS is configured. The keys are loaded
+// right away, so a wrong JWKS stops the service from starting.
+func tokenVerifier(ctx context.Context, c environment.Jwt) (*auth.Verifier, error) {
+	if c.Jwks == "" {
+		return nil, nil
+	}
+	roleScopes, err := auth.ParseRoleScopes(c.RoleScopes)
+	if err != nil {
+		return nil, err
+	}
+	keys := auth.NewJWKS(c.Jwks, c.JwksRefresh)
+	if err := keys.Load(ctx); err != nil {
+		return nil, err
+	}
+	return auth.NewVerifier(keys, c.Issuer, c.Audience, c.RolesClaim, roleScopes), nil
+}
+
+// passwords returns the password policy and hashing parameters.
+func passwords(c environment.Password) (*auth.Passwords, error) {
+	p := &auth.Passwords{
+		Params: auth.Argon2Params{
+			Memory:      uint32(c.Argon2Memory),
+			Iterations:  uint32(c.Argon2Iterations),
+			Parallelism: uint8(c.Argon2Parallelism),
+		},
+		MinLength: c.MinLength,
+	}
+	if c.DenylistFile != "" {
+		denylist, err := auth.LoadDenylist(c.DenylistFile)
+		if err != nil {
+			return nil, err
+		}
+		p.Denylist = denylist
+	}
+	return p, nil
+}
+
+// signingKey is the key access and email tokens are signed with, a random
+// one when none is configured.
+func signingKey(c environment.Session) ([]byte, error) {
+	if c.SigningKey != "" {
+		return []byte(c.SigningKey), nil
+	}
+	slog.Warn("no session signing key set, tokens won't survive a restart")
+	return auth.NewSigningKey()
+}
+
+// mailer returns nil when mail is off.
+func mailer(c environment.Mail) handlers.Mailer {
+	switch c.Driver {
+	case "smtp":
+		return &mail.SMTP{Addr: c.SmtpAddr, Username: c.SmtpUsername, Password: c.SmtpPassword, From: c.From}
+	case "dir":
+		slog.Warn("emails are written to a directory, not sent; they hold live tokens, so use it for development only", "dir", c.Dir)
+		return &mail.Dir{Path: c.Dir, From: c.From}
+	}
+	return nil
+}
+
+// corsMiddleware returns nil when no origin is allowed.
+func corsMiddleware(c environment.Cors) gin.HandlerFunc {
+	if len(c.AllowedOrigins) == 0 {
+		return nil
+	}
+	config := cors.Config{
+		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowHeaders: c.AllowedHeaders,
+		ExposeHeaders: []string{"ETag", "Location", "Idempotent-Replayed", "Retry-After",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "WWW-Authenticate"},
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}
+	if len(c.AllowedOrigins) == 1 && c.AllowedOrigins[0] == "*" {
+		config.AllowAllOrigins = true
+	} else {
+		config.AllowOrigins = c.AllowedOrigins
+	}
+	return cors.New(config)
+}
+
 //	@title			Users service
 //	@version		1.0
 //	@description	A users service API in Go using Gin framework
 
 //	@BasePath	/
 
+//	@securityDefinitions.apikey	BearerAuth
+//	@in							header
+//	@name						Authorization
+//	@description				API key, JWT or admin token as "Bearer <token>"
+
 func main() {
-	env := environment.LoadEnv()
-	db, err := sql.Open("postgres", env.Db.Dsn)
+	env, args, err := environment.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logging.New(env.Log, os.Stderr))
+	if len(args) > 0 {
+		if err := command(env, args); err != nil {
+			fatal("command failed", err)
+		}
+		return
+	}
+	if env.Log.Level != "debug" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	emailNorm := emailNormalization(env.Email)
+	handler := &handlers.Handler{
+		IdempotencyTTL:   env.App.IdempotencyTTL,
+		AdminToken:       env.App.AdminToken,
+		ReadyTimeout:     env.App.ReadyTimeout,
+		RateLimitStore:   ratelimit.NewMemoryStore(),
+		RateLimits:       rateLimits(env.RateLimit),
+		RateLimitKey:     env.RateLimit.Key,
+		MaxFailedLogins:  env.Password.MaxFailedLogins,
+		Lockout:          env.Password.Lockout,
+		SessionTTL:       env.Session.TTL,
+		VerificationTTL:  env.Email.VerificationTTL,
+		EmailRevertTTL:   env.Email.RevertTTL,
+		PasswordResetTTL: env.Password.ResetTTL,
+		LinkURL:          env.Mail.LinkURL,
+	}
+	handler.Passwords, err = passwords(env.Password)
+	if err != nil {
+		fatal("failed to start", err)
+	}
+	key, err := signingKey(env.Session)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to start", err)
+	}
+	handler.EmailTokens = auth.NewEmailTokens(key)
+	handler.Mailer = mailer(env.Mail)
+	var conn *sql.DB
+	if env.Db.Driver == "memory" {
+		slog.Warn("using in-memory storage, data is lost on exit")
+		storage := memory.NewStorage(memory.WithEmailNormalization(emailNorm))
+		handler.Storage, handler.Idempotency, handler.APIKeys, handler.Credentials = storage, storage, storage, storage
+		handler.Sessions, handler.Verification, handler.EmailChanges = storage, storage, storage
+		handler.PasswordResets = storage
+	} else {
+		var dialect db.Dialect
+		conn, dialect, err = openDb(env)
+		if err != nil {
+			fatal("failed to start", err)
+		}
+		if env.Db.AutoMigrate {
+			if err := migrateUp(context.Background(), conn, dialect, emailNorm); err != nil {
+				fatal("failed to migrate db", err)
+			}
+		}
+		storage := db.NewStorage(conn,
+			db.WithDialect(dialect),
+			db.WithEmailNormalization(emailNorm),
+			db.WithQueryTimeout(env.Db.QueryTimeout),
+		)
+		handler.Storage, handler.Idempotency, handler.APIKeys, handler.Credentials = storage, storage, storage, storage
+		handler.Sessions, handler.Verification, handler.EmailChanges = storage, storage, storage
+		handler.PasswordResets = storage
+		handler.ReadyChecks, err = readyChecks(conn, dialect)
+		if err != nil {
+			fatal("failed to start", err)
+		}
 	}
-	err = db.Ping()
+	handler.AccessTokens = auth.NewAccessTokens(key, env.Session.AccessTTL, handler.Sessions)
+	verifier, err := tokenVerifier(context.Background(), env.Jwt)
 	if err != nil {
-		log.Fatal("failed connect to db", err)
+		fatal("failed to load jwks", err)
+	}
+	if verifier != nil {
+		handler.Tokens = verifier
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), env.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	m := metrics.New()
+	handler.Storage = m.Storage(tracing.Storage(handler.Storage))
+	if conn != nil {
+		m.RegisterDB(conn, env.Db.Driver)
 	}
-	handler := handlers.NewHandler(db)
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	// Every request context derives from reqCtx, so cancelling it aborts the
+	// queries of requests still running at shutdown.
+	reqCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	middleware := []gin.HandlerFunc{tracing.Middleware(), m.Middleware()}
+	if mw := corsMiddleware(env.Cors); mw != nil {
+		middleware = append(middleware, mw)
+	}
+	r := router(handler, middleware...)
+	if err := r.SetTrustedProxies(env.App.TrustedProxies); err != nil {
+		fatal("failed to start", err)
+	}
+	r.GET("/metrics", gin.WrapH(m.Handler()))
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", env.App.Port),
-		Handler: router(handler),
+		Addr:              fmt.Sprintf(":%s", env.App.Port),
+		Handler:           r,
+		ReadHeaderTimeout: env.App.ReadHeaderTimeout,
+		ReadTimeout:       env.App.ReadTimeout,
+		WriteTimeout:      env.App.WriteTimeout,
+		IdleTimeout:       env.App.IdleTimeout,
+		BaseContext: func(net.Listener) context.Context {
+			return reqCtx
+		},
 	}
 
+	slog.Info("listening", "addr", srv.Addr, "tls", env.Tls.CertFile != "")
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %s\n", err)
+		var err error
+		if env.Tls.CertFile != "" {
+			err = srv.ListenAndServeTLS(env.Tls.CertFile, env.Tls.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("listen", err)
 		}
 	}()
 
 	<-ctx.Done()
 	stop()
 
-	log.Println("shutting down server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	slog.Info("shutting down server")
+	// Fail readiness first so no new traffic is routed here while the
+	// server still accepts connections.
+	handler.Drain()
+	if env.App.DrainDelay > 0 {
+		slog.Info("draining", "delay", env.App.DrainDelay.String())
+		time.Sleep(env.App.DrainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), env.App.ShutdownTimeout)
 	defer cancel()
+	// Let in-flight requests finish during most of the grace period, then
+	// cancel their queries so they can still answer before the deadline.
+	drain := time.AfterFunc(env.App.ShutdownTimeout*4/5, func() {
+		slog.Warn("cancelling in-flight requests")
+		cancelRequests()
+	})
+	defer drain.Stop()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v\n", err)
+		fatal("server forced to shutdown", err)
+	}
+	if err := handler.WaitMail(ctx); err != nil {
+		slog.Error("emails left unsent", "error", err)
+	}
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			slog.Error("closing db", "error", err)
+		}
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("flushing traces", "error", err)
 	}
 
-	log.Println("server exiting")
+	slog.Info("server exiting")
 
 }
@@ -2,16 +2,43 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"user-service/auth"
+	"user-service/db"
+	"user-service/db/memory"
+	"user-service/environment"
 	"user-service/handlers"
+	"user-service/logging"
+	"user-service/mail"
+	"user-service/metrics"
+	"user-service/ratelimit"
+	"user-service/tracing"
 )
 
 func TestNotFoundUser(t *testing.T) {
@@ -21,7 +48,7 @@ func TestNotFoundUser(t *testing.T) {
 
 	userUuid := uuid.New().String()
 
-	mock.ExpectQuery("SELECT uuid, name, email FROM users WHERE uuid = $1").WithArgs(userUuid).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").WithArgs(userUuid).WillReturnError(sql.ErrNoRows)
 
 	handler := handlers.NewHandler(db)
 	r := router(handler)
@@ -30,19 +57,18 @@ func TestNotFoundUser(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, url, nil)
 	r.ServeHTTP(w, req)
 
-	var b struct {
-		Message string  `json:"message"`
-		Uuid    string  `json:"uuid"`
-		Name    *string `json:"name"`
-		Email   *string `json:"email"`
+	b := handlers.Problem{
+		Type:     "urn:users-service:problem:not_found",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "user not found",
+		Instance: url,
+		Code:     "not_found",
 	}
-	b.Message = "user not found: sql: no rows in result set"
-	b.Name = nil
-	b.Uuid = userUuid
-	b.Email = nil
 	body, _ := json.Marshal(b)
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, handlers.ProblemContentType, w.Header().Get("Content-Type"))
 	assert.Equal(t, string(body), w.Body.String())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -60,10 +86,13 @@ func TestGetUser(t *testing.T) {
 		"uuid",
 		"name",
 		"email",
+		"version",
+		"deleted_at",
+		"email_verified_at",
 	}
 	rows := sqlmock.NewRows(columns)
-	rows.AddRow(userUuid, "John Doe", "john.doe@example.com")
-	mock.ExpectQuery("SELECT uuid, name, email FROM users WHERE uuid = $1").WithArgs(userUuid).WillReturnRows(rows)
+	rows.AddRow(userUuid, "John Doe", "john.doe@example.com", 3, nil, nil)
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").WithArgs(userUuid).WillReturnRows(rows)
 
 	handler := handlers.NewHandler(db)
 	r := router(handler)
@@ -86,6 +115,7 @@ func TestGetUser(t *testing.T) {
 	b.Email = &email
 	body, _ := json.Marshal(b)
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"3"`, w.Header().Get("ETag"))
 	assert.Equal(t, string(body), w.Body.String())
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -103,11 +133,11 @@ func TestChangeUser(t *testing.T) {
 	defer db.Close()
 	userUuid := uuid.New().String()
 	url := fmt.Sprintf("/users/%s", userUuid)
-	columns := []string{"uuid", "name", "email"}
+	columns := []string{"uuid", "name", "email", "version", "email_verified_at"}
 
-	rows := sqlmock.NewRows(columns).AddRow(userUuid, "Jane Smith", "john.doe@example.com")
-	mock.ExpectQuery("UPDATE users SET name = $1, updated_at = $2 WHERE uuid = $3 RETURNING uuid, name, email").
-		WithArgs("Jane Smith", sqlmock.AnyArg(), userUuid).
+	rows := sqlmock.NewRows(columns).AddRow(userUuid, "Jane Smith", "john.doe@example.com", 2, nil)
+	mock.ExpectQuery("UPDATE users SET name = $1, updated_at = $2, version = version + 1 WHERE uuid = $3 AND deleted_at IS NULL AND version = $4 RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs("Jane Smith", sqlmock.AnyArg(), userUuid, 1).
 		WillReturnRows(rows)
 	handler := handlers.NewHandler(db)
 	r := router(handler)
@@ -120,6 +150,7 @@ func TestChangeUser(t *testing.T) {
 	byteBody, _ := json.Marshal(reqBody)
 
 	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(byteBody))
+	req.Header.Set("If-Match", `"1"`)
 	r.ServeHTTP(w, req)
 
 	var b struct {
@@ -160,19 +191,20 @@ func TestFailChangeUser(t *testing.T) {
 	byteBody, _ := json.Marshal(reqBody)
 
 	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(byteBody))
+	req.Header.Set("If-Match", `"1"`)
 	r.ServeHTTP(w, req)
 
-	var b struct {
-		Message string  `json:"message"`
-		Uuid    string  `json:"uuid"`
-		Name    *string `json:"name"`
-		Email   *string `json:"email"`
+	b := handlers.Problem{
+		Type:     "urn:users-service:problem:validation_failed",
+		Title:    "Bad Request",
+		Status:   http.StatusBadRequest,
+		Detail:   "request validation failed",
+		Instance: url,
+		Code:     "validation_failed",
+		Errors: []handlers.FieldError{
+			{Field: "name", Tag: "required", Message: "name: is required"},
+		},
 	}
-
-	b.Message = "name field is required"
-	b.Email = nil
-	b.Name = nil
-	b.Uuid = userUuid
 	body, _ := json.Marshal(b)
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
@@ -190,11 +222,11 @@ func TestCreateUser(t *testing.T) {
 	defer db.Close()
 	userUuid := uuid.New().String()
 	url := "/users"
-	columns := []string{"uuid", "name", "email"}
+	columns := []string{"uuid", "name", "email", "version"}
 
-	rows := sqlmock.NewRows(columns).AddRow(userUuid, "Jane Smith", "john.doe@example.com")
-	mock.ExpectQuery("INSERT INTO users (uuid, name, email, created_at) VALUES($1, $2, $3, $4) RETURNING uuid, name, email").
-		WithArgs(sqlmock.AnyArg(), "Jane Smith", "john.doe@example.com", sqlmock.AnyArg()).
+	rows := sqlmock.NewRows(columns).AddRow(userUuid, "Jane Smith", "john.doe@example.com", 1)
+	mock.ExpectQuery("INSERT INTO users (uuid, name, email, email_normalized, created_at) VALUES($1, $2, $3, $4, $5) RETURNING uuid, name, email, version").
+		WithArgs(sqlmock.AnyArg(), "Jane Smith", "john.doe@example.com", "john.doe@example.com", sqlmock.AnyArg()).
 		WillReturnRows(rows)
 	handler := handlers.NewHandler(db)
 	r := router(handler)
@@ -231,3 +263,1615 @@ func TestCreateUser(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 }
+
+func TestDeleteUser(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s", userUuid)
+
+	mock.ExpectExec("UPDATE users SET deleted_at = $1, version = version + 1 WHERE uuid = $2 AND deleted_at IS NULL AND version = $3").
+		WithArgs(sqlmock.AnyArg(), userUuid, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.Header.Set("If-Match", `"4"`)
+	r.ServeHTTP(w, req)
+
+	var b struct {
+		Message string  `json:"message"`
+		Uuid    string  `json:"uuid"`
+		Name    *string `json:"name"`
+		Email   *string `json:"email"`
+	}
+	b.Message = "user deleted"
+	b.Uuid = userUuid
+	body, _ := json.Marshal(b)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(body), w.Body.String())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeUserRequiresAdmin(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s?hard=true", userUuid)
+
+	handler := handlers.NewHandler(db)
+	handler.AdminToken = "secret"
+	r := router(handler)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	mock.ExpectExec("DELETE FROM users WHERE uuid = $1").
+		WithArgs(userUuid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodDelete, url, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("If-Match", "*")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s/restore", userUuid)
+	columns := []string{"uuid", "name", "email", "version", "email_verified_at"}
+
+	rows := sqlmock.NewRows(columns).AddRow(userUuid, "Jane Smith", "john.doe@example.com", 6, nil)
+	mock.ExpectQuery("UPDATE users SET deleted_at = NULL, updated_at = $1, version = version + 1 WHERE uuid = $2 AND deleted_at IS NOT NULL RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs(sqlmock.AnyArg(), userUuid).
+		WillReturnRows(rows)
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	r.ServeHTTP(w, req)
+
+	var b struct {
+		Message string  `json:"message"`
+		Uuid    string  `json:"uuid"`
+		Name    *string `json:"name"`
+		Email   *string `json:"email"`
+	}
+	name := "Jane Smith"
+	email := "john.doe@example.com"
+	b.Message = "user restored"
+	b.Email = &email
+	b.Name = &name
+	b.Uuid = userUuid
+	body, _ := json.Marshal(b)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(body), w.Body.String())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	first, second := uuid.New().String(), uuid.New().String()
+	createdAt := time.Date(2025, 3, 30, 12, 0, 0, 0, time.UTC)
+	columns := []string{"uuid", "name", "email", "created_at", "updated_at", "email_verified_at"}
+
+	mock.ExpectQuery("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND LOWER(email) LIKE $1").
+		WithArgs("%@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT uuid, name, email, created_at, updated_at, email_verified_at FROM users WHERE deleted_at IS NULL AND LOWER(email) LIKE $1 ORDER BY created_at ASC, uuid ASC LIMIT $2").
+		WithArgs("%@example.com", 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(first, "John Doe", "john.doe@example.com", createdAt, nil, nil).
+			AddRow(second, "Jane Smith", "jane.smith@example.com", createdAt, nil, nil))
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest(http.MethodGet, "/users?limit=1&email_domain=example.com&total=true", nil)
+	r.ServeHTTP(w, req)
+
+	var page handlers.UserListResp
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, first, page.Users[0].Uuid)
+	assert.Equal(t, 2, *page.Total)
+	assert.NotNil(t, page.NextCursor)
+
+	mock.ExpectQuery("SELECT uuid, name, email, created_at, updated_at, email_verified_at FROM users WHERE deleted_at IS NULL AND LOWER(email) LIKE $1 AND (created_at, uuid) > ($2, $3) ORDER BY created_at ASC, uuid ASC LIMIT $4").
+		WithArgs("%@example.com", createdAt, first, 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(second, "Jane Smith", "jane.smith@example.com", createdAt, nil, nil))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/users?limit=1&email_domain=example.com&cursor="+*page.NextCursor, nil)
+	r.ServeHTTP(w, req)
+
+	page = handlers.UserListResp{}
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Users, 1)
+	assert.Equal(t, second, page.Users[0].Uuid)
+	assert.Nil(t, page.NextCursor)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListUsersBadRequest(t *testing.T) {
+	t.Parallel()
+	db, _, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+
+	for _, query := range []string{"sort=password", "cursor=garbage", "limit=1000"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/users?"+query, nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestCreateUserEmailTaken(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+
+	mock.ExpectQuery("INSERT INTO users (uuid, name, email, email_normalized, created_at) VALUES($1, $2, $3, $4, $5) RETURNING uuid, name, email, version").
+		WithArgs(sqlmock.AnyArg(), "Jane Smith", "John.Doe@Example.com", "john.doe@example.com", sqlmock.AnyArg()).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_normalized_key"})
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+
+	reqBody := CrReqBody{
+		Name:  "Jane Smith",
+		Email: "John.Doe@Example.com",
+	}
+	byteBody, _ := json.Marshal(reqBody)
+
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(byteBody))
+	r.ServeHTTP(w, req)
+
+	var b handlers.Problem
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, handlers.CodeEmailTaken, b.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUserStorageUnavailable(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+		WithArgs(userUuid).
+		WillReturnError(&pq.Error{Code: "08006", Message: "connection failure to 10.0.0.5:5432"})
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/users/%s", userUuid), nil)
+	r.ServeHTTP(w, req)
+
+	var b handlers.Problem
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, handlers.CodeUnavailable, b.Code)
+	assert.NotContains(t, w.Body.String(), "10.0.0.5")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangeMissingUser(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+
+	mock.ExpectQuery("UPDATE users SET name = $1, updated_at = $2, version = version + 1 WHERE uuid = $3 AND deleted_at IS NULL RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs("Jane Smith", sqlmock.AnyArg(), userUuid).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+		WithArgs(userUuid).
+		WillReturnError(sql.ErrNoRows)
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+	byteBody, _ := json.Marshal(ChReqBody{Name: "Jane Smith"})
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("/users/%s", userUuid), bytes.NewReader(byteBody))
+	req.Header.Set("If-Match", "*")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, "/users/not-a-uuid", bytes.NewReader(byteBody))
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	t.Parallel()
+	db, _, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	w := httptest.NewRecorder()
+
+	byteBody, _ := json.Marshal(CrReqBody{Name: "", Email: "not-an-email"})
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(byteBody))
+	r.ServeHTTP(w, req)
+
+	var b handlers.Problem
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, []handlers.FieldError{
+		{Field: "name", Tag: "required", Message: "name: is required"},
+		{Field: "email", Tag: "email", Message: "email: must be a valid email"},
+	}, b.Errors)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewReader([]byte(`{"name": 1}`)))
+	r.ServeHTTP(w, req)
+
+	b = handlers.Problem{}
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, "name", b.Errors[0].Field)
+	assert.Equal(t, "name: must be a string", b.Errors[0].Message)
+}
+
+func TestPatchUser(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s", userUuid)
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+
+	expectGet := func() {
+		mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+			WithArgs(userUuid).
+			WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "deleted_at", "email_verified_at"}).
+				AddRow(userUuid, "John Doe", "john.doe@example.com", 1, nil, nil))
+	}
+
+	expectGet()
+	mock.ExpectQuery("UPDATE users SET email = $1, email_verified_at = CASE WHEN email = $1 THEN email_verified_at END, email_normalized = $2, updated_at = $3, version = version + 1 WHERE uuid = $4 AND deleted_at IS NULL AND version = $5 RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs("John.Doe@example.org", "john.doe@example.org", sqlmock.AnyArg(), userUuid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "email_verified_at"}).
+			AddRow(userUuid, "John Doe", "John.Doe@example.org", 2, nil))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPatch, url, bytes.NewReader([]byte(`{"email": "John.Doe@example.org"}`)))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", `"1"`)
+	r.ServeHTTP(w, req)
+
+	var b handlers.UserResp
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+	assert.Equal(t, "John.Doe@example.org", *b.Email)
+
+	expectGet()
+	mock.ExpectQuery("UPDATE users SET name = $1, updated_at = $2, version = version + 1 WHERE uuid = $3 AND deleted_at IS NULL AND version = $4 RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs("Jane Doe", sqlmock.AnyArg(), userUuid, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "email_verified_at"}).
+			AddRow(userUuid, "Jane Doe", "john.doe@example.com", 2, nil))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPatch, url, bytes.NewReader([]byte(
+		`[{"op": "test", "path": "/name", "value": "John Doe"}, {"op": "replace", "path": "/name", "value": "Jane Doe"}]`)))
+	req.Header.Set("Content-Type", "application/json-patch+json")
+	req.Header.Set("If-Match", "*")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPatchUserRejected(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s", userUuid)
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+
+	cases := []struct {
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{"application/json", `{"name": "Jane Doe"}`, http.StatusUnsupportedMediaType, handlers.CodeMediaType},
+		{"application/merge-patch+json", `{"email": "not-an-email"}`, http.StatusUnprocessableEntity, handlers.CodeValidation},
+		{"application/merge-patch+json", `{"uuid": "x"}`, http.StatusUnprocessableEntity, handlers.CodePatchFailed},
+		{"application/json-patch+json", `[{"op": "test", "path": "/name", "value": "Nobody"}]`, http.StatusConflict, handlers.CodePatchTest},
+		{"application/json-patch+json", `{"op": "add"}`, http.StatusBadRequest, handlers.CodeMalformedBody},
+	}
+	for _, tc := range cases {
+		if tc.status != http.StatusUnsupportedMediaType {
+			mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+				WithArgs(userUuid).
+				WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "deleted_at", "email_verified_at"}).
+					AddRow(userUuid, "John Doe", "john.doe@example.com", 1, nil, nil))
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPatch, url, bytes.NewReader([]byte(tc.body)))
+		req.Header.Set("Content-Type", tc.contentType)
+		req.Header.Set("If-Match", `"1"`)
+		r.ServeHTTP(w, req)
+
+		var b handlers.Problem
+		assert.Equal(t, tc.status, w.Code, tc.body)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &b))
+		assert.Equal(t, tc.code, b.Code, tc.body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUserPreconditions(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	url := fmt.Sprintf("/users/%s", userUuid)
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	byteBody, _ := json.Marshal(ChReqBody{Name: "Jane Smith"})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(byteBody))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+
+	mock.ExpectQuery("UPDATE users SET name = $1, updated_at = $2, version = version + 1 WHERE uuid = $3 AND deleted_at IS NULL AND version = $4 RETURNING uuid, name, email, version, email_verified_at").
+		WithArgs("Jane Smith", sqlmock.AnyArg(), userUuid, 1).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+		WithArgs(userUuid).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "deleted_at", "email_verified_at"}).
+			AddRow(userUuid, "John Doe", "john.doe@example.com", 2, nil, nil))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPut, url, bytes.NewReader(byteBody))
+	req.Header.Set("If-Match", `"1"`)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+		WithArgs(userUuid).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "deleted_at", "email_verified_at"}).
+			AddRow(userUuid, "John Doe", "john.doe@example.com", 2, nil, nil))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("If-None-Match", `W/"1", "2"`)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateUserIdempotent(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+	byteBody, _ := json.Marshal(CrReqBody{Name: "Jane Smith", Email: "john.doe@example.com"})
+
+	mock.ExpectExec("DELETE FROM idempotency_keys WHERE expires_at < $1").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO idempotency_keys (client, key, request_hash, created_at, expires_at, locked_until) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (client, key) DO NOTHING").
+		WithArgs("", "retry-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO users (uuid, name, email, email_normalized, created_at) VALUES($1, $2, $3, $4, $5) RETURNING uuid, name, email, version").
+		WithArgs(sqlmock.AnyArg(), "Jane Smith", "john.doe@example.com", "john.doe@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version"}).
+			AddRow(userUuid, "Jane Smith", "john.doe@example.com", 1))
+	mock.ExpectExec("UPDATE idempotency_keys SET status = $1, headers = $2, body = $3, locked_until = NULL WHERE client = $4 AND key = $5").
+		WithArgs(http.StatusCreated, sqlmock.AnyArg(), sqlmock.AnyArg(), "", "retry-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(byteBody))
+	req.Header.Set("Idempotency-Key", "retry-1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	stored := w.Body.Bytes()
+
+	claimed := func(requestHash string) {
+		mock.ExpectExec("DELETE FROM idempotency_keys WHERE expires_at < $1").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO idempotency_keys (client, key, request_hash, created_at, expires_at, locked_until) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT (client, key) DO NOTHING").
+			WithArgs("", "retry-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`UPDATE idempotency_keys SET request_hash = $1, status = 0, headers = NULL, body = NULL, created_at = $5, expires_at = $6, locked_until = $2
+WHERE client = $3 AND key = $4 AND (expires_at < $5 OR status = 0 AND (locked_until IS NULL OR locked_until < $5))`).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "", "retry-1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT client, key, request_hash, status, headers, body FROM idempotency_keys WHERE client = $1 AND key = $2").
+			WithArgs("", "retry-1").
+			WillReturnRows(sqlmock.NewRows([]string{"client", "key", "request_hash", "status", "headers", "body"}).
+				AddRow("", "retry-1", requestHash, http.StatusCreated, `{"Content-Type":["application/json; charset=utf-8"],"Etag":["\"1\""]}`, stored))
+	}
+
+	sum := sha256.Sum256(append([]byte("POST /users\n"), byteBody...))
+	claimed(hex.EncodeToString(sum[:]))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewReader(byteBody))
+	req.Header.Set("Idempotency-Key", "retry-1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, string(stored), w.Body.String())
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+
+	claimed(hex.EncodeToString(sum[:]))
+	w = httptest.NewRecorder()
+	otherBody, _ := json.Marshal(CrReqBody{Name: "Someone Else", Email: "john.doe@example.com"})
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewReader(otherBody))
+	req.Header.Set("Idempotency-Key", "retry-1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIdempotencyKeysPerClient(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	r := router(&handlers.Handler{Storage: storage, Idempotency: storage, AdminToken: "secret"})
+	create := func(token string, email string) *httptest.ResponseRecorder {
+		byteBody, _ := json.Marshal(CrReqBody{Name: "Jane Smith", Email: email})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(byteBody))
+		req.Header.Set("Idempotency-Key", "retry-1")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := create("secret", "jane@example.com")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	w := create("", "jane@example.com")
+	assert.Equal(t, http.StatusConflict, w.Code, "another client's key isn't replayed")
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	w = create("secret", "jane@example.com")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), w.Body.String())
+}
+
+func TestIdempotencyKeyReleasedOnPanic(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	handler := &handlers.Handler{Idempotency: storage}
+	r := gin.New()
+	r.Use(logging.Recovery())
+	calls := 0
+	r.POST("/things", handler.Idempotent(), func(c *gin.Context) {
+		if calls++; calls == 1 {
+			panic("boom")
+		}
+		c.JSON(http.StatusCreated, gin.H{"calls": calls})
+	})
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/things", bytes.NewReader([]byte("{}")))
+		req.Header.Set("Idempotency-Key", "retry-1")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, post().Code)
+	start := time.Now()
+	w := post()
+	assert.Equal(t, http.StatusCreated, w.Code, "the retry runs instead of waiting for the key")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 2, calls)
+}
+
+// sweepCounter is an IdempotencyStore counting its claims and sweeps.
+type sweepCounter struct {
+	handlers.IdempotencyStore
+	claims, sweeps atomic.Int32
+}
+
+func (s *sweepCounter) ClaimIdempotencyKey(ctx context.Context, client string, key string, requestHash string, ttl time.Duration, lease time.Duration) (*db.IdempotencyRecord, error) {
+	s.claims.Add(1)
+	return s.IdempotencyStore.ClaimIdempotencyKey(ctx, client, key, requestHash, ttl, lease)
+}
+
+func (s *sweepCounter) DeleteExpiredIdempotencyKeys(ctx context.Context) error {
+	s.sweeps.Add(1)
+	return s.IdempotencyStore.DeleteExpiredIdempotencyKeys(ctx)
+}
+
+func TestIdempotencyWaitSweepsOnce(t *testing.T) {
+	t.Parallel()
+	store := &sweepCounter{IdempotencyStore: memory.NewStorage()}
+	handler := &handlers.Handler{Idempotency: store}
+	r := gin.New()
+	started, done := make(chan struct{}), make(chan struct{})
+	r.POST("/things", handler.Idempotent(), func(c *gin.Context) {
+		select {
+		case started <- struct{}{}:
+			<-done
+		default:
+		}
+		c.JSON(http.StatusCreated, gin.H{})
+	})
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/things", bytes.NewReader([]byte("{}")))
+		req.Header.Set("Idempotency-Key", "retry-1")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	go post()
+	<-started
+	time.AfterFunc(300*time.Millisecond, func() { close(done) })
+	w := post()
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Greater(t, store.claims.Load(), int32(3), "the duplicate polled")
+	assert.Equal(t, int32(2), store.sweeps.Load(), "expired keys are dropped once per request")
+}
+
+func TestGetUserRequestTimeout(t *testing.T) {
+	t.Parallel()
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").
+		WithArgs(userUuid).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "name", "email", "version", "deleted_at", "email_verified_at"}))
+	handler := handlers.NewHandler(db)
+	r := router(handler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("/users/%s", userUuid), nil)
+	start := time.Now()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestHealthz(t *testing.T) {
+	t.Parallel()
+	handler := &handlers.Handler{}
+	r := router(handler)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	t.Parallel()
+	migrated := true
+	handler := &handlers.Handler{
+		ReadyTimeout: 50 * time.Millisecond,
+		ReadyChecks: []handlers.ReadyCheck{
+			{Name: "db", Check: func(ctx context.Context) error {
+				return nil
+			}},
+			{Name: "migrations", Check: func(ctx context.Context) error {
+				if !migrated {
+					return fmt.Errorf("db is at version 1, want 2")
+				}
+				return nil
+			}},
+		},
+	}
+	r := router(handler)
+	readyz := func() (int, handlers.HealthResp) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		r.ServeHTTP(w, req)
+		var resp handlers.HealthResp
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, resp
+	}
+
+	code, resp := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, "ok", resp.Checks["db"].Status)
+	assert.Equal(t, "ok", resp.Checks["migrations"].Status)
+	assert.Equal(t, "ok", resp.Checks["draining"].Status)
+
+	migrated = false
+	code, resp = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", resp.Status)
+	assert.Equal(t, "ok", resp.Checks["db"].Status)
+	assert.Equal(t, "fail", resp.Checks["migrations"].Status)
+	assert.Equal(t, "db is at version 1, want 2", resp.Checks["migrations"].Error)
+
+	migrated = true
+	handler.Drain()
+	code, resp = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "fail", resp.Checks["draining"].Status)
+}
+
+func TestReadyzTimeout(t *testing.T) {
+	t.Parallel()
+	handler := &handlers.Handler{
+		ReadyTimeout: 20 * time.Millisecond,
+		ReadyChecks: []handlers.ReadyCheck{{Name: "db", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}},
+	}
+	r := router(handler)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	start := time.Now()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Contains(t, w.Body.String(), "deadline exceeded")
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	m := metrics.New()
+	storage := memory.NewStorage()
+	handler := &handlers.Handler{Storage: m.Storage(storage)}
+	r := router(handler, m.Middleware())
+	r.GET("/metrics", gin.WrapH(m.Handler()))
+
+	body, _ := json.Marshal(CrReqBody{Name: "John Doe", Email: "john.doe@example.com"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("/users/%s", uuid.New().String()), nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, series := range []string{
+		`users_http_requests_total{method="POST",route="/users",status="201"} 1`,
+		`users_http_requests_total{method="GET",route="/users/:uuid",status="404"} 2`,
+		`users_http_request_duration_seconds_count{method="GET",route="/users/:uuid",status="404"} 2`,
+		`users_storage_duration_seconds_count{method="GetUser"} 2`,
+		`users_storage_errors_total{kind="not_found",method="GetUser"} 2`,
+		`users_created_total 1`,
+	} {
+		assert.Contains(t, w.Body.String(), series)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	_, err := tracing.Setup(context.Background(), environment.Tracing{Exporter: "none"})
+	assert.NoError(t, err)
+
+	db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer db.Close()
+	userUuid := uuid.New().String()
+	mock.ExpectQuery("SELECT uuid, name, email, version, deleted_at, email_verified_at FROM users WHERE uuid = $1 AND deleted_at IS NULL").WithArgs(userUuid).WillReturnError(sql.ErrNoRows)
+	handler := handlers.NewHandler(db)
+	handler.Storage = tracing.Storage(handler.Storage)
+	r := router(handler, tracing.Middleware())
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/users/%s", userUuid), nil)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var problem handlers.Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, traceId, problem.TraceId)
+	assert.Contains(t, w.Header().Get("traceparent"), traceId)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceId {
+			spans[span.Name()] = span
+		}
+	}
+	server, storage, query := spans["GET /users/:uuid"], spans["storage.GetUser"], spans["SELECT users"]
+	if assert.NotNil(t, server) && assert.NotNil(t, storage) && assert.NotNil(t, query) {
+		assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+		assert.Equal(t, server.SpanContext().SpanID(), storage.Parent().SpanID())
+		assert.Equal(t, storage.SpanContext().SpanID(), query.Parent().SpanID())
+		assert.Contains(t, query.Attributes(), attribute.String("db.system.name", "postgresql"))
+		assert.Contains(t, query.Attributes(), attribute.String("db.collection.name", "users"))
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logging.New(environment.Log{Level: "info"}, &logs))
+
+	conn, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	defer conn.Close()
+	mock.ExpectQuery("INSERT INTO users (uuid, name, email, email_normalized, created_at) VALUES($1, $2, $3, $4, $5) RETURNING uuid, name, email, version").
+		WillReturnError(&pq.Error{Code: "XX000", Message: "could not store john.doe@example.com"})
+	handler := &handlers.Handler{Storage: memory.NewStorage()}
+	r := router(handler)
+
+	body, _ := json.Marshal(CrReqBody{Name: "John Doe", Email: "john.doe@example.com"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+	req.Header.Set("X-Request-ID", "req-1")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "req-1", w.Header().Get("X-Request-ID"))
+	var created handlers.UserResp
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	handler.Storage = handlers.NewHandler(conn).Storage
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+	req.Header.Set("X-Request-ID", "bad\nid")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	generated := w.Header().Get("X-Request-ID")
+	assert.NoError(t, uuid.Validate(generated))
+
+	assert.NotContains(t, logs.String(), "john.doe@example.com")
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record map[string]any
+		assert.NoError(t, json.Unmarshal(line, &record))
+		lines = append(lines, record)
+	}
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, "request", lines[0]["msg"])
+		assert.Equal(t, "req-1", lines[0]["request_id"])
+		assert.Equal(t, "/users", lines[0]["route"])
+		assert.Equal(t, float64(http.StatusCreated), lines[0]["status"])
+		assert.Equal(t, created.Uuid, lines[0]["user_uuid"])
+		assert.Contains(t, lines[0], "latency_ms")
+
+		assert.Equal(t, "storage error", lines[1]["msg"])
+		assert.Equal(t, "ERROR", lines[1]["level"])
+		assert.Equal(t, generated, lines[1]["request_id"])
+		assert.Equal(t, "pq: could not store [REDACTED]", lines[1]["cause"])
+
+		assert.Equal(t, "request", lines[2]["msg"])
+		assert.Equal(t, "ERROR", lines[2]["level"])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+	handler := &handlers.Handler{
+		Storage:        memory.NewStorage(),
+		RateLimitStore: ratelimit.NewMemoryStore(),
+		RateLimits: map[string]ratelimit.Limit{
+			handlers.RateLimitCreate: {Rate: 1.0 / 60, Burst: 2},
+		},
+		RateLimitKey: handlers.RateLimitByIP,
+	}
+	r := router(handler)
+	assert.NoError(t, r.SetTrustedProxies([]string{"10.0.0.1"}))
+
+	create := func(i int, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(CrReqBody{Name: "John Doe", Email: fmt.Sprintf("john.doe%d@example.com", i)})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := create(i, "192.0.2.1:1234", "")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, fmt.Sprint(1-i), w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "2;w=120", w.Header().Get("RateLimit-Policy"))
+	}
+	w := create(2, "192.0.2.1:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "120", w.Header().Get("RateLimit-Reset"))
+	var problem handlers.Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, handlers.CodeRateLimited, problem.Code)
+
+	// An untrusted client can't pick its address, a trusted proxy can.
+	w = create(3, "192.0.2.1:1234", "198.51.100.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	w = create(4, "10.0.0.1:1234", "198.51.100.1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	// Other route groups have their own budget.
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	handler := &handlers.Handler{Storage: storage, APIKeys: storage, AdminToken: "secret"}
+	r := router(handler)
+
+	secret, hash, err := auth.NewAPIKey()
+	assert.NoError(t, err)
+	key, err := storage.AddAPIKey(context.Background(), db.APIKey{Name: "reader", Prefix: auth.KeyPrefix(secret), Hash: hash, Scopes: []string{auth.ScopeRead}})
+	assert.NoError(t, err)
+
+	do := func(method string, url string, token string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	body, _ := json.Marshal(CrReqBody{Name: "John Doe", Email: "john.doe@example.com"})
+
+	w := do(http.MethodGet, "/users", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	w = do(http.MethodGet, "/users", "usk_forged", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	w = do(http.MethodGet, "/users", secret, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	keys, _ := storage.ListAPIKeys(context.Background())
+	assert.NotNil(t, keys[0].LastUsedAt, "last use is recorded")
+
+	w = do(http.MethodPost, "/users", secret, body)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var problem handlers.Problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, handlers.CodeForbidden, problem.Code)
+
+	w = do(http.MethodPost, "/users", "secret", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = do(http.MethodGet, "/healthz", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.NoError(t, storage.RevokeAPIKey(context.Background(), key.Id))
+	w = do(http.MethodGet, "/users", secret, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// tokens is a TokenVerifier that knows a fixed set of tokens.
+type tokens map[string]*auth.Principal
+
+func (t tokens) Verify(_ context.Context, token string) (*auth.Principal, error) {
+	if p, ok := t[token]; ok {
+		return p, nil
+	}
+	return nil, auth.ErrInvalidToken
+}
+
+func TestJWTSelfPolicy(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	self, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	other, err := storage.AddUser(context.Background(), "Jane Doe", "jane.doe@example.com")
+	assert.NoError(t, err)
+	handler := &handlers.Handler{Storage: storage, Tokens: tokens{
+		"h.self.s":   {Subject: self.Uuid},
+		"h.reader.s": {Subject: uuid.New().String(), Scopes: []string{auth.ScopeRead}},
+	}}
+	r := router(handler)
+
+	do := func(method string, url string, token string, body []byte) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", "*")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	body, _ := json.Marshal(ChReqBody{Name: "Johnny"})
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/users/"+self.Uuid, "h.self.s", nil))
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/users/"+self.Uuid, "h.self.s", body))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/users/"+other.Uuid, "h.self.s", nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/users/"+other.Uuid, "h.self.s", body))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/users", "h.self.s", nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/users/"+self.Uuid, "h.self.s", nil))
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/users/"+other.Uuid, "h.reader.s", nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/users/"+other.Uuid, "h.reader.s", body))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/users/"+self.Uuid, "h.forged.s", nil))
+
+	user, _ := storage.GetUser(context.Background(), self.Uuid, false)
+	assert.Equal(t, "Johnny", user.Name)
+}
+
+func TestPasswordLogin(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	handler := &handlers.Handler{
+		Storage:         storage,
+		Credentials:     storage,
+		Passwords:       &auth.Passwords{Params: auth.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}, MinLength: 8},
+		MaxFailedLogins: 3,
+		Tokens: tokens{
+			"h.self.s": {Subject: user.Uuid, SessionId: "session-1"},
+			"h.jwt.s":  {Subject: user.Uuid},
+		},
+		AdminToken: "secret",
+	}
+	r := router(handler)
+
+	do := func(method string, url string, token string, body any) (int, handlers.Problem) {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		var problem handlers.Problem
+		_ = json.Unmarshal(w.Body.Bytes(), &problem)
+		return w.Code, problem
+	}
+	login := func(email string, password string) (int, handlers.Problem) {
+		return do(http.MethodPost, "/auth/login", "", handlers.LoginReq{Email: email, Password: password})
+	}
+	passwordUrl := "/users/" + user.Uuid + "/password"
+
+	// Anyone who can get a JWT naming the user could otherwise set the
+	// first password.
+	code, problem := do(http.MethodPost, passwordUrl, "h.jwt.s", handlers.SetPasswordReq{Password: "first password"})
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, handlers.CodeForbidden, problem.Code)
+
+	code, problem = do(http.MethodPost, passwordUrl, "secret", handlers.SetPasswordReq{Password: "short"})
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, handlers.CodeWeakPassword, problem.Code)
+	code, _ = do(http.MethodPost, passwordUrl, "secret", handlers.SetPasswordReq{Password: "first password"})
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = login("John.Doe@example.com", "first password")
+	assert.Equal(t, http.StatusOK, code)
+	code, wrong := login("john.doe@example.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, unknown := login("nobody@example.com", "first password")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, wrong.Detail, unknown.Detail, "unknown emails look like wrong passwords")
+
+	// Users changing their own password must know the current one.
+	code, problem = do(http.MethodPost, passwordUrl, "h.self.s", handlers.SetPasswordReq{CurrentPassword: "guess", Password: "second password"})
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, handlers.CodeInvalidCredentials, problem.Code)
+	code, _ = do(http.MethodPost, passwordUrl, "h.self.s", handlers.SetPasswordReq{CurrentPassword: "first password", Password: "second password"})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = login("john.doe@example.com", "second password")
+	assert.Equal(t, http.StatusOK, code)
+
+	// The third failure in a row locks the account, even for the right password.
+	for i := 0; i < 3; i++ {
+		code, _ = login("john.doe@example.com", "wrong password")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	code, problem = login("john.doe@example.com", "second password")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, wrong.Detail, problem.Detail)
+	creds, _ := storage.GetCredentials(context.Background(), user.Uuid)
+	assert.NotNil(t, creds.LockedUntil)
+
+	// Setting a password lifts the lock.
+	code, _ = do(http.MethodPost, passwordUrl, "secret", handlers.SetPasswordReq{Password: "third password"})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = login("john.doe@example.com", "third password")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestPasswordRehash(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	weak := &auth.Passwords{Params: auth.Argon2Params{Memory: 32, Iterations: 1, Parallelism: 1}}
+	hash, _ := weak.Hash("my password")
+	assert.NoError(t, storage.SetPassword(context.Background(), user.Uuid, hash))
+
+	passwords := &auth.Passwords{Params: auth.Argon2Params{Memory: 64, Iterations: 2, Parallelism: 1}, MinLength: 8}
+	r := router(&handlers.Handler{Storage: storage, Credentials: storage, Passwords: passwords})
+	body, _ := json.Marshal(handlers.LoginReq{Email: "john.doe@example.com", Password: "my password"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	creds, _ := storage.GetCredentials(context.Background(), user.Uuid)
+	assert.NotEqual(t, hash, creds.PasswordHash)
+	ok, rehash := passwords.Verify("my password", creds.PasswordHash)
+	assert.True(t, ok)
+	assert.False(t, rehash, "hash was upgraded on login")
+}
+
+func TestSessions(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	other, err := storage.AddUser(context.Background(), "Jane Doe", "jane.doe@example.com")
+	assert.NoError(t, err)
+	passwords := &auth.Passwords{Params: auth.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}, MinLength: 8}
+	hash, _ := passwords.Hash("my password")
+	assert.NoError(t, storage.SetPassword(context.Background(), user.Uuid, hash))
+	key, _ := auth.NewSigningKey()
+	r := router(&handlers.Handler{
+		Storage:      storage,
+		Credentials:  storage,
+		Passwords:    passwords,
+		Sessions:     storage,
+		AccessTokens: auth.NewAccessTokens(key, time.Minute, storage),
+		Tokens:       tokens{"h.jwt.s": {Subject: user.Uuid}},
+		APIKeys:      storage,
+	})
+
+	do := func(method string, url string, token string, body any, resp any) int {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		req.Header.Set("User-Agent", "test-agent")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		if resp != nil {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		}
+		return w.Code
+	}
+	login := func(device string) handlers.LoginResp {
+		var resp handlers.LoginResp
+		code := do(http.MethodPost, "/auth/login", "", handlers.LoginReq{Email: "john.doe@example.com", Password: "my password", Device: device}, &resp)
+		assert.Equal(t, http.StatusOK, code)
+		return resp
+	}
+	sessionsUrl := "/users/" + user.Uuid + "/sessions"
+
+	laptop := login("laptop")
+	assert.Equal(t, "Bearer", laptop.TokenType)
+	assert.Equal(t, 60, laptop.ExpiresIn)
+	assert.NotEmpty(t, laptop.RefreshToken)
+	phone := login("phone")
+
+	// Access tokens let users at their own record only.
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/users/"+user.Uuid, laptop.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/users/"+other.Uuid, laptop.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/users/"+user.Uuid, "h.jwt.s", nil, nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, sessionsUrl, "h.jwt.s", nil, nil),
+		"other issuers' tokens don't reach the sessions")
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/users/"+other.Uuid+"/sessions", laptop.AccessToken, nil, nil))
+
+	var sessions handlers.SessionsResp
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, sessionsUrl, laptop.AccessToken, nil, &sessions))
+	assert.Len(t, sessions.Sessions, 2)
+	for _, s := range sessions.Sessions {
+		assert.Equal(t, s.Id == laptop.SessionId, s.Current)
+		assert.Equal(t, "test-agent", s.UserAgent)
+	}
+
+	// Refresh tokens rotate; replaying one revokes its session.
+	var refreshed handlers.TokenResp
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/auth/refresh", "", handlers.RefreshReq{RefreshToken: laptop.RefreshToken}, &refreshed))
+	assert.Equal(t, laptop.SessionId, refreshed.SessionId)
+	assert.NotEqual(t, laptop.RefreshToken, refreshed.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/auth/refresh", "", handlers.RefreshReq{RefreshToken: laptop.RefreshToken}, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/auth/refresh", "", handlers.RefreshReq{RefreshToken: refreshed.RefreshToken}, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/users/"+user.Uuid, refreshed.AccessToken, nil, nil),
+		"access tokens end with their session")
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, sessionsUrl, phone.AccessToken, nil, &sessions))
+	assert.Len(t, sessions.Sessions, 1)
+	assert.Equal(t, "phone", sessions.Sessions[0].Device)
+
+	tablet := login("tablet")
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, sessionsUrl+"/"+phone.SessionId, phone.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/users/"+user.Uuid, phone.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, sessionsUrl+"/"+phone.SessionId, tablet.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/auth/refresh", "", handlers.RefreshReq{RefreshToken: phone.RefreshToken}, nil))
+
+	login("desktop")
+	var msg handlers.MessageResp
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, sessionsUrl, tablet.AccessToken, nil, &msg))
+	assert.Equal(t, "2 sessions revoked", msg.Message)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/users/"+user.Uuid, tablet.AccessToken, nil, nil))
+
+	// Changing the password ends every other session.
+	laptop, phone = login("laptop"), login("phone")
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/users/"+user.Uuid+"/password", laptop.AccessToken,
+		handlers.SetPasswordReq{CurrentPassword: "my password", Password: "new password"}, nil))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/users/"+user.Uuid, laptop.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/users/"+user.Uuid, phone.AccessToken, nil, nil))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/auth/refresh", "", handlers.RefreshReq{RefreshToken: phone.RefreshToken}, nil))
+}
+
+// outbox is a Mailer keeping what it's sent.
+type outbox []mail.Message
+
+func (o *outbox) Send(_ context.Context, msg mail.Message) error {
+	*o = append(*o, msg)
+	return nil
+}
+
+// token returns the token in the link of the last message sent to to.
+func (o *outbox) token(t *testing.T, to string) string {
+	for i := len(*o) - 1; i >= 0; i-- {
+		if (*o)[i].To == to {
+			m := regexp.MustCompile(`\?token=(\S+)`).FindStringSubmatch((*o)[i].Body)
+			if assert.NotNil(t, m, "no link in %q", (*o)[i].Body) {
+				token, err := url.QueryUnescape(m[1])
+				assert.NoError(t, err)
+				return token
+			}
+			return ""
+		}
+	}
+	t.Errorf("nothing sent to %s", to)
+	return ""
+}
+
+func TestEmailVerification(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	key, _ := auth.NewSigningKey()
+	sent := &outbox{}
+	verification := &flakyVerification{VerificationStore: storage}
+	r := router(&handlers.Handler{
+		Storage:      storage,
+		Mailer:       sent,
+		EmailTokens:  auth.NewEmailTokens(key),
+		Verification: verification,
+		LinkURL:      "https://app.example.com/",
+	})
+
+	do := func(method string, url string, body any, resp any) int {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		r.ServeHTTP(w, req)
+		if resp != nil {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		}
+		return w.Code
+	}
+	listed := func(verified bool) int {
+		var list handlers.UserListResp
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, fmt.Sprintf("/users?verified=%t", verified), nil, &list))
+		return len(list.Users)
+	}
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/users/"+user.Uuid+"/verification", nil, nil))
+	assert.Len(t, *sent, 1)
+	assert.Contains(t, (*sent)[0].Body, "https://app.example.com/verify?token=")
+	token := sent.token(t, "john.doe@example.com")
+	assert.Equal(t, 0, listed(true))
+	assert.Equal(t, 1, listed(false))
+
+	var problem handlers.Problem
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verify", handlers.VerifyReq{Token: token + "x"}, &problem))
+	assert.Equal(t, handlers.CodeInvalidToken, problem.Code)
+
+	// A storage failure doesn't use the token up.
+	verification.down = true
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/verify", handlers.VerifyReq{Token: token}, nil))
+	verification.down = false
+
+	var resp handlers.UserResp
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/verify", handlers.VerifyReq{Token: token}, &resp))
+	assert.NotNil(t, resp.EmailVerifiedAt)
+	assert.Equal(t, 1, listed(true))
+	assert.Equal(t, 0, listed(false))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verify", handlers.VerifyReq{Token: token}, &problem), "tokens work once")
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/users/"+user.Uuid+"/verification", nil, &problem))
+	assert.Equal(t, handlers.CodeAlreadyVerified, problem.Code)
+
+	// A token for an email the user no longer has is worthless.
+	email := "john@example.com"
+	_, err = storage.UpdateUser(context.Background(), user.Uuid, db.UserChanges{Email: &email}, db.AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/users/"+user.Uuid+"/verification", nil, nil))
+	stale := sent.token(t, "john@example.com")
+	email = "johnny@example.com"
+	_, err = storage.UpdateUser(context.Background(), user.Uuid, db.UserChanges{Email: &email}, db.AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/verify", handlers.VerifyReq{Token: stale}, nil))
+	assert.Equal(t, 1, listed(false))
+}
+
+// flakyVerification is a VerificationStore that is unavailable while down.
+type flakyVerification struct {
+	handlers.VerificationStore
+	down bool
+}
+
+func (f *flakyVerification) VerifyEmail(ctx context.Context, uuid string, email string, token db.UsedToken) (*db.User, error) {
+	if f.down {
+		return nil, &db.Error{Kind: db.ErrUnavailable, Msg: "storage unavailable"}
+	}
+	return f.VerificationStore.VerifyEmail(ctx, uuid, email, token)
+}
+
+func TestEmailVerificationDisabled(t *testing.T) {
+	t.Parallel()
+	r := router(&handlers.Handler{Storage: memory.NewStorage()})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/verify", bytes.NewReader([]byte(`{"token":"x"}`)))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEmailChange(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	_, err = storage.AddUser(context.Background(), "Jane Doe", "jane.doe@example.com")
+	assert.NoError(t, err)
+	_, err = storage.AddSession(context.Background(), db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, "hash")
+	assert.NoError(t, err)
+	key, _ := auth.NewSigningKey()
+	sent := &outbox{}
+	r := router(&handlers.Handler{
+		Storage: storage,
+		Tokens: tokens{
+			"h.self.s":  {Subject: user.Uuid, SessionId: "session-1"},
+			"h.jwt.s":   {Subject: user.Uuid},
+			"h.admin.s": {Subject: uuid.New().String(), Scopes: auth.Scopes},
+		},
+		Sessions:     storage,
+		Mailer:       sent,
+		EmailTokens:  auth.NewEmailTokens(key),
+		Verification: storage,
+		EmailChanges: storage,
+		LinkURL:      "https://app.example.com",
+	})
+
+	do := func(method string, url string, token string, body any, resp any) int {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", handlers.MergePatchContentType)
+		req.Header.Set("If-Match", "*")
+		r.ServeHTTP(w, req)
+		if resp != nil {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		}
+		return w.Code
+	}
+	emailUrl := "/users/" + user.Uuid + "/email"
+	email := func() string {
+		got, _ := storage.GetUser(context.Background(), user.Uuid, false)
+		return got.Email
+	}
+
+	var problem handlers.Problem
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, emailUrl, "h.jwt.s", handlers.ChangeEmailReq{Email: "john@example.com"}, nil),
+		"only the user's own sessions may change their email")
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, emailUrl, "h.self.s", handlers.ChangeEmailReq{Email: "Jane.Doe@example.com"}, &problem))
+	assert.Equal(t, handlers.CodeEmailTaken, problem.Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, emailUrl, "h.self.s", handlers.ChangeEmailReq{Email: "john.doe@example.com"}, nil))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPatch, "/users/"+user.Uuid, "h.self.s", map[string]string{"email": "john@example.com"}, &problem),
+		"users confirm their own email changes")
+	assert.Empty(t, *sent)
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, emailUrl, "h.self.s", handlers.ChangeEmailReq{Email: "john@example.com"}, nil))
+	assert.Len(t, *sent, 2)
+	assert.Contains(t, (*sent)[0].Body, "https://app.example.com/email/revert?token=")
+	assert.Contains(t, (*sent)[1].Body, "https://app.example.com/email/confirm?token=")
+	confirm, revert := sent.token(t, "john@example.com"), sent.token(t, "john.doe@example.com")
+	assert.Equal(t, "john.doe@example.com", email(), "nothing changes until confirmed")
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/email/confirm", "", handlers.VerifyReq{Token: revert}, nil))
+
+	var resp handlers.UserResp
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/email/confirm", "", handlers.VerifyReq{Token: confirm}, &resp))
+	assert.Equal(t, "john@example.com", *resp.Email)
+	assert.NotNil(t, resp.EmailVerifiedAt)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/email/confirm", "", handlers.VerifyReq{Token: confirm}, nil), "tokens work once")
+	sessions, _ := storage.ListSessions(context.Background(), user.Uuid)
+	assert.Len(t, sessions, 1)
+
+	// The former owner of the email takes it back, signing everyone out.
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/email/revert", "", handlers.VerifyReq{Token: revert}, &resp))
+	assert.Equal(t, "john.doe@example.com", *resp.Email)
+	assert.Equal(t, "john.doe@example.com", email())
+	sessions, _ = storage.ListSessions(context.Background(), user.Uuid)
+	assert.Empty(t, sessions)
+
+	// Admins may still set emails directly.
+	assert.Equal(t, http.StatusOK, do(http.MethodPatch, "/users/"+user.Uuid, "h.admin.s", map[string]string{"email": "johnny@example.com"}, nil))
+	assert.Equal(t, "johnny@example.com", email())
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	user, err := storage.AddUser(context.Background(), "John Doe", "john.doe@example.com")
+	assert.NoError(t, err)
+	passwords := &auth.Passwords{Params: auth.Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}, MinLength: 8}
+	hash, _ := passwords.Hash("old password")
+	assert.NoError(t, storage.SetPassword(context.Background(), user.Uuid, hash))
+	_, err = storage.AddSession(context.Background(), db.Session{UserUuid: user.Uuid, ExpiresAt: time.Now().Add(time.Hour)}, "hash")
+	assert.NoError(t, err)
+	outbox := &mail.Dir{Path: t.TempDir(), From: "no-reply@example.com"}
+	h := &handlers.Handler{
+		Storage:        storage,
+		Credentials:    storage,
+		Passwords:      passwords,
+		Sessions:       storage,
+		Mailer:         outbox,
+		PasswordResets: storage,
+		LinkURL:        "https://app.example.com",
+	}
+	r := router(h)
+
+	do := func(url string, body any, resp any) int {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		r.ServeHTTP(w, req)
+		if resp != nil {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		}
+		return w.Code
+	}
+	// sent returns the tokens emailed so far, oldest first.
+	sent := func() []string {
+		assert.NoError(t, h.WaitMail(context.Background()))
+		entries, err := os.ReadDir(outbox.Path)
+		assert.NoError(t, err)
+		var tokens []string
+		for _, e := range entries {
+			b, err := os.ReadFile(filepath.Join(outbox.Path, e.Name()))
+			assert.NoError(t, err)
+			assert.Contains(t, string(b), "To: john.doe@example.com\r\n")
+			if m := regexp.MustCompile(`password-reset\?token=(\S+)`).FindSubmatch(b); assert.NotNil(t, m) {
+				token, _ := url.QueryUnescape(string(m[1]))
+				tokens = append(tokens, token)
+			}
+		}
+		return tokens
+	}
+
+	// Unknown emails get the same answer, and no email.
+	var unknown, known handlers.MessageResp
+	assert.Equal(t, http.StatusAccepted, do("/auth/password-reset", handlers.PasswordResetReq{Email: "jane.doe@example.com"}, &unknown))
+	assert.Empty(t, sent())
+	assert.Equal(t, http.StatusAccepted, do("/auth/password-reset", handlers.PasswordResetReq{Email: "John.Doe@example.com"}, &known))
+	assert.Equal(t, unknown, known)
+	assert.Len(t, sent(), 1)
+	assert.Equal(t, http.StatusAccepted, do("/auth/password-reset", handlers.PasswordResetReq{Email: "john.doe@example.com"}, nil))
+	tokens := sent()
+	assert.Len(t, tokens, 2)
+
+	var problem handlers.Problem
+	assert.Equal(t, http.StatusBadRequest, do("/auth/password-reset/confirm", handlers.ConfirmPasswordResetReq{Token: tokens[0], Password: "new password"}, &problem),
+		"a newer token replaces older ones")
+	assert.Equal(t, handlers.CodeInvalidToken, problem.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, do("/auth/password-reset/confirm", handlers.ConfirmPasswordResetReq{Token: tokens[1], Password: "short"}, nil))
+	assert.Equal(t, http.StatusOK, do("/auth/password-reset/confirm", handlers.ConfirmPasswordResetReq{Token: tokens[1], Password: "new password"}, nil),
+		"weak passwords don't use the token up")
+	assert.Equal(t, http.StatusBadRequest, do("/auth/password-reset/confirm", handlers.ConfirmPasswordResetReq{Token: tokens[1], Password: "newer password"}, nil),
+		"tokens work once")
+
+	sessions, _ := storage.ListSessions(context.Background(), user.Uuid)
+	assert.Empty(t, sessions)
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/login", handlers.LoginReq{Email: "john.doe@example.com", Password: "old password"}, nil))
+	assert.Equal(t, http.StatusOK, do("/auth/login", handlers.LoginReq{Email: "john.doe@example.com", Password: "new password"}, nil))
+}
+
+func TestRateLimitIgnoresMadeUpKeys(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	r := router(&handlers.Handler{
+		Storage:        storage,
+		Credentials:    storage,
+		APIKeys:        storage,
+		RateLimitStore: ratelimit.NewMemoryStore(),
+		RateLimits: map[string]ratelimit.Limit{
+			handlers.RateLimitLogin: {Rate: 1.0 / 60, Burst: 2},
+		},
+		RateLimitKey: handlers.RateLimitByAPIKey,
+	})
+
+	// A fresh bearer value per attempt must not buy a fresh bucket.
+	for i := 0; i < 3; i++ {
+		body, _ := json.Marshal(handlers.LoginReq{Email: "john.doe@example.com", Password: "guess" + fmt.Sprint(i)})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/auth/login", bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer usk_"+uuid.New().String())
+		r.ServeHTTP(w, req)
+		if i < 2 {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		}
+	}
+}
+
+func TestRateLimitInvalidKeys(t *testing.T) {
+	t.Parallel()
+	storage := memory.NewStorage()
+	r := router(&handlers.Handler{
+		Storage:        storage,
+		APIKeys:        storage,
+		RateLimitStore: ratelimit.NewMemoryStore(),
+		RateLimits: map[string]ratelimit.Limit{
+			handlers.RateLimitLogin: {Rate: 1.0 / 60, Burst: 2},
+		},
+	})
+
+	// Bad credentials never reach the limits of the routes, so they are
+	// charged to the login limit of the IP.
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer usk_"+uuid.New().String())
+		r.ServeHTTP(w, req)
+		if i < 2 {
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+		} else {
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			assert.NotEmpty(t, w.Header().Get("Retry-After"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/users", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	req.Header.Set("Authorization", "Bearer usk_"+uuid.New().String())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "other IPs have their own budget")
+}
+
+func TestReadyChecksMigrations(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	conn, err := db.Open(db.SQLite, ":memory:")
+	assert.NoError(t, err)
+	defer conn.Close()
+	checks, err := readyChecks(conn, db.SQLite)
+	assert.NoError(t, err)
+	migrations := checks[1].Check
+
+	assert.ErrorContains(t, migrations(ctx), "db is at version 0")
+
+	migrator, err := db.NewMigrator(conn, db.SQLite)
+	assert.NoError(t, err)
+	_, err = migrator.Up(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, migrations(ctx))
+
+	// A newer release has migrated past this binary.
+	_, err = conn.Exec("INSERT INTO goose_db_version (version_id, is_applied) VALUES (99991231000000, 1)")
+	assert.NoError(t, err)
+	assert.NoError(t, migrations(ctx))
+}
+
+// TestDockerfileBuild runs the go build command of the Dockerfile, so the
+// image keeps building when files are added to the package.
+func TestDockerfileBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the binary")
+	}
+	dockerfile, err := os.ReadFile("Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args []string
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		if cmd, ok := strings.CutPrefix(line, "RUN CGO_ENABLED=0 go build "); ok {
+			args = strings.Fields(cmd)
+		}
+	}
+	if len(args) == 0 {
+		t.Fatal("Dockerfile has no RUN CGO_ENABLED=0 go build line")
+	}
+	for i := range args {
+		if args[i] == "-o" && i+1 < len(args) {
+			args[i+1] = filepath.Join(t.TempDir(), args[i+1])
+		}
+	}
+	cmd := exec.Command("go", append([]string{"build"}, args...)...)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+}
@@ -0,0 +1,117 @@
+// Package metrics exposes Prometheus metrics of the HTTP server, the
+// database pool and the storage.
+package metrics
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "users"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	usersCreated  prometheus.Counter
+	usersUpdated  prometheus.Counter
+	usersDeleted  *prometheus.CounterVec
+	usersRestored prometheus.Counter
+}
+
+// New registers the metrics, along with the Go runtime and process ones, in
+// a registry of their own.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route template, method and status.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route template, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_duration_seconds",
+			Help:      "Storage call latency by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_errors_total",
+			Help:      "Failed storage calls by method and error kind.",
+		}, []string{"method", "kind"}),
+		usersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "created_total",
+			Help:      "Users created.",
+		}),
+		usersUpdated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "updated_total",
+			Help:      "Users updated.",
+		}),
+		usersDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deleted_total",
+			Help:      "Users deleted, soft or hard.",
+		}, []string{"mode"}),
+		usersRestored: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "restored_total",
+			Help:      "Soft-deleted users restored.",
+		}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.storageDuration, m.storageErrors,
+		m.usersCreated, m.usersUpdated, m.usersDeleted, m.usersRestored,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// RegisterDB exports the pool statistics of conn, sql.DB.Stats, as gauges.
+func (m *Metrics) RegisterDB(conn *sql.DB, name string) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(conn, name))
+}
+
+// Middleware counts and times requests. They are labelled by route template
+// rather than path, so /users/:uuid is one series whatever the uuid;
+// requests matching no route share the "unmatched" one.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.httpRequests.WithLabelValues(route, c.Request.Method, status).Inc()
+		m.httpDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"time"
+	"user-service/db"
+	"user-service/handlers"
+)
+
+// Storage wraps next to time every call, count failures by kind and count
+// the changes made to users.
+func (m *Metrics) Storage(next handlers.Storage) handlers.Storage {
+	return &storage{next: next, m: m}
+}
+
+type storage struct {
+	next handlers.Storage
+	m    *Metrics
+}
+
+func (s *storage) observe(method string, start time.Time, err error) {
+	s.m.storageDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.m.storageErrors.WithLabelValues(method, db.KindName(err)).Inc()
+	}
+}
+
+func (s *storage) AddUser(ctx context.Context, name string, email string) (user *db.User, err error) {
+	defer func(start time.Time) { s.observe("AddUser", start, err) }(time.Now())
+	user, err = s.next.AddUser(ctx, name, email)
+	if err == nil {
+		s.m.usersCreated.Inc()
+	}
+	return user, err
+}
+
+func (s *storage) GetUser(ctx context.Context, uuid string, withDeleted bool) (user *db.User, err error) {
+	defer func(start time.Time) { s.observe("GetUser", start, err) }(time.Now())
+	return s.next.GetUser(ctx, uuid, withDeleted)
+}
+
+func (s *storage) UpdateUser(ctx context.Context, uuid string, changes db.UserChanges, version int) (user *db.User, err error) {
+	defer func(start time.Time) { s.observe("UpdateUser", start, err) }(time.Now())
+	user, err = s.next.UpdateUser(ctx, uuid, changes, version)
+	if err == nil && (changes.Name != nil || changes.Email != nil) {
+		s.m.usersUpdated.Inc()
+	}
+	return user, err
+}
+
+func (s *storage) DeleteUser(ctx context.Context, uuid string, hard bool, version int) (err error) {
+	defer func(start time.Time) { s.observe("DeleteUser", start, err) }(time.Now())
+	err = s.next.DeleteUser(ctx, uuid, hard, version)
+	if err == nil {
+		mode := "soft"
+		if hard {
+			mode = "hard"
+		}
+		s.m.usersDeleted.WithLabelValues(mode).Inc()
+	}
+	return err
+}
+
+func (s *storage) RestoreUser(ctx context.Context, uuid string) (user *db.User, err error) {
+	defer func(start time.Time) { s.observe("RestoreUser", start, err) }(time.Now())
+	user, err = s.next.RestoreUser(ctx, uuid)
+	if err == nil {
+		s.m.usersRestored.Inc()
+	}
+	return user, err
+}
+
+func (s *storage) ListUsers(ctx context.Context, filter db.UserFilter) (page *db.UserPage, err error) {
+	defer func(start time.Time) { s.observe("ListUsers", start, err) }(time.Now())
+	return s.next.ListUsers(ctx, filter)
+}
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The default rules only; `migrate up` redoes this with the configured ones.
+ALTER TABLE users ADD COLUMN email_normalized VARCHAR(100);
+UPDATE users SET email_normalized = LOWER(TRIM(email));
+ALTER TABLE users ALTER COLUMN email_normalized SET NOT NULL;
+DO $$
+DECLARE
+    dups TEXT;
+BEGIN
+    SELECT string_agg(email_normalized || ' (' || uuids || ')', '; ' ORDER BY email_normalized) INTO dups
+    FROM (SELECT email_normalized, string_agg(uuid::TEXT, ', ' ORDER BY uuid) AS uuids
+          FROM users GROUP BY email_normalized HAVING COUNT(*) > 1) d;
+    IF dups IS NOT NULL THEN
+        RAISE EXCEPTION 'emails shared by several users, change them before migrating: %', dups;
+    END IF;
+END $$;
+CREATE UNIQUE INDEX users_email_normalized_key ON users (email_normalized);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_email_normalized_key;
+ALTER TABLE users DROP COLUMN IF EXISTS email_normalized;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE idempotency_keys
+(
+    key          VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64)  NOT NULL,
+    status       INTEGER      NOT NULL DEFAULT 0,
+    headers      TEXT,
+    body         BYTEA,
+    created_at   TIMESTAMP(3) NOT NULL,
+    expires_at   TIMESTAMP(3) NOT NULL
+);
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS idempotency_keys;
+-- +goose StatementEnd
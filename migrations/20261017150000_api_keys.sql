@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE api_keys
+(
+    id           UUID PRIMARY KEY,
+    name         VARCHAR(100) NOT NULL,
+    prefix       VARCHAR(16)  NOT NULL,
+    key_hash     VARCHAR(64)  NOT NULL UNIQUE,
+    scopes       TEXT         NOT NULL,
+    created_at   TIMESTAMP(3) NOT NULL,
+    last_used_at TIMESTAMP(3),
+    revoked_at   TIMESTAMP(3)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS api_keys;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE sessions
+(
+    id           UUID PRIMARY KEY,
+    user_uuid    UUID         NOT NULL REFERENCES users (uuid) ON DELETE CASCADE,
+    refresh_hash VARCHAR(64)  NOT NULL UNIQUE,
+    device       VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent   VARCHAR(255) NOT NULL DEFAULT '',
+    ip           VARCHAR(45)  NOT NULL DEFAULT '',
+    created_at   TIMESTAMP(3) NOT NULL,
+    last_used_at TIMESTAMP(3) NOT NULL,
+    expires_at   TIMESTAMP(3) NOT NULL,
+    revoked_at   TIMESTAMP(3)
+);
+CREATE INDEX sessions_user_uuid_idx ON sessions (user_uuid);
+CREATE TABLE rotated_refresh_tokens
+(
+    hash       VARCHAR(64)  PRIMARY KEY,
+    session_id UUID         NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    rotated_at TIMESTAMP(3) NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS rotated_refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+-- +goose StatementEnd
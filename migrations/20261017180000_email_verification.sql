@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP(3);
+CREATE TABLE used_tokens
+(
+    id         VARCHAR(64)  PRIMARY KEY,
+    expires_at TIMESTAMP(3) NOT NULL
+);
+CREATE INDEX used_tokens_expires_at_idx ON used_tokens (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS used_tokens;
+ALTER TABLE users DROP COLUMN email_verified_at;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE password_resets
+(
+    user_uuid  UUID PRIMARY KEY REFERENCES users (uuid) ON DELETE CASCADE,
+    token_hash VARCHAR(64)  NOT NULL UNIQUE,
+    created_at TIMESTAMP(3) NOT NULL,
+    expires_at TIMESTAMP(3) NOT NULL
+);
+CREATE INDEX password_resets_expires_at_idx ON password_resets (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS password_resets;
+-- +goose StatementEnd
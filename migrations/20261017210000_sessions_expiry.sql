@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
+CREATE INDEX rotated_refresh_tokens_session_id_idx ON rotated_refresh_tokens (session_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS rotated_refresh_tokens_session_id_idx;
+DROP INDEX IF EXISTS sessions_expires_at_idx;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Existing keys were stored for no client in particular, so nobody's requests
+-- find them any more and they expire unused.
+ALTER TABLE idempotency_keys ADD COLUMN client VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys ADD COLUMN locked_until TIMESTAMP(3);
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (client, key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM idempotency_keys WHERE client <> '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key);
+ALTER TABLE idempotency_keys DROP COLUMN locked_until;
+ALTER TABLE idempotency_keys DROP COLUMN client;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+// Package migrations embeds the SQL migrations so the service binary can
+// apply them itself.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed *.sql
+var postgres embed.FS
+
+//go:embed sqlite/*.sql
+var sqlite embed.FS
+
+// Postgres holds the migrations of the Postgres schema.
+var Postgres fs.FS = postgres
+
+// SQLite holds the migrations of the SQLite schema.
+var SQLite fs.FS
+
+func init() {
+	var err error
+	SQLite, err = fs.Sub(sqlite, "sqlite")
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE users
+(
+    uuid             TEXT PRIMARY KEY,
+    name             VARCHAR(100) NOT NULL,
+    email            VARCHAR(100) NOT NULL,
+    email_normalized VARCHAR(100) NOT NULL,
+    version          INTEGER      NOT NULL DEFAULT 1,
+    created_at       TIMESTAMP    NOT NULL,
+    updated_at       TIMESTAMP,
+    deleted_at       TIMESTAMP
+);
+CREATE UNIQUE INDEX users_email_normalized_key ON users (email_normalized);
+
+CREATE TABLE idempotency_keys
+(
+    key          VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64)  NOT NULL,
+    status       INTEGER      NOT NULL DEFAULT 0,
+    headers      TEXT,
+    body         BLOB,
+    created_at   TIMESTAMP    NOT NULL,
+    expires_at   TIMESTAMP    NOT NULL
+);
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS users;
+-- +goose StatementEnd
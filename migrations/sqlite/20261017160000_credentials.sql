@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE credentials
+(
+    user_uuid       TEXT PRIMARY KEY REFERENCES users (uuid) ON DELETE CASCADE,
+    password_hash   VARCHAR(255) NOT NULL,
+    failed_attempts INTEGER      NOT NULL DEFAULT 0,
+    locked_until    TIMESTAMP,
+    updated_at      TIMESTAMP    NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS credentials;
+-- +goose StatementEnd
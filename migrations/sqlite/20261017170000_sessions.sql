@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE sessions
+(
+    id           TEXT PRIMARY KEY,
+    user_uuid    TEXT         NOT NULL REFERENCES users (uuid) ON DELETE CASCADE,
+    refresh_hash VARCHAR(64)  NOT NULL UNIQUE,
+    device       VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent   VARCHAR(255) NOT NULL DEFAULT '',
+    ip           VARCHAR(45)  NOT NULL DEFAULT '',
+    created_at   TIMESTAMP    NOT NULL,
+    last_used_at TIMESTAMP    NOT NULL,
+    expires_at   TIMESTAMP    NOT NULL,
+    revoked_at   TIMESTAMP
+);
+CREATE INDEX sessions_user_uuid_idx ON sessions (user_uuid);
+CREATE TABLE rotated_refresh_tokens
+(
+    hash       VARCHAR(64)  PRIMARY KEY,
+    session_id TEXT         NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+    rotated_at TIMESTAMP    NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS rotated_refresh_tokens;
+DROP TABLE IF EXISTS sessions;
+-- +goose StatementEnd
@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SQLite can't change a primary key, so the table is rebuilt. Existing keys
+-- were stored for no client in particular, so nobody's requests find them any
+-- more and they expire unused.
+CREATE TABLE idempotency_keys_new
+(
+    client       VARCHAR(255) NOT NULL DEFAULT '',
+    key          VARCHAR(255) NOT NULL,
+    request_hash VARCHAR(64)  NOT NULL,
+    status       INTEGER      NOT NULL DEFAULT 0,
+    headers      TEXT,
+    body         BLOB,
+    created_at   TIMESTAMP    NOT NULL,
+    expires_at   TIMESTAMP    NOT NULL,
+    locked_until TIMESTAMP,
+    PRIMARY KEY (client, key)
+);
+INSERT INTO idempotency_keys_new (key, request_hash, status, headers, body, created_at, expires_at)
+SELECT key, request_hash, status, headers, body, created_at, expires_at FROM idempotency_keys;
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_new RENAME TO idempotency_keys;
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE idempotency_keys_old
+(
+    key          VARCHAR(255) PRIMARY KEY,
+    request_hash VARCHAR(64)  NOT NULL,
+    status       INTEGER      NOT NULL DEFAULT 0,
+    headers      TEXT,
+    body         BLOB,
+    created_at   TIMESTAMP    NOT NULL,
+    expires_at   TIMESTAMP    NOT NULL
+);
+INSERT INTO idempotency_keys_old (key, request_hash, status, headers, body, created_at, expires_at)
+SELECT key, request_hash, status, headers, body, created_at, expires_at FROM idempotency_keys WHERE client = '';
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_old RENAME TO idempotency_keys;
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+-- +goose StatementEnd
@@ -0,0 +1,138 @@
+// Package ratelimit implements token bucket rate limits.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: Burst requests at once, refilled at Rate per
+// second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Window is the time an empty bucket takes to fill up.
+func (l Limit) Window() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Burst, l.Window())
+}
+
+// ParseLimit parses limits such as "100/m": 100 requests, refilled over a
+// minute. The period is s, m, h or a duration such as 10s. "" means no limit
+// and parses to the zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, want requests/period such as 100/m", s)
+	}
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		d, err = time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return Limit{}, fmt.Errorf("invalid rate limit period %q", period)
+		}
+	}
+	return Limit{Rate: float64(n) / d.Seconds(), Burst: n}, nil
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until a token is available when the request
+	// wasn't allowed.
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is how long after last the bucket is full again.
+	full time.Duration
+}
+
+// MemoryStore keeps buckets in process. Buckets that filled up again are
+// dropped now and then, so memory stays bounded by the active clients.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take takes a token from the bucket of key if one is left.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+		s.lastSweep = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = refill(b, limit, now)
+	b.last = now
+
+	res := Result{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	res.Remaining = int(math.Floor(b.tokens))
+	res.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+	b.full = res.Reset
+	return res, nil
+}
+
+// sweep drops the buckets that are full by now, as a new bucket would be.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.last) >= b.full {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func refill(b *bucket, limit Limit, now time.Time) float64 {
+	return math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{in: "", want: Limit{}},
+		{in: "10/s", want: Limit{Rate: 10, Burst: 10}},
+		{in: "120/m", want: Limit{Rate: 2, Burst: 120}},
+		{in: "5/10s", want: Limit{Rate: 0.5, Burst: 5}},
+		{in: "10", wantErr: true},
+		{in: "0/m", wantErr: true},
+		{in: "10/week", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if tt.wantErr {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	limit := Limit{Rate: 1, Burst: 2}
+
+	for want := 1; want >= 0; want-- {
+		res, err := s.Take(ctx, "a", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, want, res.Remaining)
+	}
+	res, _ := s.Take(ctx, "a", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 2*time.Second, res.Reset)
+
+	res, _ = s.Take(ctx, "b", limit)
+	assert.True(t, res.Allowed, "buckets are per key")
+
+	now = now.Add(1500 * time.Millisecond)
+	res, _ = s.Take(ctx, "a", limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	res, _ = s.Take(ctx, "a", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	// Full buckets are swept, the one in use stays.
+	now = now.Add(time.Minute)
+	slow := Limit{Rate: 1.0 / 3600, Burst: 1}
+	res, _ = s.Take(ctx, "c", slow)
+	assert.True(t, res.Allowed)
+	now = now.Add(2 * time.Minute)
+	_, _ = s.Take(ctx, "a", limit)
+	assert.NotContains(t, s.buckets, "b")
+	assert.Contains(t, s.buckets, "c")
+	res, _ = s.Take(ctx, "c", slow)
+	assert.False(t, res.Allowed)
+}
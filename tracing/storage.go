@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"user-service/db"
+	"user-service/handlers"
+)
+
+// Storage wraps next with a span per call. The queries StDb runs are
+// children of it.
+func Storage(next handlers.Storage) handlers.Storage {
+	return &storage{next: next, tracer: otel.Tracer(instrumentation)}
+}
+
+type storage struct {
+	next   handlers.Storage
+	tracer trace.Tracer
+}
+
+func (s *storage) start(ctx context.Context, method string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "storage."+method, trace.WithAttributes(semconv.CodeFunctionName(method)))
+}
+
+// end records err on the span. Missing users and conflicts are expected
+// answers rather than failures, so only mark the span as failed otherwise.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		kind := db.KindName(err)
+		span.SetAttributes(semconv.ErrorTypeKey.String(kind))
+		if kind != "not_found" && kind != "conflict" && kind != "invalid_input" {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func (s *storage) AddUser(ctx context.Context, name string, email string) (user *db.User, err error) {
+	ctx, span := s.start(ctx, "AddUser")
+	defer func() { end(span, err) }()
+	return s.next.AddUser(ctx, name, email)
+}
+
+func (s *storage) GetUser(ctx context.Context, uuid string, withDeleted bool) (user *db.User, err error) {
+	ctx, span := s.start(ctx, "GetUser")
+	defer func() { end(span, err) }()
+	return s.next.GetUser(ctx, uuid, withDeleted)
+}
+
+func (s *storage) UpdateUser(ctx context.Context, uuid string, changes db.UserChanges, version int) (user *db.User, err error) {
+	ctx, span := s.start(ctx, "UpdateUser")
+	defer func() { end(span, err) }()
+	return s.next.UpdateUser(ctx, uuid, changes, version)
+}
+
+func (s *storage) DeleteUser(ctx context.Context, uuid string, hard bool, version int) (err error) {
+	ctx, span := s.start(ctx, "DeleteUser")
+	defer func() { end(span, err) }()
+	return s.next.DeleteUser(ctx, uuid, hard, version)
+}
+
+func (s *storage) RestoreUser(ctx context.Context, uuid string) (user *db.User, err error) {
+	ctx, span := s.start(ctx, "RestoreUser")
+	defer func() { end(span, err) }()
+	return s.next.RestoreUser(ctx, uuid)
+}
+
+func (s *storage) ListUsers(ctx context.Context, filter db.UserFilter) (page *db.UserPage, err error) {
+	ctx, span := s.start(ctx, "ListUsers")
+	defer func() { end(span, err) }()
+	return s.next.ListUsers(ctx, filter)
+}